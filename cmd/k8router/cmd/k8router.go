@@ -3,13 +3,17 @@ package cmd
 import (
 	"flag"
 	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/acme"
+	"github.com/vsk8s/k8router/pkg/admin"
 	"github.com/vsk8s/k8router/pkg/config"
 	"github.com/vsk8s/k8router/pkg/haproxy"
 	"github.com/vsk8s/k8router/pkg/loadbalancer"
 	"github.com/vsk8s/k8router/pkg/router"
 	"github.com/vsk8s/k8router/pkg/state"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 )
 
 // K8router main object, just contains command line arguments
@@ -43,20 +47,70 @@ func (k8r *K8router) Run() {
 
 	eventChan := make(chan state.ClusterState)
 	loadBalancerChan := make(chan state.LoadBalancerChange)
+	clusters := map[string]*router.Cluster{}
 	for _, clusterCfg := range cfg.Clusters {
 		log.WithField("cluster", clusterCfg.Name).Debug("Starting cluster handler")
 		cluster := router.Initialize(clusterCfg, eventChan, loadBalancerChan)
+		cluster.SetEventSettings(cfg.Events)
 		cluster.Start()
+		clusters[clusterCfg.Name] = cluster
 	}
 	log.Debug("All cluster handlers loaded")
 
+	// Forward events about ingresses to the clusters they belong to
+	ingressEventChan := make(chan state.IngressEvent, 100)
+	go func() {
+		for event := range ingressEventChan {
+			if cluster, ok := clusters[event.Cluster]; ok {
+				cluster.RecordIngressEvent(event)
+			}
+		}
+	}()
+
 	handler, err := haproxy.Initialize(eventChan, *cfg)
 	if err != nil {
 		log.WithField("config", k8r.configPath).WithError(err).Fatal("Couldn't init haproxy handler!")
 	}
+	if cfg.ACME != nil {
+		acmeManager, err := acme.Initialize(*cfg.ACME)
+		if err != nil {
+			log.WithError(err).Fatal("Couldn't init ACME manager!")
+		}
+		err = acmeManager.Start()
+		if err != nil {
+			log.WithError(err).Fatal("Couldn't start ACME manager!")
+		}
+		handler.SetCertificateIssuer(acmeManager)
+		log.Debug("ACME manager started")
+	}
+	handler.SetIngressEvents(ingressEventChan)
 	handler.Start()
 	log.Debug("HAProxy handler loaded")
 
+	if cfg.AdminListen != "" {
+		token := ""
+		if cfg.AdminTokenFile != "" {
+			rawToken, err := ioutil.ReadFile(cfg.AdminTokenFile)
+			if err != nil {
+				log.WithField("path", cfg.AdminTokenFile).WithError(err).Fatal("Couldn't read admin token!")
+			}
+			token = strings.TrimSpace(string(rawToken))
+			if token == "" {
+				log.WithField("path", cfg.AdminTokenFile).Fatal("Admin token is empty!")
+			}
+		} else {
+			log.Warning("No adminTokenFile configured, the admin API is disabled")
+		}
+		adminServer := admin.Initialize(cfg.AdminListen, token)
+		adminServer.Handle("/clusters", handler.DrainAPI())
+		adminServer.Handle("/clusters/", handler.DrainAPI())
+		err = adminServer.Start()
+		if err != nil {
+			log.WithField("listen", cfg.AdminListen).WithError(err).Fatal("Couldn't start admin server!")
+		}
+		log.Debug("Admin server started")
+	}
+
 	balancer := loadbalancer.Initialize(cfg.IPs, loadBalancerChan)
 	balancer.Start()
 	log.Debug("balancer started")
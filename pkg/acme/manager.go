@@ -0,0 +1,449 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/certificate"
+	"github.com/vsk8s/k8router/pkg/config"
+	acmeapi "golang.org/x/crypto/acme"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often all certificates are checked for renewal
+	renewalCheckInterval = 1 * time.Hour
+	// How long to wait before retrying a host after a failed issuance
+	retryInterval = 1 * time.Hour
+	// Timeout for issuing a single certificate
+	issueTimeout = 5 * time.Minute
+	// Path prefix of HTTP-01 challenges
+	challengePathPrefix = "/.well-known/acme-challenge/"
+)
+
+// Manager issues and renews certificates for hosts using HTTP-01 challenges
+type Manager struct {
+	config config.ACME
+
+	client *acmeapi.Client
+
+	// Protects everything below
+	mutex sync.Mutex
+
+	// Hosts we want certificates for
+	hosts []string
+
+	// Host to path of a valid certificate for it
+	certificates map[string]string
+
+	// Host to time of the last failed issuance
+	failures map[string]time.Time
+
+	// Token to key authorization of all pending challenges
+	challenges map[string]string
+
+	// Used to wake up the event loop after the host list changed
+	hostsChanged chan bool
+
+	// Notifies listeners that the set of certificates changed
+	updates chan bool
+
+	// Channel to stop our goroutine
+	stopper chan bool
+
+	server *http.Server
+}
+
+// Initialize a new ACME manager, loading or creating the account key and all stored certificates
+func Initialize(cfg config.ACME) (*Manager, error) {
+	err := os.MkdirAll(path.Join(cfg.StorageDirectory, "certs"), 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create storage directory")
+	}
+	key, err := loadOrCreateKey(path.Join(cfg.StorageDirectory, "account.key"))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't load account key")
+	}
+	httpClient := http.DefaultClient
+	if cfg.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		bundle, err := ioutil.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't read CA bundle")
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("CA bundle doesn't contain any certificate")
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	manager := &Manager{
+		config: cfg,
+		client: &acmeapi.Client{
+			Key:          key,
+			DirectoryURL: cfg.DirectoryURL,
+			HTTPClient:   httpClient,
+			UserAgent:    "k8router",
+		},
+		certificates: map[string]string{},
+		failures:     map[string]time.Time{},
+		challenges:   map[string]string{},
+		hostsChanged: make(chan bool, 1),
+		updates:      make(chan bool, 1),
+		stopper:      make(chan bool),
+	}
+	manager.loadCertificates()
+	return manager, nil
+}
+
+// Start the challenge responder and the issuance loop
+func (m *Manager) Start() error {
+	listener, err := net.Listen("tcp", m.config.ChallengeListen)
+	if err != nil {
+		return errors.Wrap(err, "couldn't start challenge responder")
+	}
+	m.server = &http.Server{Handler: m}
+	go func() {
+		err := m.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("ACME challenge responder failed")
+		}
+	}()
+	go m.eventLoop()
+	return nil
+}
+
+// Stop the manager
+func (m *Manager) Stop() {
+	m.stopper <- true
+	_ = m.server.Close()
+}
+
+// ChallengeAddress returns the address HAProxy should forward HTTP-01 challenges to
+func (m *Manager) ChallengeAddress() string {
+	return m.config.ChallengeListen
+}
+
+// Updates notifies about new or renewed certificates
+func (m *Manager) Updates() <-chan bool {
+	return m.updates
+}
+
+// SetHosts sets the list of hosts certificates should be issued for
+func (m *Manager) SetHosts(hosts []string) {
+	sorted := append([]string{}, hosts...)
+	sort.Strings(sorted)
+	m.mutex.Lock()
+	changed := strings.Join(sorted, ",") != strings.Join(m.hosts, ",")
+	m.hosts = sorted
+	if changed {
+		m.pruneCertificates()
+	}
+	m.mutex.Unlock()
+	if changed {
+		select {
+		case m.hostsChanged <- true:
+		default:
+		}
+	}
+}
+
+// Certificates returns a map of host to certificate path for all hosts that have a valid certificate
+func (m *Manager) Certificates() map[string]string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	certificates := map[string]string{}
+	for host, file := range m.certificates {
+		certificates[host] = file
+	}
+	return certificates
+}
+
+// ServeHTTP answers HTTP-01 challenges
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, challengePathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	m.mutex.Lock()
+	response, ok := m.challenges[strings.TrimPrefix(r.URL.Path, challengePathPrefix)]
+	m.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(response))
+}
+
+func (m *Manager) eventLoop() {
+	registered := false
+	renewalTicks := time.NewTicker(renewalCheckInterval)
+	defer renewalTicks.Stop()
+	for {
+		select {
+		case _ = <-m.stopper:
+			log.Debug("Returning from ACME event loop after stop request")
+			return
+		case _ = <-m.hostsChanged:
+		case _ = <-renewalTicks.C:
+		}
+		if !registered {
+			err := m.register()
+			if err != nil {
+				log.WithError(err).Error("Couldn't register ACME account")
+				continue
+			}
+			registered = true
+		}
+		if m.issueMissing() {
+			select {
+			case m.updates <- true:
+			default:
+			}
+		}
+	}
+}
+
+func (m *Manager) register() error {
+	ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+	defer cancel()
+	account := &acmeapi.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	_, err := m.client.Register(ctx, account, acmeapi.AcceptTOS)
+	if err != nil && err != acmeapi.ErrAccountAlreadyExists {
+		return err
+	}
+	return nil
+}
+
+// Issue certificates for all hosts without a valid one. Returns whether any certificate was issued
+func (m *Manager) issueMissing() bool {
+	m.mutex.Lock()
+	hosts := append([]string{}, m.hosts...)
+	m.mutex.Unlock()
+
+	issued := false
+	for _, host := range hosts {
+		file := m.certificatePath(host)
+		if !m.needsRenewal(file) {
+			continue
+		}
+		m.mutex.Lock()
+		lastFailure, failed := m.failures[host]
+		m.mutex.Unlock()
+		if failed && time.Since(lastFailure) < retryInterval {
+			continue
+		}
+		log.WithField("host", host).Info("Requesting certificate via ACME")
+		err := m.issue(host, file)
+		m.mutex.Lock()
+		if err != nil {
+			m.failures[host] = time.Now()
+			log.WithField("host", host).WithError(err).Error("Couldn't issue certificate")
+		} else {
+			delete(m.failures, host)
+			m.certificates[host] = file
+			issued = true
+			log.WithField("host", host).Info("Issued certificate via ACME")
+		}
+		m.mutex.Unlock()
+	}
+	return issued
+}
+
+// Check whether the certificate at the given path is missing or about to expire
+func (m *Manager) needsRenewal(file string) bool {
+	bundle, err := certificate.Load(file)
+	if err != nil {
+		return true
+	}
+	renewBefore := time.Duration(m.config.RenewBeforeDays) * 24 * time.Hour
+	return time.Now().Add(renewBefore).After(bundle.Leaves[0].NotAfter)
+}
+
+// Obtain a certificate for a single host and store it at the given path
+func (m *Manager) issue(host string, file string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+	defer cancel()
+
+	order, err := m.client.AuthorizeOrder(ctx, acmeapi.DomainIDs(host))
+	if err != nil {
+		return errors.Wrap(err, "order failed")
+	}
+	for _, authzURL := range order.AuthzURLs {
+		err = m.authorize(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return errors.Wrap(err, "order not ready")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{host}}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return errors.Wrap(err, "finalization failed")
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, der := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	tmpFile := file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// Fulfill a single authorization using HTTP-01
+func (m *Manager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get authorization")
+	}
+	if authz.Status == acmeapi.StatusValid {
+		return nil
+	}
+	var challenge *acmeapi.Challenge
+	for _, candidate := range authz.Challenges {
+		if candidate.Type == "http-01" {
+			challenge = candidate
+			break
+		}
+	}
+	if challenge == nil {
+		return errors.New("no HTTP-01 challenge offered")
+	}
+	response, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.challenges[challenge.Token] = response
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		delete(m.challenges, challenge.Token)
+		m.mutex.Unlock()
+	}()
+
+	_, err = m.client.Accept(ctx, challenge)
+	if err != nil {
+		return errors.Wrap(err, "couldn't accept challenge")
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	if err != nil {
+		return errors.Wrap(err, "authorization failed")
+	}
+	return nil
+}
+
+// Pick up all valid certificates already stored on disk
+func (m *Manager) loadCertificates() {
+	files, err := ioutil.ReadDir(path.Join(m.config.StorageDirectory, "certs"))
+	if err != nil {
+		log.WithError(err).Warning("Couldn't list stored ACME certificates")
+		return
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".pem") {
+			continue
+		}
+		host := strings.TrimSuffix(file.Name(), ".pem")
+		if m.hasValidCertificate(host) {
+			m.certificates[host] = m.certificatePath(host)
+		}
+	}
+}
+
+// Drop certificates of hosts we no longer issue for and pick up stored ones of hosts that came back.
+// Has to be called with the mutex held
+func (m *Manager) pruneCertificates() {
+	certificates := map[string]string{}
+	for _, host := range m.hosts {
+		if file, ok := m.certificates[host]; ok {
+			certificates[host] = file
+		} else if m.hasValidCertificate(host) {
+			certificates[host] = m.certificatePath(host)
+		}
+	}
+	m.certificates = certificates
+}
+
+// Check whether a stored, not yet expired certificate exists for the given host
+func (m *Manager) hasValidCertificate(host string) bool {
+	bundle, err := certificate.Load(m.certificatePath(host))
+	return err == nil && time.Now().Before(bundle.Leaves[0].NotAfter)
+}
+
+func (m *Manager) certificatePath(host string) string {
+	return path.Join(m.config.StorageDirectory, "certs", host+".pem")
+}
+
+// Load the account key from disk or create a new one
+func loadOrCreateKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM data found")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
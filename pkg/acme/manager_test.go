@@ -0,0 +1,129 @@
+package acme
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/certificate/certificatetest"
+	"github.com/vsk8s/k8router/pkg/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Create a manager with its storage in a temporary directory
+func createUUT(t *testing.T, cfg config.ACME) (*Manager, func()) {
+	dir, err := ioutil.TempDir("", "k8router-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.StorageDirectory = dir
+	if cfg.RenewBeforeDays == 0 {
+		cfg.RenewBeforeDays = 30
+	}
+	uut, err := Initialize(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uut, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestChallengeResponder(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut, cleanup := createUUT(t, config.ACME{})
+	defer cleanup()
+	uut.challenges["token"] = "token.thumbprint"
+
+	recorder := httptest.NewRecorder()
+	uut.ServeHTTP(recorder, httptest.NewRequest("GET", "/.well-known/acme-challenge/token", nil))
+	g.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(recorder.Body.String()).To(gomega.Equal("token.thumbprint"))
+
+	recorder = httptest.NewRecorder()
+	uut.ServeHTTP(recorder, httptest.NewRequest("GET", "/.well-known/acme-challenge/other", nil))
+	g.Expect(recorder.Code).To(gomega.Equal(http.StatusNotFound))
+
+	recorder = httptest.NewRecorder()
+	uut.ServeHTTP(recorder, httptest.NewRequest("GET", "/token", nil))
+	g.Expect(recorder.Code).To(gomega.Equal(http.StatusNotFound))
+}
+
+// Stored certificates have to be picked up and renewed in time
+func TestStoredCertificates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut, cleanup := createUUT(t, config.ACME{})
+	defer cleanup()
+	certDir := path.Join(uut.config.StorageDirectory, "certs")
+	certificatetest.Write(t, certDir, "valid.example.org.pem", time.Now().Add(90*24*time.Hour), "valid.example.org")
+	certificatetest.Write(t, certDir, "renew.example.org.pem", time.Now().Add(10*24*time.Hour), "renew.example.org")
+	certificatetest.Write(t, certDir, "expired.example.org.pem", time.Now().Add(-time.Hour), "expired.example.org")
+
+	// The account key has to survive a restart
+	key := uut.client.Key
+	uut, err := Initialize(uut.config)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.client.Key).To(gomega.Equal(key))
+
+	certificates := uut.Certificates()
+	g.Expect(certificates).To(gomega.HaveLen(2))
+	g.Expect(certificates).To(gomega.HaveKeyWithValue("valid.example.org", path.Join(certDir, "valid.example.org.pem")))
+	g.Expect(uut.needsRenewal(certificates["valid.example.org"])).To(gomega.BeFalse())
+	g.Expect(uut.needsRenewal(certificates["renew.example.org"])).To(gomega.BeTrue())
+	g.Expect(uut.needsRenewal(path.Join(certDir, "missing.example.org.pem"))).To(gomega.BeTrue())
+}
+
+// Certificates of hosts that are gone must no longer be handed out, but come back with their host
+func TestSetHostsPrunesCertificates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut, cleanup := createUUT(t, config.ACME{})
+	defer cleanup()
+	certDir := path.Join(uut.config.StorageDirectory, "certs")
+	certificatetest.Write(t, certDir, "a.example.org.pem", time.Now().Add(90*24*time.Hour), "a.example.org")
+	certificatetest.Write(t, certDir, "b.example.org.pem", time.Now().Add(90*24*time.Hour), "b.example.org")
+	uut.loadCertificates()
+	g.Expect(uut.Certificates()).To(gomega.HaveLen(2))
+
+	uut.SetHosts([]string{"a.example.org", "c.example.org"})
+	g.Expect(uut.Certificates()).To(gomega.Equal(map[string]string{
+		"a.example.org": path.Join(certDir, "a.example.org.pem"),
+	}))
+
+	uut.SetHosts([]string{"b.example.org"})
+	g.Expect(uut.Certificates()).To(gomega.Equal(map[string]string{
+		"b.example.org": path.Join(certDir, "b.example.org.pem"),
+	}))
+}
+
+// Issue a certificate from a local pebble instance. Run pebble with 'PEBBLE_VA_ALWAYS_VALID=1' (or with its
+// httpPort pointing to K8ROUTER_PEBBLE_CHALLENGE_LISTEN and a DNS server resolving the test host to localhost), then
+// set K8ROUTER_PEBBLE_DIRECTORY to pebble's directory URL and K8ROUTER_PEBBLE_CA to pebble's TLS CA certificate.
+func TestPebbleIssuance(t *testing.T) {
+	directory := os.Getenv("K8ROUTER_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("K8ROUTER_PEBBLE_DIRECTORY not set")
+	}
+	challengeListen := os.Getenv("K8ROUTER_PEBBLE_CHALLENGE_LISTEN")
+	if challengeListen == "" {
+		challengeListen = "127.0.0.1:5002"
+	}
+	g := gomega.NewGomegaWithT(t)
+	uut, cleanup := createUUT(t, config.ACME{
+		DirectoryURL:    directory,
+		CABundle:        os.Getenv("K8ROUTER_PEBBLE_CA"),
+		ChallengeListen: challengeListen,
+	})
+	defer cleanup()
+	g.Expect(uut.Start()).To(gomega.BeNil())
+	defer uut.Stop()
+
+	uut.SetHosts([]string{"k8router.example.org"})
+	select {
+	case _ = <-uut.Updates():
+	case _ = <-time.After(2 * time.Minute):
+		t.Fatal("Timeout waiting for certificate")
+	}
+	g.Expect(uut.Certificates()).To(gomega.HaveKey("k8router.example.org"))
+	g.Expect(uut.needsRenewal(uut.Certificates()["k8router.example.org"])).To(gomega.BeFalse())
+}
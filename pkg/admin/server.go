@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+)
+
+// Server exposes metrics and the admin API via HTTP
+type Server struct {
+	listen string
+
+	// Bearer token required by the admin API (the admin API is disabled if empty)
+	token string
+
+	mux *http.ServeMux
+
+	server *http.Server
+}
+
+// Initialize a new admin server listening on the given address. Admin API requests have to carry the given bearer
+// token, metrics are served to everybody
+func Initialize(listen string, token string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &Server{
+		listen: listen,
+		token:  token,
+		mux:    mux,
+		server: &http.Server{Handler: mux},
+	}
+}
+
+// Handle registers an additional admin API handler, which is only reachable with the token. Call before Start()
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// Check whether a request carries the admin token
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+	expected := "Bearer " + s.token
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// Start serving
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return errors.Wrap(err, "couldn't listen")
+	}
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Admin server failed")
+		}
+	}()
+	return nil
+}
+
+// Stop serving
+func (s *Server) Stop() {
+	_ = s.server.Close()
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The admin API is only reachable with the token, metrics are served to everybody
+func TestAdminToken(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, token := range []string{"secret", ""} {
+		uut := Initialize("127.0.0.1:0", token)
+		uut.Handle("/clusters", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		request := func(path string, authorization string) int {
+			recorder := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, path, nil)
+			if authorization != "" {
+				r.Header.Set("Authorization", authorization)
+			}
+			uut.mux.ServeHTTP(recorder, r)
+			return recorder.Code
+		}
+		g.Expect(request("/clusters", "")).To(gomega.Equal(http.StatusUnauthorized))
+		g.Expect(request("/clusters", "Bearer wrong")).To(gomega.Equal(http.StatusUnauthorized))
+		// Without a token, nobody gets in
+		g.Expect(request("/clusters", "Bearer ")).To(gomega.Equal(http.StatusUnauthorized))
+		if token != "" {
+			g.Expect(request("/clusters", "Bearer "+token)).To(gomega.Equal(http.StatusOK))
+		}
+		g.Expect(request("/metrics", "")).To(gomega.Equal(http.StatusOK))
+	}
+}
@@ -0,0 +1,167 @@
+package certificate
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bundle contains all certificates found at a configured certificate path
+type Bundle struct {
+	// Path the bundle was loaded from (either a single PEM file or a directory of PEM files)
+	Path string
+	// Leaf certificates, one per PEM file
+	Leaves []*x509.Certificate
+	// Latest modification time of the path and all files in it
+	ModTime time.Time
+}
+
+// Load parses all PEM files at the given path. Directories are handled like HAProxy does, e.g. every file is treated
+// as a separate chain where the first certificate is the leaf
+func Load(certPath string) (*Bundle, error) {
+	info, err := os.Stat(certPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat failed")
+	}
+	modTime, err := latestModTime(certPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat failed")
+	}
+	bundle := Bundle{
+		Path:    certPath,
+		ModTime: modTime,
+	}
+	files := []string{certPath}
+	if info.IsDir() {
+		files = nil
+		entries, err := ioutil.ReadDir(certPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "directory read failed")
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, path.Join(certPath, entry.Name()))
+		}
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "file read failed")
+		}
+		leaf, err := ParseLeaf(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse '%s'", file)
+		}
+		bundle.Leaves = append(bundle.Leaves, leaf)
+	}
+	if len(bundle.Leaves) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return &bundle, nil
+}
+
+// ParseLeaf returns the first certificate contained in the given PEM data
+func ParseLeaf(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// Domains returns the sorted list of DNS SANs of all leaf certificates
+func (b *Bundle) Domains() []string {
+	seen := map[string]bool{}
+	var domains []string
+	for _, leaf := range b.Leaves {
+		for _, name := range leaf.DNSNames {
+			name = strings.ToLower(name)
+			if !seen[name] {
+				seen[name] = true
+				domains = append(domains, name)
+			}
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// NotAfter returns the earliest expiry date of all leaf certificates
+func (b *Bundle) NotAfter() time.Time {
+	notAfter := b.Leaves[0].NotAfter
+	for _, leaf := range b.Leaves[1:] {
+		if leaf.NotAfter.Before(notAfter) {
+			notAfter = leaf.NotAfter
+		}
+	}
+	return notAfter
+}
+
+// Covers checks whether any leaf certificate of this bundle is valid for the given host
+func (b *Bundle) Covers(host string) bool {
+	for _, domain := range b.Domains() {
+		if MatchesDomain(domain, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsModified checks whether the bundle's files have changed on disk since the bundle was loaded
+func (b *Bundle) IsModified() bool {
+	modTime, err := latestModTime(b.Path)
+	if err != nil {
+		return true
+	}
+	return !modTime.Equal(b.ModTime)
+}
+
+// Get the latest modification time of a path and (if it is a directory) the files in it
+func latestModTime(certPath string) (time.Time, error) {
+	info, err := os.Stat(certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	modTime := info.ModTime()
+	if !info.IsDir() {
+		return modTime, nil
+	}
+	entries, err := ioutil.ReadDir(certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, entry := range entries {
+		if entry.ModTime().After(modTime) {
+			modTime = entry.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// MatchesDomain checks whether a certificate domain (which may contain a wildcard) matches a host name
+func MatchesDomain(pattern string, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+	// A wildcard only ever covers exactly one label
+	dot := strings.Index(host, ".")
+	if dot <= 0 {
+		return false
+	}
+	return host[dot:] == pattern[1:]
+}
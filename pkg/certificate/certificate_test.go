@@ -0,0 +1,60 @@
+package certificate
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/certificate/certificatetest"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMatchesDomain(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	g.Expect(MatchesDomain("example.org", "example.org")).To(gomega.BeTrue())
+	g.Expect(MatchesDomain("example.org", "Example.ORG")).To(gomega.BeTrue())
+	g.Expect(MatchesDomain("example.org", "foo.example.org")).To(gomega.BeFalse())
+	g.Expect(MatchesDomain("*.example.org", "foo.example.org")).To(gomega.BeTrue())
+	g.Expect(MatchesDomain("*.example.org", "example.org")).To(gomega.BeFalse())
+	g.Expect(MatchesDomain("*.example.org", "a.foo.example.org")).To(gomega.BeFalse())
+	g.Expect(MatchesDomain("*.org", "fooorg")).To(gomega.BeFalse())
+	g.Expect(MatchesDomain("*.org", ".org")).To(gomega.BeFalse())
+}
+
+// Load a directory of certificates and check the resulting domains
+func TestLoadDirectory(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-cert")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(24 * time.Hour)
+	certificatetest.Write(t, dir, "a.pem", notAfter, "b.example.org", "a.example.org")
+	certificatetest.Write(t, dir, "b.pem", notAfter, "*.example.com", "a.example.org")
+
+	uut, err := Load(dir)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Leaves).To(gomega.HaveLen(2))
+	g.Expect(uut.Domains()).To(gomega.Equal([]string{"*.example.com", "a.example.org", "b.example.org"}))
+	g.Expect(uut.Covers("foo.example.com")).To(gomega.BeTrue())
+	g.Expect(uut.Covers("c.example.org")).To(gomega.BeFalse())
+	g.Expect(uut.IsModified()).To(gomega.BeFalse())
+
+	// Adding a file has to be detected
+	later := time.Now().Add(time.Minute)
+	file := certificatetest.Write(t, dir, "c.pem", notAfter, "c.example.org")
+	g.Expect(os.Chtimes(file, later, later)).To(gomega.BeNil())
+	g.Expect(uut.IsModified()).To(gomega.BeTrue())
+}
+
+func TestLoadErrors(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, err := Load("/nonexistent/k8router")
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	dir, err := ioutil.TempDir("", "k8router-cert")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+	_, err = Load(dir)
+	g.Expect(err).NotTo(gomega.BeNil())
+}
@@ -0,0 +1,52 @@
+// Package certificatetest provides self-signed certificates for tests
+package certificatetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"testing"
+	"time"
+)
+
+// Generate creates a self-signed certificate for the given domains, returning certificate and key in PEM format
+func Generate(t *testing.T, notAfter time.Time, domains ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "k8router test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     domains,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// Write creates a combined certificate and key PEM file named 'name' in 'dir' and returns its path
+func Write(t *testing.T, dir string, name string, notAfter time.Time, domains ...string) string {
+	cert, key := Generate(t, notAfter, domains...)
+	file := path.Join(dir, name)
+	err := ioutil.WriteFile(file, append(cert, key...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
@@ -4,7 +4,12 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"k8s.io/apimachinery/pkg/labels"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // CertificateInternal contains everything you ever wanted to know about a certificate
@@ -13,8 +18,36 @@ type CertificateInternal struct {
 	Name string `yaml:"name"`
 	// Path to certificate directory
 	Cert string `yaml:"cert"`
-	// List of domains this certificate is valid for
+	// List of domains this certificate is valid for. Derived from the certificate's SANs if omitted
 	Domains []string `yaml:"domains"`
+	// Whether to use this certificate for clients which don't send a known SNI
+	Default bool `yaml:"default"`
+	// Whether to redirect plain HTTP requests for this certificate's hosts to HTTPS (global setting if omitted)
+	RedirectToHTTPS *bool `yaml:"redirectToHTTPS"`
+	// Max age of the Strict-Transport-Security header for this certificate's hosts (global setting if omitted)
+	HSTSMaxAge *time.Duration `yaml:"hstsMaxAge"`
+	// CA bundle to verify client certificates with (clients aren't asked for certificates if empty)
+	ClientCA string `yaml:"clientCA"`
+	// Whether client certificates are 'required' or 'optional'
+	ClientVerify string `yaml:"clientVerify"`
+	// Revocation list for client certificates (optional)
+	ClientCRL string `yaml:"clientCRL"`
+	// TLS settings for this certificate's hosts, overriding the global ones
+	TLS TLS `yaml:"tls"`
+}
+
+// TLS tunes the handshake of the frontends terminating TLS. Empty values use the global setting or HAProxy's default
+type TLS struct {
+	// Protocols offered via ALPN, in order of preference (e.g. 'h2' and 'http/1.1')
+	ALPN []string `yaml:"alpn"`
+	// Offer 'h2' and 'http/1.1' via ALPN (ignored if alpn is set)
+	HTTP2 *bool `yaml:"http2"`
+	// Oldest TLS version to accept ('TLSv1.0' to 'TLSv1.3')
+	MinVersion string `yaml:"minVersion"`
+	// Cipher list for TLS up to 1.2 (OpenSSL format)
+	Ciphers string `yaml:"ciphers"`
+	// Cipher suites for TLS 1.3 (OpenSSL format)
+	CipherSuites string `yaml:"cipherSuites"`
 }
 
 // ClusterInternal describes all information we need to know about a cluster
@@ -23,12 +56,177 @@ type ClusterInternal struct {
 	Name string `yaml:"name"`
 	// Path to kubeconfig used to connect to the cluster
 	Kubeconfig string `yaml:"kubeconfig"`
+	// Context of the kubeconfig to use (the current context if empty)
+	Context string `yaml:"context"`
+	// Connect with the service account of the pod k8router runs in instead of a kubeconfig
+	InCluster bool `yaml:"inCluster"`
+	// Overrides and tuning of the connection to the API server
+	Connection Connection `yaml:"connection"`
 	// Namespace where the Ingress is located
 	IngressNamespace string `yaml:"ingressNamespace"`
 	// Name of the ingress deployment (the pod label "app.kubernetes.io/name" will be checked)
 	IngressAppName string `yaml:"ingressDeamonSetName"`
 	// Port the ingress pods use
 	IngressPort int `yaml:"ingressPort"`
+	// Port the ingress pods terminate TLS on, used for passthrough hosts
+	IngressTLSPort int `yaml:"ingressTLSPort"`
+	// Label selector for the ingress pods (all pods in IngressNamespace if empty)
+	PodSelector string `yaml:"podSelector"`
+	// Only watch Ingresses and Services in these namespaces (all namespaces if empty)
+	Namespaces []string `yaml:"namespaces"`
+	// Never watch Ingresses and Services in these namespaces
+	ExcludedNamespaces []string `yaml:"excludedNamespaces"`
+	// Only watch Ingresses matching this label selector
+	IngressSelector string `yaml:"ingressSelector"`
+	// Only watch Services matching this label selector
+	ServiceSelector string `yaml:"serviceSelector"`
+	// Share of traffic this cluster gets for hosts which exist in several clusters (relative to the other clusters,
+	// no traffic if zero)
+	Weight *int `yaml:"weight"`
+	// Hosts which exist in several clusters are only routed to the clusters with the highest priority, others are
+	// only used once all ingress pods of these clusters are down
+	Priority int `yaml:"priority"`
+	// Whether to sync TLS certificates from secrets referenced in the ingresses' TLS blocks
+	SyncTLSSecrets bool `yaml:"syncTLSSecrets"`
+	// How HAProxy checks the health of the ingress pods
+	HealthCheck HealthCheck `yaml:"healthCheck"`
+	// Whether namespaces of this cluster may claim hosts via annotation
+	NamespaceHostClaims bool `yaml:"namespaceHostClaims"`
+	// Also route the HTTPRoutes and TLSRoutes attached to Gateways of this GatewayClass (disabled if empty)
+	GatewayClass string `yaml:"gatewayClass"`
+	// Protocol to talk to the ingress pods with ('http/1.1' or 'h2', e.g. for gRPC)
+	BackendProtocol string `yaml:"backendProtocol"`
+}
+
+// Connection overrides parts of the kubeconfig and tunes the client. Zero values keep the kubeconfig's settings
+// or client-go's defaults
+type Connection struct {
+	// URL of the API server
+	Server string `yaml:"server"`
+	// Path to the CA certificates to verify the API server with
+	CAFile string `yaml:"caFile"`
+	// Path to a bearer token, re-read regularly so it may be rotated
+	TokenFile string `yaml:"tokenFile"`
+	// Credential plugin to get the credentials from
+	Exec *ExecCredential `yaml:"exec"`
+	// Requests per second to the API server on average
+	QPS float32 `yaml:"qps"`
+	// Requests to the API server at once
+	Burst int `yaml:"burst"`
+	// Timeout of single requests (watches excluded)
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ExecCredential describes a client-go credential plugin
+type ExecCredential struct {
+	// Command to run
+	Command string `yaml:"command"`
+	// Arguments of the command
+	Args []string `yaml:"args"`
+	// Additional environment variables of the command
+	Env map[string]string `yaml:"env"`
+	// Version of the ExecCredential API the plugin speaks
+	APIVersion string `yaml:"apiVersion"`
+}
+
+// HealthCheck contains the settings for HAProxy's health checks of the ingress pods. Zero values use HAProxy's
+// defaults
+type HealthCheck struct {
+	// HTTP path to request (plain TCP connect if empty)
+	Path string `yaml:"path"`
+	// Port to check (e.g. 10254 for ingress-nginx), the ingress port if zero
+	Port int `yaml:"port"`
+	// HTTP status to expect, any 2xx or 3xx status if zero
+	ExpectStatus int `yaml:"expectStatus"`
+	// Time between two checks
+	Interval time.Duration `yaml:"interval"`
+	// Number of successful checks until a pod is considered healthy
+	Rise int `yaml:"rise"`
+	// Number of failed checks until a pod is considered unhealthy
+	Fall int `yaml:"fall"`
+	// Time to ramp up a pod's weight after it became healthy
+	SlowStart time.Duration `yaml:"slowstart"`
+}
+
+// ACME contains the settings for automatic certificate issuance using HTTP-01 challenges
+type ACME struct {
+	// URL of the ACME directory to use
+	DirectoryURL string `yaml:"directoryURL"`
+	// Contact address for the ACME account
+	Email string `yaml:"email"`
+	// Directory to store the account key and all issued certificates in
+	StorageDirectory string `yaml:"storageDirectory"`
+	// Local address of the challenge responder HAProxy forwards '/.well-known/acme-challenge/' to
+	ChallengeListen string `yaml:"challengeListen"`
+	// Renew certificates this many days before they expire
+	RenewBeforeDays int `yaml:"renewBeforeDays"`
+	// Additional CA certificates to trust when talking to the ACME server (e.g. for pebble)
+	CABundle string `yaml:"caBundle"`
+}
+
+// CertificateExpiry contains the settings for certificate expiry monitoring
+type CertificateExpiry struct {
+	// Warn once a certificate expires in less than any of these numbers of days
+	WarningDays []int `yaml:"warningDays"`
+	// How often to check certificate expiry
+	CheckInterval time.Duration `yaml:"checkInterval"`
+	// Stop using expired certificates for hosts which are covered by another valid (e.g. wildcard) certificate
+	ReplaceExpired bool `yaml:"replaceExpired"`
+}
+
+// HostPolicy restricts which namespaces of which clusters may claim which hosts
+type HostPolicy struct {
+	// Rules owning hosts, checked before namespace claims
+	Rules []HostPolicyRule `yaml:"rules"`
+	// What to do with hosts not covered by any rule or namespace claim ('allow' or 'deny')
+	Default string `yaml:"default"`
+}
+
+// HostPolicyRule reserves hosts for some namespaces of some clusters
+type HostPolicyRule struct {
+	// Host patterns, a '*.' prefix matches a single label
+	Hosts []string `yaml:"hosts"`
+	// Clusters which may claim these hosts (all if empty)
+	Clusters []string `yaml:"clusters"`
+	// Namespaces which may claim these hosts (all if empty)
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// PassthroughRule passes TLS connections for some hosts through without decrypting them
+type PassthroughRule struct {
+	// Host patterns, a '*.' prefix matches a single label
+	Hosts []string `yaml:"hosts"`
+	// Address ('ip:port') to send the connections to instead of the TLS port of the hosts' ingress pods
+	Service string `yaml:"service"`
+}
+
+// Reload limits how often HAProxy is reloaded
+type Reload struct {
+	// Wait until nothing changed for this long before applying changes
+	QuietPeriod time.Duration `yaml:"quietPeriod"`
+	// Apply changes after this time even if things keep changing. Changes can't be delayed indefinitely, so zero
+	// means the default
+	MaxDelay time.Duration `yaml:"maxDelay"`
+	// Maximum number of reloads within any minute (no limit if zero)
+	MaxPerMinute int `yaml:"maxPerMinute"`
+}
+
+// LocalPorts is the range of loopback ports the frontends terminating TLS listen on
+type LocalPorts struct {
+	// First port of the range
+	First int `yaml:"first"`
+	// Number of ports in the range
+	Count int `yaml:"count"`
+}
+
+// Events limits the Kubernetes Events k8router posts on ingresses
+type Events struct {
+	// Don't repeat an identical event within this time
+	RepeatInterval time.Duration `yaml:"repeatInterval"`
+	// Events per second each cluster may get on average
+	QPS float32 `yaml:"qps"`
+	// Events each cluster may get at once
+	Burst int `yaml:"burst"`
 }
 
 // Cluster only exists for parser trickery
@@ -49,14 +247,126 @@ type Config struct {
 	HAProxyDropinPath string `yaml:"haproxyDropinPath"`
 	// Mode to use in case the config file is created
 	HAProxyDropinMode string `yaml:"haproxyDropinMode"`
+	// HAProxy's stats socket (with admin level), used to change server addresses without a reload (disabled if empty)
+	HAProxyRuntimeSocket string `yaml:"haproxyRuntimeSocket"`
 	// List of clusters to route to
 	Clusters []Cluster `yaml:"clusters"`
 	// List of TLS certificates to use
 	Certificates []Certificate `yaml:"certificates"`
 	// List of IPs to listen on
 	IPs []*net.IP `yaml:"ips"`
+	// Directory to write certificates synced from Kubernetes secrets to
+	ManagedCertificateDirectory string `yaml:"managedCertificateDirectory"`
+	// Automatic certificate issuance for hosts not covered by any certificate (disabled if missing)
+	ACME *ACME `yaml:"acme"`
+	// Certificate expiry monitoring
+	CertificateExpiry CertificateExpiry `yaml:"certificateExpiry"`
+	// Directory containing the drain flags of all clusters. A cluster is drained while a file named like it exists
+	DrainDirectory string `yaml:"drainDirectory"`
+	// Remove the backends of drained clusters after this time (never if zero)
+	DrainGracePeriod time.Duration `yaml:"drainGracePeriod"`
+	// Address to serve metrics and the admin API on (disabled if empty)
+	AdminListen string `yaml:"adminListen"`
+	// File containing the bearer token the admin API requires (only metrics are served if empty)
+	AdminTokenFile string `yaml:"adminTokenFile"`
+	// Whether to redirect plain HTTP requests to HTTPS for all hosts with a certificate
+	RedirectToHTTPS bool `yaml:"redirectToHTTPS"`
+	// Max age of the Strict-Transport-Security header for all hosts with a certificate (no header if zero)
+	HSTSMaxAge time.Duration `yaml:"hstsMaxAge"`
+	// TLS settings of all certificates
+	TLS TLS `yaml:"tls"`
+	// How HTTPS is terminated ('loopback' or 'crt-list')
+	TLSTermination string `yaml:"tlsTermination"`
+	// Path to write the crt-list to in 'crt-list' mode
+	CrtListPath string `yaml:"crtListPath"`
+	// Loopback ports to terminate TLS on
+	LocalPorts LocalPorts `yaml:"localPorts"`
+	// How often HAProxy may be reloaded
+	Reload Reload `yaml:"reload"`
+	// Which namespaces may claim which hosts
+	HostPolicy HostPolicy `yaml:"hostPolicy"`
+	// Hosts whose TLS connections are passed through instead of being terminated by HAProxy
+	Passthrough []PassthroughRule `yaml:"passthrough"`
+	// How many Kubernetes Events to post on ingresses
+	Events Events `yaml:"events"`
+	// What to do if configured certificate domains are not covered by the certificate ('warn' or 'refuse')
+	CertificateDomainMismatch string `yaml:"certificateDomainMismatch"`
 }
 
+// DefaultClusterWeight is used for clusters without configured weight
+const DefaultClusterWeight = 100
+
+// DefaultExecAPIVersion is used for credential plugins without configured API version
+const DefaultExecAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// DefaultReloadQuietPeriod is used if no quiet period for reloads is configured
+const DefaultReloadQuietPeriod = 1 * time.Second
+
+// DefaultReloadMaxDelay is used if no maximum delay for reloads is configured
+const DefaultReloadMaxDelay = 10 * time.Second
+
+// DefaultEventRepeatInterval is used if no repeat interval for events is configured
+const DefaultEventRepeatInterval = 1 * time.Hour
+
+// DefaultEventQPS is used if no event rate is configured
+const DefaultEventQPS = 1
+
+// DefaultEventBurst is used if no event burst is configured
+const DefaultEventBurst = 25
+
+// DefaultLocalPortsFirst is used if no local port range is configured
+const DefaultLocalPortsFirst = 12345
+
+// DefaultLocalPortsCount is used if no size of the local port range is configured
+const DefaultLocalPortsCount = 100
+
+// DefaultCertificateExpiryCheckInterval is used if no certificate expiry check interval is configured
+const DefaultCertificateExpiryCheckInterval = 1 * time.Hour
+
+const (
+	// HostPolicyAllow allows hosts which aren't covered by any rule or namespace claim
+	HostPolicyAllow = "allow"
+	// HostPolicyDeny drops hosts which aren't covered by any rule or namespace claim
+	HostPolicyDeny = "deny"
+)
+
+const (
+	// ClientVerifyRequired rejects requests without a valid client certificate
+	ClientVerifyRequired = "required"
+	// ClientVerifyOptional only verifies client certificates if the client sends one
+	ClientVerifyOptional = "optional"
+	// ClientVerifyOff doesn't ask for client certificates (only valid as per-host override)
+	ClientVerifyOff = "off"
+)
+
+const (
+	// TLSTerminationLoopback terminates each certificate's hosts on a separate frontend, which the SNI frontend
+	// forwards to via loopback
+	TLSTerminationLoopback = "loopback"
+	// TLSTerminationCrtList terminates all hosts on a single frontend using a crt-list
+	TLSTerminationCrtList = "crt-list"
+)
+
+const (
+	// BackendProtocolHTTP1 talks HTTP/1.1 to the ingress pods
+	BackendProtocolHTTP1 = "http/1.1"
+	// BackendProtocolH2 talks HTTP/2 without TLS (h2c) to the ingress pods
+	BackendProtocolH2 = "h2"
+)
+
+// TLS versions HAProxy accepts as minimum version
+var tlsVersions = []string{"TLSv1.0", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+
+// Characters allowed in ALPN protocols and cipher lists, which end up in the HAProxy config verbatim
+var tlsValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.:/+!@=-]+$`)
+
+const (
+	// DomainMismatchWarn only logs configured domains the certificate isn't valid for
+	DomainMismatchWarn = "warn"
+	// DomainMismatchRefuse drops configured domains the certificate isn't valid for
+	DomainMismatchRefuse = "refuse"
+)
+
 // UnmarshalYAML is a custom deserializer for 'Cluster' in order to transparently provide default values where applicable
 func (c *Cluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	obj := ClusterInternal{}
@@ -73,15 +383,88 @@ func (c *Cluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.IngressNamespace == "" {
 		c.IngressNamespace = "ingress-nginx"
 	}
-	if c.Kubeconfig == "" {
+	if c.Kubeconfig == "" && !c.InCluster {
 		return errors.New("Cluster: kubeconfig missing")
 	}
+	if c.Kubeconfig != "" && c.InCluster {
+		return errors.New("Cluster: kubeconfig and inCluster are mutually exclusive")
+	}
+	if c.Context != "" && c.InCluster {
+		return errors.New("Cluster: context requires a kubeconfig")
+	}
+	if c.Connection.TokenFile != "" && c.Connection.Exec != nil {
+		return errors.New("Cluster: tokenFile and exec are mutually exclusive")
+	}
+	if c.Connection.Exec != nil {
+		if c.Connection.Exec.Command == "" {
+			return errors.New("Cluster: exec command missing")
+		}
+		if c.Connection.Exec.APIVersion == "" {
+			c.Connection.Exec.APIVersion = DefaultExecAPIVersion
+		}
+	}
+	if c.Connection.QPS < 0 || c.Connection.Burst < 0 || c.Connection.Timeout < 0 {
+		return errors.New("Cluster: connection settings must not be negative")
+	}
 	if c.Name == "" {
 		return errors.New("Cluster: name missing")
 	}
 	if c.IngressPort == 0 {
 		c.IngressPort = 80
 	}
+	if c.IngressTLSPort == 0 {
+		c.IngressTLSPort = 443
+	}
+	if c.IngressTLSPort < 0 || c.IngressTLSPort > 65535 {
+		return errors.New("Cluster: ingressTLSPort is invalid")
+	}
+	if c.Weight == nil {
+		weight := DefaultClusterWeight
+		c.Weight = &weight
+	}
+	if *c.Weight < 0 {
+		return errors.New("Cluster: weight must not be negative")
+	}
+	for _, selector := range []string{c.PodSelector, c.IngressSelector, c.ServiceSelector} {
+		if _, err := labels.Parse(selector); err != nil {
+			return errors.Wrap(err, "Cluster: invalid label selector")
+		}
+	}
+	for _, namespace := range append(c.Namespaces, c.ExcludedNamespaces...) {
+		if namespace == "" {
+			return errors.New("Cluster: namespaces must not be empty")
+		}
+	}
+	excluded := map[string]bool{}
+	for _, namespace := range c.ExcludedNamespaces {
+		excluded[namespace] = true
+	}
+	watched := false
+	for _, namespace := range c.Namespaces {
+		watched = watched || !excluded[namespace]
+	}
+	if len(c.Namespaces) > 0 && !watched {
+		return errors.New("Cluster: all namespaces are excluded")
+	}
+	if c.HealthCheck.Path != "" && (!strings.HasPrefix(c.HealthCheck.Path, "/") || strings.ContainsAny(c.HealthCheck.Path, " \t")) {
+		return errors.New("Cluster: healthCheck path must be an absolute path without whitespace")
+	}
+	if c.HealthCheck.Port < 0 || c.HealthCheck.Port > 65535 {
+		return errors.New("Cluster: healthCheck port is invalid")
+	}
+	if c.HealthCheck.ExpectStatus != 0 && (c.HealthCheck.ExpectStatus < 100 || c.HealthCheck.ExpectStatus > 599) {
+		return errors.New("Cluster: healthCheck expectStatus is invalid")
+	}
+	switch c.BackendProtocol {
+	case "":
+		c.BackendProtocol = BackendProtocolHTTP1
+	case BackendProtocolHTTP1, BackendProtocolH2:
+	default:
+		return errors.New("Cluster: backendProtocol must be either 'http/1.1' or 'h2'")
+	}
+	if c.HealthCheck.Interval < 0 || c.HealthCheck.Rise < 0 || c.HealthCheck.Fall < 0 || c.HealthCheck.SlowStart < 0 {
+		return errors.New("Cluster: healthCheck settings must not be negative")
+	}
 
 	return nil
 }
@@ -103,8 +486,23 @@ func (c *Certificate) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.Name == "" {
 		return errors.New("Certificate: name missing")
 	}
-	if len(c.Domains) == 0 {
-		return errors.New("Certificate: cert is not valid for any domain?")
+	if c.HSTSMaxAge != nil && *c.HSTSMaxAge < 0 {
+		return errors.New("Certificate: hstsMaxAge must not be negative")
+	}
+	if c.ClientCA == "" && (c.ClientVerify != "" || c.ClientCRL != "") {
+		return errors.New("Certificate: clientVerify and clientCRL require a clientCA")
+	}
+	switch c.ClientVerify {
+	case "":
+		if c.ClientCA != "" {
+			c.ClientVerify = ClientVerifyRequired
+		}
+	case ClientVerifyRequired, ClientVerifyOptional:
+	default:
+		return errors.New("Certificate: clientVerify must be either 'required' or 'optional'")
+	}
+	if err := c.TLS.validate(); err != nil {
+		return errors.Wrap(err, "Certificate")
 	}
 
 	return nil
@@ -128,8 +526,228 @@ func FromFile(path string) (*Config, error) {
 	if obj.Clusters == nil {
 		return nil, errors.New("Cluster list missing")
 	}
+	defaultCertificates := 0
+	for _, cert := range obj.Certificates {
+		if cert.Default {
+			defaultCertificates++
+		}
+	}
+	if obj.HSTSMaxAge < 0 {
+		return nil, errors.New("hstsMaxAge must not be negative")
+	}
+	if err := obj.TLS.validate(); err != nil {
+		return nil, err
+	}
+	switch obj.TLSTermination {
+	case "":
+		obj.TLSTermination = TLSTerminationLoopback
+	case TLSTerminationLoopback, TLSTerminationCrtList:
+	default:
+		return nil, errors.New("tlsTermination must be either 'loopback' or 'crt-list'")
+	}
+	if obj.CrtListPath == "" && obj.TLSTermination == TLSTerminationCrtList {
+		obj.CrtListPath = "/var/lib/k8router/k8router.crt-list"
+	}
+	if obj.LocalPorts.First == 0 {
+		obj.LocalPorts.First = DefaultLocalPortsFirst
+	}
+	if obj.LocalPorts.Count == 0 {
+		obj.LocalPorts.Count = DefaultLocalPortsCount
+	}
+	if obj.LocalPorts.First < 1 || obj.LocalPorts.Count < 1 || obj.LocalPorts.First+obj.LocalPorts.Count-1 > 65535 {
+		return nil, errors.New("localPorts must be within 1-65535")
+	}
+	// Synced and issued certificates need ports as well, but there's no telling how many there will be
+	if obj.TLSTermination == TLSTerminationLoopback && obj.LocalPorts.Count < len(obj.Certificates) {
+		return nil, errors.New("localPorts must contain at least one port per certificate")
+	}
+	if defaultCertificates > 1 {
+		return nil, errors.New("Only one certificate may be the default")
+	}
 	if len(obj.IPs) == 0 {
 		return nil, errors.New("IP list missing")
 	}
+	if obj.ManagedCertificateDirectory == "" {
+		obj.ManagedCertificateDirectory = "/var/lib/k8router/certificates"
+	}
+	if obj.DrainDirectory == "" {
+		obj.DrainDirectory = "/var/lib/k8router/drain"
+	}
+	if len(obj.CertificateExpiry.WarningDays) == 0 {
+		obj.CertificateExpiry.WarningDays = []int{30, 14, 7, 3, 1}
+	}
+	if obj.CertificateExpiry.CheckInterval == 0 {
+		obj.CertificateExpiry.CheckInterval = DefaultCertificateExpiryCheckInterval
+	}
+	if obj.Reload.QuietPeriod < 0 || obj.Reload.MaxDelay < 0 || obj.Reload.MaxPerMinute < 0 {
+		return nil, errors.New("reload settings must not be negative")
+	}
+	if obj.Reload.QuietPeriod == 0 {
+		obj.Reload.QuietPeriod = DefaultReloadQuietPeriod
+	}
+	if obj.Reload.MaxDelay == 0 {
+		obj.Reload.MaxDelay = DefaultReloadMaxDelay
+	}
+	if obj.Reload.MaxDelay < obj.Reload.QuietPeriod {
+		return nil, errors.New("reload maxDelay must not be shorter than quietPeriod")
+	}
+	if obj.Events.RepeatInterval < 0 || obj.Events.QPS < 0 || obj.Events.Burst < 0 {
+		return nil, errors.New("events settings must not be negative")
+	}
+	obj.Events = obj.Events.WithDefaults()
+	if obj.ACME != nil {
+		if obj.ACME.DirectoryURL == "" {
+			obj.ACME.DirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+		}
+		if obj.ACME.StorageDirectory == "" {
+			obj.ACME.StorageDirectory = "/var/lib/k8router/acme"
+		}
+		if obj.ACME.ChallengeListen == "" {
+			obj.ACME.ChallengeListen = "127.0.0.1:8402"
+		}
+		if obj.ACME.RenewBeforeDays == 0 {
+			obj.ACME.RenewBeforeDays = 30
+		}
+	}
+	if err := obj.checkLocalPortOverlap(); err != nil {
+		return nil, err
+	}
+	switch obj.HostPolicy.Default {
+	case "":
+		obj.HostPolicy.Default = HostPolicyAllow
+	case HostPolicyAllow, HostPolicyDeny:
+	default:
+		return nil, errors.New("hostPolicy default must be either 'allow' or 'deny'")
+	}
+	for _, rule := range obj.HostPolicy.Rules {
+		if len(rule.Hosts) == 0 {
+			return nil, errors.New("hostPolicy rules need at least one host")
+		}
+	}
+	for _, rule := range obj.Passthrough {
+		if len(rule.Hosts) == 0 {
+			return nil, errors.New("passthrough rules need at least one host")
+		}
+		if rule.Service == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(rule.Service)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, errors.New("passthrough service must be an address like 'ip:port'")
+		}
+		if number, err := strconv.Atoi(port); err != nil || number <= 0 || number > 65535 {
+			return nil, errors.New("passthrough service port is invalid")
+		}
+	}
+	switch obj.CertificateDomainMismatch {
+	case "":
+		obj.CertificateDomainMismatch = DomainMismatchWarn
+	case DomainMismatchWarn, DomainMismatchRefuse:
+	default:
+		return nil, errors.New("certificateDomainMismatch must be either 'warn' or 'refuse'")
+	}
 	return &obj, nil
 }
+
+// Check that the local port range doesn't contain any port HAProxy or k8router listen on otherwise
+func (c *Config) checkLocalPortOverlap() error {
+	count := c.LocalPorts.Count
+	if c.TLSTermination == TLSTerminationCrtList {
+		// Only the first port is used
+		count = 1
+	}
+	local := func(host string, port int) bool {
+		ip := net.ParseIP(host)
+		return port >= c.LocalPorts.First && port < c.LocalPorts.First+count &&
+			(host == "" || host == "localhost" || (ip != nil && (ip.Equal(net.IPv4(127, 0, 0, 1)) || ip.IsUnspecified())))
+	}
+	for _, ip := range c.IPs {
+		if ip != nil && (local(ip.String(), 80) || local(ip.String(), 443)) {
+			return errors.New("localPorts must not contain the HTTP and HTTPS ports")
+		}
+	}
+	listens := [][2]string{{"adminListen", c.AdminListen}}
+	if c.ACME != nil {
+		listens = append(listens, [2]string{"acme challengeListen", c.ACME.ChallengeListen})
+	}
+	for _, listen := range listens {
+		host, port, err := net.SplitHostPort(listen[1])
+		if err != nil {
+			continue
+		}
+		if number, err := strconv.Atoi(port); err == nil && local(host, number) {
+			return errors.New("localPorts must not contain the port of " + listen[0])
+		}
+	}
+	return nil
+}
+
+// WithDefaults fills in the defaults of all settings which aren't set
+func (e Events) WithDefaults() Events {
+	if e.RepeatInterval == 0 {
+		e.RepeatInterval = DefaultEventRepeatInterval
+	}
+	if e.QPS == 0 {
+		e.QPS = DefaultEventQPS
+	}
+	if e.Burst == 0 {
+		e.Burst = DefaultEventBurst
+	}
+	return e
+}
+
+// WithOverrides replaces all settings which are set in the given overrides. ALPN protocols and the HTTP/2 switch
+// are replaced together, so either of them overrides both
+func (t TLS) WithOverrides(overrides TLS) TLS {
+	if overrides.ALPN != nil {
+		t.ALPN = overrides.ALPN
+		t.HTTP2 = nil
+	} else if overrides.HTTP2 != nil {
+		t.ALPN = nil
+		t.HTTP2 = overrides.HTTP2
+	}
+	if overrides.MinVersion != "" {
+		t.MinVersion = overrides.MinVersion
+	}
+	if overrides.Ciphers != "" {
+		t.Ciphers = overrides.Ciphers
+	}
+	if overrides.CipherSuites != "" {
+		t.CipherSuites = overrides.CipherSuites
+	}
+	return t
+}
+
+// Protocols returns the protocols to offer via ALPN, in order of preference
+func (t TLS) Protocols() []string {
+	if len(t.ALPN) > 0 {
+		return t.ALPN
+	}
+	if t.HTTP2 != nil && *t.HTTP2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return nil
+}
+
+func (t TLS) validate() error {
+	for _, protocol := range t.ALPN {
+		if !tlsValuePattern.MatchString(protocol) {
+			return errors.New("tls alpn protocols must not contain whitespace or commas")
+		}
+	}
+	if t.MinVersion != "" {
+		valid := false
+		for _, version := range tlsVersions {
+			valid = valid || version == t.MinVersion
+		}
+		if !valid {
+			return errors.New("tls minVersion must be one of " + strings.Join(tlsVersions, ", "))
+		}
+	}
+	for _, ciphers := range []string{t.Ciphers, t.CipherSuites} {
+		if ciphers != "" && !tlsValuePattern.MatchString(ciphers) {
+			return errors.New("tls ciphers must not contain whitespace")
+		}
+	}
+	return nil
+}
@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Helper function to write a config string to file and load it
@@ -67,8 +69,458 @@ ips:
 	g.Expect(uut.Clusters[0].IngressNamespace).To(gomega.BeIdenticalTo("ingress-nginx"))
 	g.Expect(uut.Clusters[0].IngressAppName).To(gomega.BeIdenticalTo("ingress-nginx"))
 	g.Expect(uut.Clusters[0].IngressPort).To(gomega.BeIdenticalTo(80))
+	g.Expect(*uut.Clusters[0].Weight).To(gomega.BeIdenticalTo(DefaultClusterWeight))
 	g.Expect(len(uut.IPs)).To(gomega.BeIdenticalTo(1))
 	g.Expect(*uut.IPs[0]).To(gomega.BeEquivalentTo(net.ParseIP("127.0.0.1")))
+	g.Expect(uut.CertificateDomainMismatch).To(gomega.BeIdenticalTo(DomainMismatchWarn))
+	g.Expect(uut.Reload).To(gomega.Equal(Reload{
+		QuietPeriod: DefaultReloadQuietPeriod,
+		MaxDelay:    DefaultReloadMaxDelay,
+	}))
+}
+
+// Certificates may omit their domains, they are derived from the certificate itself
+func TestCertificateWithoutDomains(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(len(uut.Certificates[0].Domains)).To(gomega.BeIdenticalTo(0))
+}
+
+// Global HTTPS policies can be overridden per certificate
+func TestHTTPSPolicies(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+redirectToHTTPS: true
+hstsMaxAge: 8760h
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+certificates:
+  - cert: /foo
+    name: foo
+  - cert: /bar
+    name: bar
+    redirectToHTTPS: false
+    hstsMaxAge: 0s
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.RedirectToHTTPS).To(gomega.BeTrue())
+	g.Expect(uut.HSTSMaxAge).To(gomega.Equal(8760 * time.Hour))
+	g.Expect(uut.Certificates[0].RedirectToHTTPS).To(gomega.BeNil())
+	g.Expect(uut.Certificates[0].HSTSMaxAge).To(gomega.BeNil())
+	g.Expect(*uut.Certificates[1].RedirectToHTTPS).To(gomega.BeFalse())
+	g.Expect(*uut.Certificates[1].HSTSMaxAge).To(gomega.BeZero())
+}
+
+// Client certificates are required by default once a CA is configured
+func TestClientCertificates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+certificates:
+  - cert: /foo
+    name: foo
+  - cert: /admin
+    name: admin
+    clientCA: /etc/k8router/clients.pem
+  - cert: /partners
+    name: partners
+    clientCA: /etc/k8router/partners.pem
+    clientVerify: optional
+    clientCRL: /etc/k8router/partners.crl
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Certificates[0].ClientVerify).To(gomega.BeEmpty())
+	g.Expect(uut.Certificates[1].ClientVerify).To(gomega.Equal(ClientVerifyRequired))
+	g.Expect(uut.Certificates[2].ClientVerify).To(gomega.Equal(ClientVerifyOptional))
+	g.Expect(uut.Certificates[2].ClientCRL).To(gomega.Equal("/etc/k8router/partners.crl"))
+
+	testError(strings.Replace(configStr, "clientVerify: optional", "clientVerify: off", 1),
+		"Certificate: clientVerify must be either 'required' or 'optional'", t, g)
+	testError(strings.Replace(configStr, "    clientCA: /etc/k8router/partners.pem\n", "", 1),
+		"Certificate: clientVerify and clientCRL require a clientCA", t, g)
+}
+
+// TLS settings of certificates override the global ones
+func TestTLSSettings(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+tls:
+  http2: true
+  minVersion: TLSv1.2
+  ciphers: ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+  - name: grpc
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+    backendProtocol: h2
+certificates:
+  - cert: /foo
+    name: foo
+  - cert: /legacy
+    name: legacy
+    tls:
+      http2: false
+      minVersion: TLSv1.0
+  - cert: /grpc
+    name: grpc
+    tls:
+      alpn: [h2]
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Clusters[0].BackendProtocol).To(gomega.Equal(BackendProtocolHTTP1))
+	g.Expect(uut.Clusters[1].BackendProtocol).To(gomega.Equal(BackendProtocolH2))
+	g.Expect(uut.TLS.Protocols()).To(gomega.Equal([]string{"h2", "http/1.1"}))
+	legacy := uut.TLS.WithOverrides(uut.Certificates[1].TLS)
+	g.Expect(legacy.Protocols()).To(gomega.BeEmpty())
+	g.Expect(legacy.MinVersion).To(gomega.Equal("TLSv1.0"))
+	g.Expect(legacy.Ciphers).To(gomega.Equal(uut.TLS.Ciphers))
+	g.Expect(uut.TLS.WithOverrides(uut.Certificates[2].TLS).Protocols()).To(gomega.Equal([]string{"h2"}))
+
+	g.Expect(uut.TLSTermination).To(gomega.Equal(TLSTerminationLoopback))
+	g.Expect(uut.CrtListPath).To(gomega.BeEmpty())
+	uut, err = writeAndLoadConfig(strings.Replace(configStr, "tls:", "tlsTermination: crt-list\ntls:", 1), t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.CrtListPath).To(gomega.Equal("/var/lib/k8router/k8router.crt-list"))
+
+	testError(strings.Replace(configStr, "tls:", "tlsTermination: direct\ntls:", 1),
+		"tlsTermination must be either 'loopback' or 'crt-list'", t, g)
+	testError(strings.Replace(configStr, "minVersion: TLSv1.2", "minVersion: SSLv3", 1),
+		"tls minVersion must be one of TLSv1.0, TLSv1.1, TLSv1.2, TLSv1.3", t, g)
+	testError(strings.Replace(configStr, "alpn: [h2]", `alpn: ["h2,http/1.1"]`, 1),
+		"Certificate: tls alpn protocols must not contain whitespace or commas", t, g)
+	testError(strings.Replace(configStr, "backendProtocol: h2", "backendProtocol: grpc", 1),
+		"Cluster: backendProtocol must be either 'http/1.1' or 'h2'", t, g)
+}
+
+// The local port range gets a default, has to fit all certificates and mustn't overlap other ports
+func TestLocalPorts(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+certificates:
+  - cert: /foo
+    name: foo
+  - cert: /bar
+    name: bar
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.LocalPorts).To(gomega.Equal(LocalPorts{First: DefaultLocalPortsFirst, Count: DefaultLocalPortsCount}))
+
+	uut, err = writeAndLoadConfig(configStr+"localPorts:\n  first: 20000\n", t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.LocalPorts).To(gomega.Equal(LocalPorts{First: 20000, Count: DefaultLocalPortsCount}))
+
+	testError(configStr+"localPorts:\n  first: 65500\n", "localPorts must be within 1-65535", t, g)
+	testError(configStr+"localPorts:\n  count: -1\n", "localPorts must be within 1-65535", t, g)
+	testError(configStr+"localPorts:\n  count: 1\n", "localPorts must contain at least one port per certificate",
+		t, g)
+	// A single frontend terminates all certificates
+	_, err = writeAndLoadConfig(configStr+"localPorts:\n  count: 1\ntlsTermination: crt-list\n", t)
+	g.Expect(err).To(gomega.BeNil())
+
+	// The range mustn't contain ports which are listened on otherwise
+	testError(configStr+"localPorts:\n  first: 400\n", "localPorts must not contain the HTTP and HTTPS ports", t, g)
+	testError(configStr+"adminListen: :12400\n", "localPorts must not contain the port of adminListen", t, g)
+	testError(configStr+"acme:\n  email: admin@example.org\n  challengeListen: 127.0.0.1:12350\n",
+		"localPorts must not contain the port of acme challengeListen", t, g)
+	_, err = writeAndLoadConfig(configStr+"adminListen: 10.0.0.1:12400\n", t)
+	g.Expect(err).To(gomega.BeNil())
+	_, err = writeAndLoadConfig(configStr+"adminListen: :12400\ntlsTermination: crt-list\n", t)
+	g.Expect(err).To(gomega.BeNil())
+}
+
+// Clusters may be configured to get no traffic at all
+func TestClusterWeight(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+    weight: 0
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(*uut.Clusters[0].Weight).To(gomega.Equal(0))
+
+	testError(strings.Replace(configStr, "weight: 0", "weight: -1", 1), "Cluster: weight must not be negative", t, g)
+}
+
+// Reload limits must be consistent
+func TestReload(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+reload:
+  quietPeriod: 5s
+  maxPerMinute: 4
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Reload).To(gomega.Equal(Reload{
+		QuietPeriod:  5 * time.Second,
+		MaxDelay:     DefaultReloadMaxDelay,
+		MaxPerMinute: 4,
+	}))
+
+	// Changes can't be delayed indefinitely
+	uut, err = writeAndLoadConfig(strings.Replace(configStr, "quietPeriod: 5s", "maxDelay: 0s", 1), t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Reload.MaxDelay).To(gomega.Equal(DefaultReloadMaxDelay))
+
+	testError(strings.Replace(configStr, "quietPeriod: 5s", "quietPeriod: 20s", 1),
+		"reload maxDelay must not be shorter than quietPeriod", t, g)
+	testError(strings.Replace(configStr, "maxPerMinute: 4", "maxPerMinute: -1", 1),
+		"reload settings must not be negative", t, g)
+}
+
+// Event limits get defaults
+func TestEvents(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+events:
+  qps: 0.5
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Events).To(gomega.Equal(Events{
+		RepeatInterval: DefaultEventRepeatInterval,
+		QPS:            0.5,
+		Burst:          DefaultEventBurst,
+	}))
+
+	testError(strings.Replace(configStr, "qps: 0.5", "qps: -1", 1), "events settings must not be negative", t, g)
+}
+
+// Connection settings must be consistent
+func TestClusterConnection(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - name: testcluster
+    inCluster: true
+    connection:
+      server: https://10.0.0.1:6443
+      exec:
+        command: /usr/local/bin/get-token
+        env:
+          CLUSTER: testcluster
+      qps: 20
+      timeout: 30s
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Clusters[0].Connection).To(gomega.Equal(Connection{
+		Server: "https://10.0.0.1:6443",
+		Exec: &ExecCredential{
+			Command:    "/usr/local/bin/get-token",
+			Env:        map[string]string{"CLUSTER": "testcluster"},
+			APIVersion: DefaultExecAPIVersion,
+		},
+		QPS:     20,
+		Timeout: 30 * time.Second,
+	}))
+
+	testError(strings.Replace(configStr, "inCluster: true", "inCluster: true\n    kubeconfig: /etc/k8s.yml", 1),
+		"Cluster: kubeconfig and inCluster are mutually exclusive", t, g)
+	testError(strings.Replace(configStr, "inCluster: true", "inCluster: true\n    context: prod", 1),
+		"Cluster: context requires a kubeconfig", t, g)
+	testError(strings.Replace(configStr, "      qps: 20", "      tokenFile: /token", 1),
+		"Cluster: tokenFile and exec are mutually exclusive", t, g)
+	testError(strings.Replace(configStr, "command: /usr/local/bin/get-token", "args: [token]", 1),
+		"Cluster: exec command missing", t, g)
+	testError(strings.Replace(configStr, "qps: 20", "qps: -1", 1),
+		"Cluster: connection settings must not be negative", t, g)
+}
+
+// Host policies default to allowing everything
+func TestHostPolicy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+hostPolicy:
+  rules:
+    - hosts: ["*.shop.example.org"]
+      namespaces: [shop]
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+    namespaceHostClaims: true
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.HostPolicy.Default).To(gomega.Equal(HostPolicyAllow))
+	g.Expect(uut.HostPolicy.Rules[0].Namespaces).To(gomega.Equal([]string{"shop"}))
+	g.Expect(uut.Clusters[0].NamespaceHostClaims).To(gomega.BeTrue())
+
+	testError(strings.Replace(configStr, "  rules:", "  default: maybe\n  rules:", 1),
+		"hostPolicy default must be either 'allow' or 'deny'", t, g)
+	testError(strings.Replace(configStr, `["*.shop.example.org"]`, "[]", 1),
+		"hostPolicy rules need at least one host", t, g)
+}
+
+// Passthrough services have to be IP addresses
+func TestPassthrough(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+passthrough:
+  - hosts: ["vault.example.org"]
+  - hosts: ["*.mtls.example.org"]
+    service: 10.0.0.10:8443
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Passthrough).To(gomega.HaveLen(2))
+	g.Expect(uut.Passthrough[1].Service).To(gomega.Equal("10.0.0.10:8443"))
+	g.Expect(uut.Clusters[0].IngressTLSPort).To(gomega.Equal(443))
+
+	testError(strings.Replace(configStr, `["vault.example.org"]`, "[]", 1),
+		"passthrough rules need at least one host", t, g)
+	testError(strings.Replace(configStr, "10.0.0.10:8443", "backend.example.org:8443", 1),
+		"passthrough service must be an address like 'ip:port'", t, g)
+	testError(strings.Replace(configStr, "10.0.0.10:8443", "10.0.0.10:0", 1),
+		"passthrough service port is invalid", t, g)
+	testError(strings.Replace(configStr, "kubeconfig.yml", "kubeconfig.yml\n    ingressTLSPort: 70000", 1),
+		"Cluster: ingressTLSPort is invalid", t, g)
+}
+
+func TestHealthCheck(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	configStr := `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+    healthCheck:
+      path: /healthz
+      port: 10254
+      expectStatus: 200
+      interval: 2s
+      rise: 2
+      fall: 3
+      slowstart: 30s
+certificates:
+  - cert: /foo
+    name: foo
+ips:
+  - 127.0.0.1
+`
+	uut, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(uut.Clusters[0].HealthCheck).To(gomega.Equal(HealthCheck{
+		Path:         "/healthz",
+		Port:         10254,
+		ExpectStatus: 200,
+		Interval:     2 * time.Second,
+		Rise:         2,
+		Fall:         3,
+		SlowStart:    30 * time.Second,
+	}))
+
+	configStr = `
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+    healthCheck:
+      path: healthz
+`
+	testError(configStr, "Cluster: healthCheck path must be an absolute path without whitespace", t, g)
+	configStr = `
+clusters:
+  - name: testcluster
+    kubeconfig: /etc/kubernetes/kubeconfig.yml
+    healthCheck:
+      expectStatus: 1000
+`
+	testError(configStr, "Cluster: healthCheck expectStatus is invalid", t, g)
 }
 
 func TestErrorConditions(t *testing.T) {
@@ -80,6 +532,25 @@ clusters:
   - kubeconfig: /foo/bar
 `
 	testError(configStr, "Cluster: name missing", t, g)
+	configStr = `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - kubeconfig: /foo/bar
+    name: foo
+    ingressSelector: "k8router in enabled"
+`
+	_, err := writeAndLoadConfig(configStr, t)
+	g.Expect(err).NotTo(gomega.BeNil())
+	g.Expect(err.Error()).To(gomega.HavePrefix("Cluster: invalid label selector"))
+	configStr = `
+haproxyTemplatePath: /foo/bar/test.cfg
+clusters:
+  - kubeconfig: /foo/bar
+    name: foo
+    namespaces: [shop, blog]
+    excludedNamespaces: [blog, shop]
+`
+	testError(configStr, "Cluster: all namespaces are excluded", t, g)
 
 	// Certificate config issues
 	configStr = `
@@ -104,16 +575,6 @@ certificates:
       - example.org
 `
 	testError(configStr, "Certificate: name missing", t, g)
-	configStr = `
-haproxyTemplatePath: /foo/bar/test.cfg
-clusters:
-  - kubeconfig: /foo/bar
-    name: foo
-certificates:
-  - cert: /foo
-    name: foo
-`
-	testError(configStr, "Certificate: cert is not valid for any domain?", t, g)
 
 	// overall config issues
 	configStr = `
@@ -144,4 +605,31 @@ clusters:
     name: foo
 `
 	testError(configStr, "IP list missing", t, g)
+	configStr = `
+haproxyTemplatePath: /foo/bar/test.cfg
+certificates:
+  - cert: /foo
+    name: foo
+clusters:
+  - kubeconfig: /foo/bar
+    name: foo
+ips:
+  - 127.0.0.1
+certificateDomainMismatch: ignore
+`
+	testError(configStr, "certificateDomainMismatch must be either 'warn' or 'refuse'", t, g)
+	configStr = `
+haproxyTemplatePath: /foo/bar/test.cfg
+certificates:
+  - cert: /foo
+    name: foo
+    default: true
+  - cert: /bar
+    name: bar
+    default: true
+clusters:
+  - kubeconfig: /foo/bar
+    name: foo
+`
+	testError(configStr, "Only one certificate may be the default", t, g)
 }
@@ -0,0 +1,269 @@
+package haproxy
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/certificate"
+	"github.com/vsk8s/k8router/pkg/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often certificate files are checked for changes on disk
+const certificateCheckInterval = 30 * time.Second
+
+// Prefix of the names of all certificates issued via ACME
+const acmeCertificatePrefix = "acme-"
+
+// CertificateIssuer obtains certificates for hosts which aren't covered by any other certificate
+type CertificateIssuer interface {
+	// Set the hosts to obtain certificates for
+	SetHosts(hosts []string)
+	// Get a map of host to certificate path for all hosts with a valid certificate
+	Certificates() map[string]string
+	// Notifies about new or renewed certificates
+	Updates() <-chan bool
+	// Address HAProxy should forward HTTP-01 challenges to
+	ChallengeAddress() string
+}
+
+// A certificate that can be used for SNI, either configured statically or synced from a cluster
+type certificateEntry struct {
+	Name    string
+	Path    string
+	Domains []string
+	// Whether this certificate was explicitly configured as default certificate
+	IsDefault bool
+}
+
+// Load all configured certificates that changed on disk since the last call. Returns whether anything changed
+func (h *Handler) refreshCertificates() bool {
+	changed := false
+	for _, cert := range h.config.Certificates {
+		current, known := h.certificates[cert.Name]
+		if current != nil && !current.IsModified() {
+			continue
+		}
+		bundle, err := certificate.Load(cert.Cert)
+		if err != nil {
+			// Only complain (and rebuild) on the first failure, not on every check
+			if !known || current != nil {
+				log.WithFields(log.Fields{
+					"certificate": cert.Name,
+					"path":        cert.Cert,
+				}).WithError(err).Warning("Couldn't load certificate, falling back to configured domains")
+				changed = true
+			}
+			h.certificates[cert.Name] = nil
+			continue
+		}
+		h.certificates[cert.Name] = bundle
+		log.WithFields(log.Fields{
+			"certificate": cert.Name,
+			"domains":     bundle.Domains(),
+		}).Info("Loaded certificate")
+		h.logDomainMismatches(cert, bundle)
+		changed = true
+	}
+	return changed
+}
+
+// Complain about configured domains a certificate isn't actually valid for
+func (h *Handler) logDomainMismatches(cert config.Certificate, bundle *certificate.Bundle) {
+	for _, domain := range cert.Domains {
+		if bundle.Covers(domain) {
+			continue
+		}
+		entry := log.WithFields(log.Fields{
+			"certificate": cert.Name,
+			"domain":      domain,
+			"sans":        bundle.Domains(),
+		})
+		if h.config.CertificateDomainMismatch == config.DomainMismatchRefuse {
+			entry.Error("Refusing configured domain the certificate isn't valid for")
+		} else {
+			entry.Warning("Configured domain isn't covered by the certificate")
+		}
+	}
+}
+
+// Get the list of domains a configured certificate should be used for
+func (h *Handler) certificateDomains(cert config.Certificate) []string {
+	bundle := h.certificates[cert.Name]
+	if len(cert.Domains) == 0 {
+		if bundle == nil {
+			return nil
+		}
+		return bundle.Domains()
+	}
+	if bundle == nil || h.config.CertificateDomainMismatch != config.DomainMismatchRefuse {
+		return cert.Domains
+	}
+	var domains []string
+	for _, domain := range cert.Domains {
+		if bundle.Covers(domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// Get all usable certificates: Configured ones first (in config order), then synced ones and finally issued ones
+// (both sorted by name)
+func (h *Handler) certificateEntries() []certificateEntry {
+	var entries []certificateEntry
+	for _, cert := range h.config.Certificates {
+		entries = append(entries, certificateEntry{
+			Name:      cert.Name,
+			Path:      cert.Cert,
+			Domains:   h.certificateDomains(cert),
+			IsDefault: cert.Default,
+		})
+	}
+	var names []string
+	for name := range h.managedCertificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries = append(entries, h.managedCertificates[name])
+	}
+	if h.issuer != nil {
+		issued := h.issuer.Certificates()
+		var hosts []string
+		for host := range issued {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			entries = append(entries, certificateEntry{
+				Name:    acmeCertificatePrefix + host,
+				Path:    issued[host],
+				Domains: []string{host},
+			})
+		}
+	}
+	return entries
+}
+
+// Ask the certificate issuer for certificates for all hosts not covered by any other certificate
+func (h *Handler) requestCertificates(hostToBackend map[string]string, hostToCert map[string]string) {
+	if h.issuer == nil {
+		return
+	}
+	var hosts []string
+	wildcards := map[string]bool{}
+	for host := range hostToBackend {
+		cert, ok := hostToCert[host]
+		if ok && !strings.HasPrefix(cert, acmeCertificatePrefix) {
+			continue
+		}
+		// HTTP-01 challenges can't prove control over a whole domain
+		if strings.HasPrefix(host, "*.") {
+			wildcards[host] = true
+			if !h.wildcardHostsWarned[host] {
+				log.WithField("host", host).Warning(
+					"Wildcard host can't get a certificate via ACME, it needs a configured (or DNS-01) certificate")
+			}
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	h.wildcardHostsWarned = wildcards
+	h.issuer.SetHosts(hosts)
+}
+
+// Check whether any cluster syncs certificates from TLS secrets
+func (h *Handler) syncsTLSSecrets() bool {
+	for _, cluster := range h.config.Clusters {
+		if cluster.SyncTLSSecrets {
+			return true
+		}
+	}
+	return false
+}
+
+// Write all certificates synced from TLS secrets to the managed directory and remove stale ones
+func (h *Handler) syncManagedCertificates() {
+	if !h.syncsTLSSecrets() {
+		return
+	}
+	dir := h.config.ManagedCertificateDirectory
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.WithField("path", dir).WithError(err).Error("Couldn't create managed certificate directory")
+		return
+	}
+	managedCertificates := map[string]certificateEntry{}
+	for clusterName, clusterState := range h.clusterState {
+		for _, cert := range clusterState.Certificates {
+			// The hash keeps names unique, e.g. for secrets a-b/c and a/b-c
+			name := invalidNameCharacters.ReplaceAllString("secret-"+clusterName+"-"+cert.Name, "_") + "-" + shortHash(clusterName, cert.Name)
+			file := path.Join(dir, name+".pem")
+			written, err := writeFileIfChanged(file, cert.PEM, 0600)
+			if err != nil {
+				log.WithField("path", file).WithError(err).Error("Couldn't write synced certificate")
+				continue
+			}
+			if written {
+				h.certificatesChanged = true
+			}
+			bundle, err := certificate.Load(file)
+			if err != nil {
+				log.WithField("path", file).WithError(err).Error("Couldn't load synced certificate")
+				continue
+			}
+			entry := certificateEntry{
+				Name: name,
+				Path: file,
+			}
+			for _, host := range cert.Hosts {
+				if bundle.Covers(host) {
+					entry.Domains = append(entry.Domains, host)
+				} else {
+					log.WithFields(log.Fields{
+						"cluster": clusterName,
+						"secret":  cert.Name,
+						"host":    host,
+					}).Warning("TLS secret isn't valid for a host it is used for")
+				}
+			}
+			managedCertificates[name] = entry
+		}
+	}
+	h.managedCertificates = managedCertificates
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.WithField("path", dir).WithError(err).Error("Couldn't list managed certificate directory")
+		return
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".pem")
+		if _, ok := managedCertificates[name]; ok || !strings.HasPrefix(name, "secret-") {
+			continue
+		}
+		err = os.Remove(path.Join(dir, file.Name()))
+		if err != nil {
+			log.WithField("path", file.Name()).WithError(err).Warning("Couldn't remove stale synced certificate")
+		}
+	}
+}
+
+// Write a file, but only if its content actually changed. Returns whether the file was written
+func writeFileIfChanged(file string, data []byte, mode os.FileMode) (bool, error) {
+	current, err := ioutil.ReadFile(file)
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	tmpFile := file + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, mode)
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmpFile, file)
+}
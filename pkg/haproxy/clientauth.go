@@ -0,0 +1,78 @@
+package haproxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+)
+
+// Header passing the subject DN of verified client certificates to the backends
+const clientDNHeader = "X-SSL-Client-DN"
+
+// Get the client certificate settings of a certificate. Certificates which aren't configured (e.g. synced or issued
+// ones) don't verify clients
+func (h *Handler) clientAuthSettings(name string) (string, string, string) {
+	for _, cert := range h.config.Certificates {
+		if cert.Name == name {
+			return cert.ClientCA, cert.ClientVerify, cert.ClientCRL
+		}
+	}
+	return "", "", ""
+}
+
+// Combine the client certificate settings of all certificates with the overrides of their hosts. A bind can only
+// require client certificates for all of its hosts, so it just verifies them if sent once its hosts disagree. The
+// hosts requiring them deny requests without one in any case. Returns the header to pass client DNs in, if any
+func (h *Handler) computeClientAuth(hostToOptions map[string]state.K8RouterIngressOptions,
+	sniList map[string]SniDetail, hostOptions map[string]HostOptions) string {
+	header := ""
+	for name, details := range sniList {
+		var requiring []string
+		wanted := false
+		for _, host := range details.Domains {
+			verify := hostToOptions[host].ClientVerify
+			if verify == "" {
+				verify = details.ClientVerify
+			}
+			if verify == "" || verify == config.ClientVerifyOff {
+				continue
+			}
+			wanted = true
+			if details.ClientCA == "" {
+				log.WithFields(log.Fields{
+					"host":   host,
+					"verify": verify,
+				}).Warning("Host wants client certificates, but its certificate has no clientCA")
+				h.reportHostEvent(host, true, reasonNoClientCA,
+					"Host "+host+" wants client certificates, but its certificate has no clientCA")
+			}
+			if verify == config.ClientVerifyRequired {
+				requiring = append(requiring, host)
+			}
+		}
+		switch {
+		case details.ClientCA == "":
+		case !wanted:
+			// Don't bother clients if none of the hosts is interested
+			details.ClientCA = ""
+			details.ClientVerify = ""
+			details.ClientCRL = ""
+		case len(requiring) == len(details.Domains):
+			details.ClientVerify = config.ClientVerifyRequired
+		default:
+			details.ClientVerify = config.ClientVerifyOptional
+		}
+		// Plain HTTP requests never have a client certificate. Neither do HTTPS requests to a certificate without
+		// CA, so these hosts deny everything then
+		for _, host := range requiring {
+			options := hostOptions[host]
+			options.RequireClientCert = true
+			hostOptions[host] = options
+		}
+		if details.ClientCA != "" {
+			header = clientDNHeader
+		}
+		sniList[name] = details
+	}
+	return header
+}
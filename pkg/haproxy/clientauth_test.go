@@ -0,0 +1,75 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"testing"
+)
+
+// Binds only require client certificates if all of their hosts do, hosts enforce their own requirement otherwise
+func TestClientCertificates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	admin := config.CertificateInternal{
+		Name:         "admin",
+		Domains:      []string{"*.admin.example.org"},
+		Cert:         "/etc/ssl/admin.pem",
+		ClientCA:     "/etc/ssl/clients.pem",
+		ClientVerify: config.ClientVerifyRequired,
+	}
+	public := config.CertificateInternal{Name: "public", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/public.pem"}
+	a := clusterStateWithBackends("a", 1, "grafana.admin.example.org", "www.example.org")
+	events := make(chan state.IngressEvent, 10)
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"a": a},
+		config: config.Config{
+			Certificates: []config.Certificate{{CertificateInternal: &admin}, {CertificateInternal: &public}},
+		},
+		ingressEvents: events,
+	}
+	uut.regenerateTemplateInfo()
+	info := uut.templateInfo
+	g.Expect(info.SniList["admin"].ClientCA).To(gomega.Equal("/etc/ssl/clients.pem"))
+	g.Expect(info.SniList["admin"].ClientVerify).To(gomega.Equal(config.ClientVerifyRequired))
+	g.Expect(info.SniList["public"].ClientCA).To(gomega.BeEmpty())
+	g.Expect(info.HostOptions["grafana.admin.example.org"].RequireClientCert).To(gomega.BeTrue(),
+		"Plain HTTP requests have to be denied")
+	g.Expect(info.ClientDNHeader).To(gomega.Equal(clientDNHeader))
+
+	// Hosts opting out make the bind fall back to optional verification
+	a.AddIngress(state.K8RouterIngress{
+		Name:    "status",
+		Hosts:   []string{"status.admin.example.org"},
+		Options: state.K8RouterIngressOptions{ClientVerify: config.ClientVerifyOff},
+	})
+	uut.regenerateTemplateInfo()
+	info = uut.templateInfo
+	g.Expect(info.SniList["admin"].ClientVerify).To(gomega.Equal(config.ClientVerifyOptional))
+	g.Expect(info.HostOptions["grafana.admin.example.org"].RequireClientCert).To(gomega.BeTrue())
+	g.Expect(info.HostOptions["status.admin.example.org"].RequireClientCert).To(gomega.BeFalse())
+
+	// Nobody can present a valid certificate without a CA
+	a.AddIngress(state.K8RouterIngress{
+		Name:    "www",
+		Hosts:   []string{"www.example.org"},
+		Options: state.K8RouterIngressOptions{ClientVerify: config.ClientVerifyRequired},
+	})
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.SniList["public"].ClientCA).To(gomega.BeEmpty())
+	g.Expect(uut.templateInfo.HostOptions["www.example.org"].RequireClientCert).To(gomega.BeTrue())
+	// Both ingresses of the host are told
+	received := receiveEvents(events)
+	g.Expect(received).To(gomega.HaveLen(2))
+	for _, event := range received {
+		g.Expect(event.Reason).To(gomega.Equal(reasonNoClientCA))
+	}
+
+	// The CA is dropped if no host wants client certificates
+	delete(a.Ingresses, "www")
+	status := a.Ingresses["status"]
+	status.Hosts = append(status.Hosts, "grafana.admin.example.org")
+	a.AddIngress(status)
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.SniList["admin"].ClientCA).To(gomega.BeEmpty())
+	g.Expect(uut.templateInfo.ClientDNHeader).To(gomega.BeEmpty())
+}
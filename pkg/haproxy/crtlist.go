@@ -0,0 +1,55 @@
+package haproxy
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Render the crt-list binding every certificate to the hosts it serves, including their TLS and client certificate
+// settings. The default certificate comes first, so HAProxy uses it for unknown SNIs
+func renderCrtList(info TemplateInfo) []byte {
+	var names []string
+	for name, details := range info.SniList {
+		if name != info.DefaultWildcardCert && len(details.Domains) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := info.SniList[info.DefaultWildcardCert]; ok {
+		names = append([]string{info.DefaultWildcardCert}, names...)
+	}
+
+	var rendered bytes.Buffer
+	for _, name := range names {
+		details := info.SniList[name]
+		var options []string
+		if details.ALPN != "" {
+			options = append(options, "alpn "+details.ALPN)
+		}
+		if details.MinVersion != "" {
+			options = append(options, "ssl-min-ver "+details.MinVersion)
+		}
+		if details.Ciphers != "" {
+			options = append(options, "ciphers "+details.Ciphers)
+		}
+		if details.CipherSuites != "" {
+			options = append(options, "ciphersuites "+details.CipherSuites)
+		}
+		if details.ClientCA != "" {
+			options = append(options, "ca-file "+details.ClientCA, "verify "+details.ClientVerify)
+			if details.ClientCRL != "" {
+				options = append(options, "crl-file "+details.ClientCRL)
+			}
+		}
+		rendered.WriteString(details.Path)
+		if len(options) > 0 {
+			rendered.WriteString(" [" + strings.Join(options, " ") + "]")
+		}
+		for _, domain := range details.Domains {
+			rendered.WriteString(" " + domain)
+		}
+		rendered.WriteString("\n")
+	}
+	return rendered.Bytes()
+}
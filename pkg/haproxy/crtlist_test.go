@@ -0,0 +1,110 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// In crt-list mode all certificates are terminated on a single frontend, which the SNI frontend only forwards to if
+// it has to pass through hosts
+func TestCrtListTermination(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-crtlist")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	uut := goldenHandler(false)
+	uut.config.TLSTermination = config.TLSTerminationCrtList
+	uut.config.CrtListPath = "/var/lib/k8router/k8router.crt-list"
+	uut.regenerateTemplateInfo()
+	for _, details := range uut.templateInfo.SniList {
+		g.Expect(details.LocalForwardPort).To(gomega.BeZero(), "Certificates don't get a frontend of their own")
+	}
+	expectGolden(g, "crtlist", renderTemplate(g, uut))
+
+	uut.config.CrtListPath = path.Join(dir, "k8router.crt-list")
+	uut.config.HAProxyDropinPath = path.Join(dir, "k8router.cfg")
+	uut.debugFileEventChannel = make(chan bool)
+	uut.regenerateTemplateInfo()
+
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+	crtList, err := ioutil.ReadFile(uut.config.CrtListPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(strings.Split(string(crtList), "\n")).To(gomega.Equal([]string{
+		"/etc/ssl/wildcard.pem [alpn h2,http/1.1 ssl-min-ver TLSv1.2 ca-file /etc/ssl/clients.pem verify optional " +
+			"crl-file /etc/ssl/clients.crl] admin.example.org grpc.example.org www.example.org",
+		"/etc/ssl/shop.pem [alpn http/1.1 ssl-min-ver TLSv1.2 ciphers ECDHE-RSA-AES256-GCM-SHA384] shop.example.org",
+		"",
+	}))
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeFalse())
+
+	// HAProxy only reads the crt-list on startup
+	uut.templateInfo.SniList["shop"] = SniDetail{Domains: []string{"shop.example.org"}, Path: "/etc/ssl/shop-new.pem"}
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+}
+
+// Without passthrough hosts, the crt-list frontend listens on the public addresses itself
+func TestCrtListWithoutPassthrough(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ip := net.IPv4(127, 0, 0, 1)
+	cert := config.CertificateInternal{Name: "dummycert", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/dummy.pem"}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": dummyClusterState()},
+		config: config.Config{
+			Certificates:   []config.Certificate{{CertificateInternal: &cert}},
+			IPs:            []*net.IP{&ip},
+			TLSTermination: config.TLSTerminationCrtList,
+			CrtListPath:    "/var/lib/k8router/k8router.crt-list",
+		},
+	}
+	uut.regenerateTemplateInfo()
+	rendered := renderTemplate(g, &uut)
+	g.Expect(rendered).NotTo(gomega.ContainSubstring("mode tcp"))
+	g.Expect(rendered).NotTo(gomega.ContainSubstring("127.0.0.1:12345"))
+	g.Expect(renderedSection(rendered, "frontend HTTPS")).To(gomega.ContainSubstring(
+		"bind     127.0.0.1:443 ssl crt-list /var/lib/k8router/k8router.crt-list"))
+	g.Expect(string(renderCrtList(uut.templateInfo))).To(gomega.Equal("/etc/ssl/dummy.pem foo.example.org test.example.org\n"))
+}
+
+// HAProxy doesn't start with an empty crt-list, so without certificates there is no crt-list and no frontend using it
+func TestCrtListWithoutCertificates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-crtlist")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	ip := net.IPv4(127, 0, 0, 1)
+	clusterState := dummyClusterState()
+	clusterState.AddIngress(state.K8RouterIngress{
+		Name:    "db",
+		Hosts:   []string{"db.example.org"},
+		Options: state.K8RouterIngressOptions{SSLPassthrough: true},
+	})
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": clusterState},
+		config: config.Config{
+			IPs:               []*net.IP{&ip},
+			TLSTermination:    config.TLSTerminationCrtList,
+			CrtListPath:       path.Join(dir, "k8router.crt-list"),
+			HAProxyDropinPath: path.Join(dir, "k8router.cfg"),
+		},
+		debugFileEventChannel: make(chan bool),
+	}
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.CrtListUsed).To(gomega.BeFalse())
+	rendered := renderTemplate(g, &uut)
+	g.Expect(rendered).NotTo(gomega.ContainSubstring("crt-list"))
+	g.Expect(renderedSection(rendered, "frontend HTTPS")).To(gomega.ContainSubstring(
+		"use_backend backend-" + uut.templateInfo.HostToBackend["db.example.org"] + " if acl-passthrough-db.example.org"))
+
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+	_, err = os.Stat(uut.config.CrtListPath)
+	g.Expect(os.IsNotExist(err)).To(gomega.BeTrue())
+}
@@ -0,0 +1,142 @@
+package haproxy
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Drain state of a single cluster as reported by the admin API
+type drainStatus struct {
+	Cluster string     `json:"cluster"`
+	Drained bool       `json:"drained"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// Read the drain flags of all clusters from disk. Returns whether anything changed
+func (h *Handler) refreshDrainState() bool {
+	if h.config.DrainDirectory == "" {
+		return false
+	}
+	drainedClusters := map[string]time.Time{}
+	for _, cluster := range h.config.Clusters {
+		info, err := os.Stat(path.Join(h.config.DrainDirectory, cluster.Name))
+		if err != nil {
+			continue
+		}
+		drainedClusters[cluster.Name] = info.ModTime()
+	}
+
+	changed := len(drainedClusters) != len(h.drainedClusters)
+	for cluster, since := range drainedClusters {
+		if _, ok := h.drainedClusters[cluster]; !ok {
+			changed = true
+			log.WithField("cluster", cluster).Info("Draining cluster")
+		}
+		clusterDrained.WithLabelValues(cluster).Set(1)
+		// Once the grace period is over, the cluster's backends have to be removed
+		if h.config.DrainGracePeriod > 0 && time.Since(since) > h.config.DrainGracePeriod && !h.drainCompleted[cluster] {
+			h.drainCompleted[cluster] = true
+			changed = true
+			log.WithField("cluster", cluster).Info("Drain grace period over, removing cluster's backends")
+		}
+	}
+	for cluster := range h.drainedClusters {
+		if _, ok := drainedClusters[cluster]; !ok {
+			changed = true
+			delete(h.drainCompleted, cluster)
+			clusterDrained.WithLabelValues(cluster).Set(0)
+			log.WithField("cluster", cluster).Info("Cluster no longer drained")
+		}
+	}
+	h.drainedClusters = drainedClusters
+	return changed
+}
+
+// Check whether a cluster is drained and whether its grace period is over
+func (h *Handler) drainState(cluster string) (bool, bool) {
+	_, drained := h.drainedClusters[cluster]
+	return drained, h.drainCompleted[cluster]
+}
+
+// DrainAPI returns the admin API handler to drain clusters at runtime. It only manages the drain flag files, the
+// event loop picks up the changes
+func (h *Handler) DrainAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) == 1 && parts[0] == "clusters" && r.Method == http.MethodGet {
+			var statuses []drainStatus
+			for _, cluster := range h.config.Clusters {
+				statuses = append(statuses, h.readDrainStatus(cluster.Name))
+			}
+			writeJSON(w, statuses)
+			return
+		}
+		if len(parts) != 3 || parts[0] != "clusters" || parts[2] != "drain" || !h.isConfiguredCluster(parts[1]) {
+			http.NotFound(w, r)
+			return
+		}
+		cluster := parts[1]
+		flagFile := path.Join(h.config.DrainDirectory, cluster)
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			if _, statErr := os.Stat(flagFile); os.IsNotExist(statErr) {
+				err = os.MkdirAll(h.config.DrainDirectory, 0755)
+				if err == nil {
+					err = ioutil.WriteFile(flagFile, []byte{}, 0644)
+				}
+			}
+		case http.MethodDelete:
+			err = os.Remove(flagFile)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			log.WithField("cluster", cluster).WithError(err).Error("Couldn't change drain flag")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, h.readDrainStatus(cluster))
+	})
+}
+
+// Check whether a cluster with the given name is configured
+func (h *Handler) isConfiguredCluster(name string) bool {
+	for _, cluster := range h.config.Clusters {
+		if cluster.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the drain status of a cluster directly from disk
+func (h *Handler) readDrainStatus(cluster string) drainStatus {
+	status := drainStatus{Cluster: cluster}
+	info, err := os.Stat(path.Join(h.config.DrainDirectory, cluster))
+	if err == nil {
+		since := info.ModTime()
+		status.Drained = true
+		status.Since = &since
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(obj)
+	if err != nil {
+		log.WithError(err).Warning("Couldn't write admin API response")
+	}
+}
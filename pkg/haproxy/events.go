@@ -0,0 +1,79 @@
+package haproxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/state"
+	"sort"
+)
+
+// Reasons of the events we report about ingresses
+const (
+	reasonHostRejected           = "HostRejected"
+	reasonNoCertificate          = "NoCertificate"
+	reasonConflictingAnnotations = "ConflictingAnnotations"
+	reasonHostRouted             = "HostRouted"
+	reasonNoClientCA             = "NoClientCA"
+	reasonZeroWeights            = "ZeroWeights"
+)
+
+// Tell the owners of an ingress about something. Events are dropped if nobody keeps up with them
+func (h *Handler) reportIngressEvent(event state.IngressEvent) {
+	if h.ingressEvents == nil {
+		return
+	}
+	select {
+	case h.ingressEvents <- event:
+	default:
+		log.WithFields(log.Fields{
+			"cluster":   event.Cluster,
+			"namespace": event.Namespace,
+			"ingress":   event.Name,
+			"reason":    event.Reason,
+		}).Debug("Dropping ingress event")
+	}
+}
+
+// Tell the owners of all ingresses serving a host about something
+func (h *Handler) reportHostEvent(host string, warning bool, reason string, message string) {
+	if h.ingressEvents == nil {
+		return
+	}
+	for _, clusterState := range h.clusterState {
+		for _, ingress := range clusterState.Ingresses {
+			if containsString(ingress.Hosts, host) {
+				h.reportIngressEvent(ingressEvent(clusterState.Name, &ingress, warning, reason, message))
+			}
+		}
+	}
+}
+
+// Build an event about an ingress
+func ingressEvent(cluster string, ingress *state.K8RouterIngress, warning bool, reason string,
+	message string) state.IngressEvent {
+	return state.IngressEvent{
+		Cluster:   cluster,
+		Kind:      ingress.Kind,
+		Namespace: ingress.Namespace,
+		Name:      ingress.ObjectName,
+		Warning:   warning,
+		Reason:    reason,
+		Message:   message,
+	}
+}
+
+// Tell the owners of all hosts which were just added to the running config
+func (h *Handler) reportRoutedHosts() {
+	routed := map[string]bool{}
+	var added []string
+	for host := range h.appliedTemplateInfo.HostToBackend {
+		routed[host] = true
+		if !h.routedHosts[host] {
+			added = append(added, host)
+		}
+	}
+	h.routedHosts = routed
+	sort.Strings(added)
+	for _, host := range added {
+		h.reportHostEvent(host, false, reasonHostRouted, "Host "+host+" is routed by k8router")
+	}
+}
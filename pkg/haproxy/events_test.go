@@ -0,0 +1,82 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"testing"
+)
+
+// Collect all events reported so far
+func receiveEvents(events chan state.IngressEvent) []state.IngressEvent {
+	var received []state.IngressEvent
+	for len(events) > 0 {
+		received = append(received, <-events)
+	}
+	return received
+}
+
+// The owners of ingresses should learn about problems with their hosts and when they go live
+func TestIngressEvents(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cert := config.CertificateInternal{
+		Name:    "dummycert",
+		Domains: []string{"*.example.org"},
+		Cert:    "/etc/ssl/dummy.pem",
+	}
+	a := clusterStateWithBackends("a", 1)
+	a.AddIngress(state.K8RouterIngress{
+		Name:       "shop-web",
+		Namespace:  "shop",
+		ObjectName: "web",
+		Hosts:      []string{"app.example.org"},
+		Options:    state.K8RouterIngressOptions{ForceHTTPS: true},
+	})
+	b := clusterStateWithBackends("b", 1)
+	b.AddIngress(state.K8RouterIngress{
+		Name:       "shop-web",
+		Namespace:  "shop",
+		ObjectName: "web",
+		Hosts:      []string{"app.example.org", "app.example.com"},
+		Options:    state.K8RouterIngressOptions{MaxBodySize: 1024},
+	})
+	events := make(chan state.IngressEvent, 10)
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"a": a, "b": b},
+		config: config.Config{
+			Certificates: []config.Certificate{{CertificateInternal: &cert}},
+		},
+		ingressEvents: events,
+	}
+	uut.regenerateTemplateInfo()
+	g.Expect(receiveEvents(events)).To(gomega.ConsistOf(
+		state.IngressEvent{
+			Cluster:   "b",
+			Namespace: "shop",
+			Name:      "web",
+			Warning:   true,
+			Reason:    reasonConflictingAnnotations,
+			Message:   "Annotations for host app.example.org are ignored, they conflict with the ones of a/shop-web",
+		},
+		state.IngressEvent{
+			Cluster:   "b",
+			Namespace: "shop",
+			Name:      "web",
+			Warning:   true,
+			Reason:    reasonNoCertificate,
+			Message:   "Host app.example.com is not covered by any certificate",
+		},
+	))
+
+	// Hosts are only reported once they're in the running config
+	uut.appliedTemplateInfo = uut.templateInfo
+	uut.reportRoutedHosts()
+	received := receiveEvents(events)
+	g.Expect(received).To(gomega.HaveLen(3))
+	for _, event := range received {
+		g.Expect(event.Warning).To(gomega.BeFalse())
+		g.Expect(event.Reason).To(gomega.Equal(reasonHostRouted))
+	}
+	uut.reportRoutedHosts()
+	g.Expect(events).To(gomega.BeEmpty())
+}
@@ -0,0 +1,100 @@
+package haproxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/certificate"
+	"sort"
+	"time"
+)
+
+// Update the expiry metrics and warn about certificates which are about to expire. Returns whether the set of expired
+// certificates changed since the last check
+func (h *Handler) checkCertificateExpiry() bool {
+	thresholds := append([]int{}, h.config.CertificateExpiry.WarningDays...)
+	sort.Ints(thresholds)
+
+	// Several leaves may share a SAN, only the first one to expire matters
+	type gaugeKey struct {
+		certificate string
+		san         string
+	}
+	sanExpiry := map[gaugeKey]time.Time{}
+	expiredCertificates := map[string]bool{}
+	expiryWarnings := map[string]int{}
+	for _, cert := range h.certificateEntries() {
+		bundle := h.entryBundle(cert)
+		if bundle == nil {
+			continue
+		}
+		for _, leaf := range bundle.Leaves {
+			for _, san := range leaf.DNSNames {
+				key := gaugeKey{cert.Name, san}
+				if current, ok := sanExpiry[key]; !ok || leaf.NotAfter.Before(current) {
+					sanExpiry[key] = leaf.NotAfter
+				}
+			}
+		}
+
+		notAfter := bundle.NotAfter()
+		daysLeft := time.Until(notAfter).Hours() / 24
+		entry := log.WithFields(log.Fields{
+			"certificate": cert.Name,
+			"notAfter":    notAfter,
+			"daysLeft":    int(daysLeft),
+		})
+		if daysLeft <= 0 {
+			expiredCertificates[cert.Name] = true
+			if !h.expiredCertificates[cert.Name] {
+				entry.Error("Certificate expired!")
+			}
+			continue
+		}
+		entry.Debug("Checked certificate expiry")
+		// Only warn once per threshold
+		for _, threshold := range thresholds {
+			if daysLeft < float64(threshold) {
+				if h.expiryWarnings[cert.Name] != threshold {
+					entry.WithField("threshold", threshold).Warning("Certificate is about to expire")
+				}
+				expiryWarnings[cert.Name] = threshold
+				break
+			}
+		}
+	}
+	certificateExpiryDays.Reset()
+	for key, notAfter := range sanExpiry {
+		certificateExpiryDays.WithLabelValues(key.certificate, key.san).Set(time.Until(notAfter).Hours() / 24)
+	}
+
+	changed := len(expiredCertificates) != len(h.expiredCertificates)
+	for name := range expiredCertificates {
+		if !h.expiredCertificates[name] {
+			changed = true
+		}
+	}
+	h.expiredCertificates = expiredCertificates
+	h.expiryWarnings = expiryWarnings
+	return changed
+}
+
+// Get the loaded bundle of a certificate entry. Configured certificates are already loaded, synced and issued ones
+// are read from disk
+func (h *Handler) entryBundle(cert certificateEntry) *certificate.Bundle {
+	if bundle, ok := h.certificates[cert.Name]; ok {
+		return bundle
+	}
+	bundle, err := certificate.Load(cert.Path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"certificate": cert.Name,
+			"path":        cert.Path,
+		}).WithError(err).Warning("Couldn't load certificate to check its expiry")
+		return nil
+	}
+	return bundle
+}
+
+// Check whether a certificate should no longer be preferred because it expired
+func (h *Handler) isReplaceableExpiredCertificate(name string) bool {
+	return h.config.CertificateExpiry.ReplaceExpired && h.expiredCertificates[name]
+}
@@ -0,0 +1,170 @@
+package haproxy
+
+import (
+	"flag"
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// Compare a rendered config with its golden file (or update the golden file if requested)
+func expectGolden(g *gomega.WithT, name string, rendered string) {
+	file := path.Join("testdata", name+".golden")
+	if *updateGolden {
+		g.Expect(ioutil.WriteFile(file, []byte(rendered), 0644)).To(gomega.Succeed())
+	}
+	golden, err := ioutil.ReadFile(file)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(rendered).To(gomega.Equal(string(golden)), "Run 'go test ./pkg/haproxy -update' if this change is intended")
+}
+
+// Build a handler using most features, with cluster states in the given order
+func goldenHandler(reverse bool) *Handler {
+	ip := net.IPv4(192, 0, 2, 1)
+	redirect := true
+	http2 := true
+	blueCluster := config.ClusterInternal{
+		Name:        "blue",
+		Weight:      intPointer(90),
+		IngressPort: 80,
+		HealthCheck: config.HealthCheck{Path: "/healthz", Port: 10254, ExpectStatus: 200, Interval: 2 * time.Second},
+	}
+	greenCluster := config.ClusterInternal{
+		Name:        "green",
+		Weight:      intPointer(10),
+		IngressPort: 80,
+		HealthCheck: config.HealthCheck{Path: "/healthz", Port: 10254, ExpectStatus: 200, Interval: 2 * time.Second},
+	}
+	drCluster := config.ClusterInternal{Name: "dr site", Weight: intPointer(100), Priority: -1, IngressPort: 8080}
+	wildcard := config.CertificateInternal{
+		Name:    "wildcard",
+		Domains: []string{"*.example.org"},
+		Cert:    "/etc/ssl/wildcard.pem",
+		Default: true,
+		// Only the admin host is interested
+		ClientCA:     "/etc/ssl/clients.pem",
+		ClientVerify: config.ClientVerifyOptional,
+		ClientCRL:    "/etc/ssl/clients.crl",
+	}
+	shop := config.CertificateInternal{
+		Name:            "shop",
+		Domains:         []string{"shop.example.org"},
+		Cert:            "/etc/ssl/shop.pem",
+		RedirectToHTTPS: &redirect,
+		TLS:             config.TLS{ALPN: []string{"http/1.1"}, Ciphers: "ECDHE-RSA-AES256-GCM-SHA384"},
+	}
+	clusters := []config.Cluster{{ClusterInternal: &blueCluster}, {ClusterInternal: &greenCluster},
+		{ClusterInternal: &drCluster}}
+	certificates := []config.Certificate{{CertificateInternal: &wildcard}, {CertificateInternal: &shop}}
+
+	blue := clusterStateWithBackends("blue", 3, "www.example.org", "shop.example.org")
+	blue.AddIngress(state.K8RouterIngress{
+		Name:  "admin",
+		Hosts: []string{"admin.example.org"},
+		Options: state.K8RouterIngressOptions{
+			AllowedSourceRanges: []string{"10.0.0.0/8"},
+			BasicAuthUserlist:   "admins",
+			BasicAuthRealm:      "k8router",
+			ResponseTimeout:     time.Minute,
+			ClientVerify:        config.ClientVerifyRequired,
+		},
+	})
+	// Terminates TLS in-cluster, so the wildcard certificate mustn't be used
+	blue.AddIngress(state.K8RouterIngress{
+		Name:    "vault",
+		Hosts:   []string{"vault.example.org"},
+		Options: state.K8RouterIngressOptions{SSLPassthrough: true},
+	})
+	blue.AddIngress(state.K8RouterIngress{Name: "mtls", Hosts: []string{"mtls.example.com"}})
+	blue.AddIngress(state.K8RouterIngress{
+		Name:    "grpc",
+		Hosts:   []string{"grpc.example.org"},
+		Options: state.K8RouterIngressOptions{BackendProtocol: config.BackendProtocolH2},
+	})
+	green := clusterStateWithBackends("green", 2, "www.example.org", "shop.example.org")
+	dr := clusterStateWithBackends("dr site", 1, "www.example.org")
+	// Pods of different clusters may have the same name
+	backend := dr.Backends["dr site-0"]
+	delete(dr.Backends, backend.Name)
+	backend.Name = "blue-0"
+	dr.AddBackend(backend)
+	if reverse {
+		clusters[0], clusters[2] = clusters[2], clusters[0]
+		certificates[0], certificates[1] = certificates[1], certificates[0]
+	}
+	return &Handler{
+		clusterState: map[string]state.ClusterState{"blue": blue, "green": green, "dr site": dr},
+		config: config.Config{
+			Clusters:     clusters,
+			Certificates: certificates,
+			IPs:          []*net.IP{&ip},
+			HSTSMaxAge:   365 * 24 * time.Hour,
+			TLS:          config.TLS{HTTP2: &http2, MinVersion: "TLSv1.2"},
+			Passthrough:  []config.PassthroughRule{{Hosts: []string{"mtls.example.com"}, Service: "10.0.0.10:8443"}},
+		},
+	}
+}
+
+// The rendered config mustn't depend on the order of config entries, pods or ingresses
+func TestGoldenConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": dummyClusterState()},
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+	cert := config.CertificateInternal{Name: "dummycert", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/dummy.pem"}
+	uut.config = config.Config{
+		Certificates: []config.Certificate{{CertificateInternal: &cert}},
+		IPs:          []*net.IP{&ip},
+	}
+	uut.regenerateTemplateInfo()
+	expectGolden(g, "basic", renderTemplate(g, &uut))
+
+	for _, reverse := range []bool{false, true} {
+		for i := 0; i < 5; i++ {
+			handler := goldenHandler(reverse)
+			handler.SetCertificateIssuer(&fakeIssuer{
+				certificates: map[string]string{"other.example.com": "/var/lib/k8router/acme/certs/other.example.com.pem"},
+			})
+			handler.regenerateTemplateInfo()
+			expectGolden(g, "full", renderTemplate(g, handler))
+		}
+	}
+}
+
+// HAProxy should only be reloaded if the config or any certificate changed
+func TestReloadOnlyOnChange(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-reload")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	uut := goldenHandler(false)
+	uut.config.HAProxyDropinPath = path.Join(dir, "k8router.cfg")
+	// Don't actually reload anything
+	uut.debugFileEventChannel = make(chan bool)
+	renderTemplate(g, uut)
+
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeFalse())
+
+	// Certificates are only read on reload
+	uut.certificatesChanged = true
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeFalse())
+
+	uut.clusterState["green"] = clusterStateWithBackends("green", 1, "www.example.org", "shop.example.org")
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+}
@@ -1,13 +1,16 @@
 package haproxy
 
 import (
+	"bytes"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/certificate"
 	"github.com/vsk8s/k8router/pkg/config"
 	"github.com/vsk8s/k8router/pkg/state"
 	"io/ioutil"
-	"os"
 	"os/exec"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -24,11 +27,72 @@ type Handler struct {
 
 	template *template.Template
 
+	// Certificate name to parsed certificate (nil if loading failed)
+	certificates map[string]*certificate.Bundle
+
+	// Certificates synced from TLS secrets, by name
+	managedCertificates map[string]certificateEntry
+
+	// Names of all configured certificates which are expired
+	expiredCertificates map[string]bool
+
+	// Certificate name to the last expiry threshold (in days) we warned about
+	expiryWarnings map[string]int
+
+	// Drained clusters and the time draining started
+	drainedClusters map[string]time.Time
+
+	// Drained clusters whose grace period is over
+	drainCompleted map[string]bool
+
+	// Obtains certificates for uncovered hosts (optional)
+	issuer CertificateIssuer
+
+	// Uncovered wildcard hosts we already warned about not being able to issue certificates for
+	wildcardHostsWarned map[string]bool
+
+	// Receives everything the owners of ingresses should know about (optional)
+	ingressEvents chan state.IngressEvent
+
+	// Current host policy violations by cluster
+	hostViolations map[string]map[hostViolation]bool
+
+	// Hosts in the config HAProxy currently runs with
+	routedHosts map[string]bool
+
 	// Current state for templating
 	templateInfo TemplateInfo
 
 	haproxyNeedsUpdate bool
 
+	// Whether pending changes have to be applied without waiting for further changes
+	urgentUpdate bool
+
+	// Number of changes since the config was last rendered
+	pendingChanges int
+
+	// Time of the first and the latest change since the config was last rendered
+	pendingSince time.Time
+	lastChange   time.Time
+
+	// Times of all reloads within the last minute
+	reloadTimes []time.Time
+
+	// Whether anything but server addresses changed since the config was last written. Address changes alone can be
+	// applied via the runtime API
+	reloadRequired bool
+
+	// Template info HAProxy currently runs with
+	appliedTemplateInfo TemplateInfo
+
+	// Local port of each certificate's frontend. Read from the config we've written before on startup, so
+	// certificates keep their ports
+	localPorts map[string]int
+
+	// Whether certificate files changed since the last reload. HAProxy only reads them on reload, so it has to be
+	// reloaded even if the config itself is unchanged
+	certificatesChanged bool
+
 	// Channel to stop our goroutine
 	stopper chan bool
 
@@ -49,14 +113,33 @@ func Initialize(updates chan state.ClusterState, config config.Config) (*Handler
 	if err != nil {
 		return nil, err
 	}
-	return &Handler{
+	handler := &Handler{
 		updates:            updates,
 		haproxyNeedsUpdate: false,
 		template:           parsedTemplate,
 		clusterState:       make(map[string]state.ClusterState),
+		certificates:       make(map[string]*certificate.Bundle),
+		drainedClusters:    make(map[string]time.Time),
+		drainCompleted:     make(map[string]bool),
+		hostViolations:     make(map[string]map[hostViolation]bool),
 		config:             config,
 		stopper:            make(chan bool),
-	}, nil
+	}
+	handler.localPorts = readLocalPorts(config.HAProxyDropinPath)
+	handler.refreshCertificates()
+	handler.checkCertificateExpiry()
+	handler.refreshDrainState()
+	return handler, nil
+}
+
+// SetCertificateIssuer enables automatic certificate issuance for hosts without a certificate. Call before Start()
+func (h *Handler) SetCertificateIssuer(issuer CertificateIssuer) {
+	h.issuer = issuer
+}
+
+// SetIngressEvents makes the handler report events about ingresses to the given channel. Call before Start()
+func (h *Handler) SetIngressEvents(events chan state.IngressEvent) {
+	h.ingressEvents = events
 }
 
 // Start the handler
@@ -70,120 +153,411 @@ func (h *Handler) Stop() {
 }
 
 func (h *Handler) eventLoop() {
-	updateTicks := time.NewTicker(1 * time.Second)
+	updateTicks := time.NewTicker(reloadCheckInterval)
+	drainTicks := time.NewTicker(1 * time.Second)
+	certificateTicks := time.NewTicker(certificateCheckInterval)
+	expiryInterval := h.config.CertificateExpiry.CheckInterval
+	if expiryInterval <= 0 {
+		expiryInterval = config.DefaultCertificateExpiryCheckInterval
+	}
+	expiryTicks := time.NewTicker(expiryInterval)
+	var issuerUpdates <-chan bool
+	if h.issuer != nil {
+		issuerUpdates = h.issuer.Updates()
+	}
 	for {
 		select {
 		case _ = <-h.stopper:
 			log.Debug("Returning from event loop after stop request")
 			return
 		case newState := <-h.updates:
-			currentState := h.clusterState[newState.Name]
-			if !state.IsClusterStateEquivalent(&currentState, &newState) {
-				h.clusterState[newState.Name] = newState
-				h.haproxyNeedsUpdate = true
+			h.applyClusterState(newState)
+		case _ = <-certificateTicks.C:
+			if h.refreshCertificates() {
+				h.checkCertificateExpiry()
+				h.certificatesChanged = true
+				h.scheduleUpdate(false)
 			}
-		case _ = <-updateTicks.C:
-			if h.haproxyNeedsUpdate {
-				h.haproxyNeedsUpdate = false
-				log.WithField("clusterState", h.clusterState).Debug("Rebuilding config")
-				h.regenerateTemplateInfo()
-				log.WithField("templateInfo", h.templateInfo).Debug("Templating config")
-				h.writeConfigToHAProxy()
-				if h.debugFileEventChannel != nil {
-					h.debugFileEventChannel <- true
-				}
+		case _ = <-expiryTicks.C:
+			if h.checkCertificateExpiry() {
+				h.reloadRequired = true
+				h.scheduleUpdate(false)
+			}
+		case _ = <-issuerUpdates:
+			h.certificatesChanged = true
+			h.scheduleUpdate(false)
+		case _ = <-drainTicks.C:
+			if h.refreshDrainState() {
+				h.reloadRequired = true
+				h.scheduleUpdate(false)
+			}
+		case now := <-updateTicks.C:
+			if h.updateDue(now) {
+				h.applyPendingUpdate()
 			}
 		}
 	}
 }
 
+// Take over a new cluster state and figure out whether HAProxy has to be reloaded for it
+func (h *Handler) applyClusterState(newState state.ClusterState) {
+	currentState := h.clusterState[newState.Name]
+	if newState.Generation != 0 && newState.Generation < currentState.Generation {
+		log.WithFields(log.Fields{
+			"cluster":    newState.Name,
+			"generation": newState.Generation,
+			"current":    currentState.Generation,
+		}).Warning("Ignoring outdated cluster state")
+		return
+	}
+	newState, violations := h.applyHostPolicy(newState)
+	h.reportHostViolations(newState.Name, violations)
+	diff := state.Diff(&currentState, &newState)
+	if diff.IsEmpty() {
+		h.clusterState[newState.Name] = newState
+		return
+	}
+	hostsBefore := h.hostsWithBackends()
+	h.clusterState[newState.Name] = newState
+	hostsLost := hostsLosingAllBackends(hostsBefore, h.hostsWithBackends())
+	entry := log.WithField("cluster", newState.Name)
+	for kind, names := range diff.Summary() {
+		entry = entry.WithField(kind, names)
+	}
+	entry.WithField("generation", newState.Generation).Info("Cluster state changed")
+	if !diff.OnlyBackendAddressesChanged() {
+		h.reloadRequired = true
+	}
+	if len(hostsLost) > 0 {
+		sort.Strings(hostsLost)
+		log.WithField("hosts", hostsLost).Warning("Hosts lost all backends, updating config immediately")
+	}
+	h.scheduleUpdate(len(hostsLost) > 0)
+}
+
 func (h *Handler) regenerateTemplateInfo() {
 	/* The HAProxy config we write works (simplified) like this:
 	 *  * There is a frontend that splits request according to SNI
 	 *  * We have a backend where all SNI requests go to and another frontend
 	 *  * This frontend does "normal" host-style case distinction and then
 	 *  * routes to a combination of backends
+	 *  * Passthrough hosts skip the wrapping and go straight to a TCP backend
 	 */
 
 	hostToClusters := h.computeHostToClusterMap()
-	hostToBackend, backendCombinationList := h.computeBackends(hostToClusters)
-	hostToCert, sniList, defaultCert := h.computeCertsForHosts(hostToBackend)
+	hostToOptions := h.computeHostOptions(hostToClusters)
+	passthroughHosts := h.computePassthroughHosts(hostToClusters, hostToOptions)
+	hostToBackend, hostPaths, backendCombinationList, backendSettings := h.computeBackends(hostToClusters,
+		hostToOptions, passthroughHosts)
+	// Passthrough hosts don't need a certificate of ours
+	terminated := terminatedHosts(hostToBackend, passthroughHosts)
+	hostToCert, sniList, defaultCert := h.computeCertsForHosts(terminated)
 
-	h.warnAboutMissingCerts(hostToBackend, hostToCert)
+	h.warnAboutMissingCerts(terminated, hostToCert)
+	h.requestCertificates(terminated, hostToCert)
+
+	hostOptions, redirectHosts := h.computeHostPolicies(hostToOptions, hostToCert)
+	clientDNHeader := h.computeClientAuth(hostToOptions, sniList, hostOptions)
 
 	h.templateInfo = TemplateInfo{
 		SniList:                sniList,
 		BackendCombinationList: backendCombinationList,
 		HostToBackend:          hostToBackend,
+		HostPaths:              hostPaths,
+		PassthroughHosts:       map[string]bool{},
+		HostOptions:            hostOptions,
+		RedirectHosts:          redirectHosts,
+		BackendSettings:        backendSettings,
 		IPs:                    h.config.IPs,
 		DefaultWildcardCert:    defaultCert,
+		ClientDNHeader:         clientDNHeader,
+	}
+	if h.config.TLSTermination == config.TLSTerminationCrtList {
+		h.templateInfo.CrtListPath = h.config.CrtListPath
+		h.templateInfo.CrtListForwardPort, _ = h.localPortRange()
+		h.templateInfo.CrtListUsed = len(renderCrtList(h.templateInfo)) > 0
+	}
+	for host := range passthroughHosts {
+		h.templateInfo.PassthroughHosts[host] = true
+	}
+	if h.issuer != nil {
+		h.templateInfo.ACMEChallengeAddress = h.issuer.ChallengeAddress()
 	}
 }
 
 func (h *Handler) computeCertsForHosts(hostToBackend map[string]string) (map[string]string, map[string]SniDetail, string) {
-	// TODO(uubk): Make configurable
-	localForwardPort := 12345
+	entries := h.certificateEntries()
+
+	// Figure out the most specific certificate for each host. Exact matches beat wildcards, in case of a tie the
+	// first certificate wins. Expired certificates may lose against everything else if configured
 	hostToCert := map[string]string{}
+	hostToSpecificity := map[string]int{}
+	for _, cert := range entries {
+		for _, domain := range cert.Domains {
+			specificity := 2
+			if strings.HasPrefix(domain, "*.") {
+				specificity = 1
+			}
+			if h.isReplaceableExpiredCertificate(cert.Name) {
+				specificity = 0
+			}
+			for host := range hostToBackend {
+				if !certificate.MatchesDomain(domain, host) {
+					continue
+				}
+				current, ok := hostToCert[host]
+				if ok && current != cert.Name && specificity == hostToSpecificity[host] {
+					log.WithFields(log.Fields{
+						"host":        host,
+						"certificate": current,
+						"ignored":     cert.Name,
+					}).Warning("Host is covered by several equally specific certificates, using the first one")
+				}
+				if !ok || specificity > hostToSpecificity[host] {
+					hostToCert[host] = cert.Name
+					hostToSpecificity[host] = specificity
+				}
+			}
+		}
+	}
+	certToHosts := map[string][]string{}
+	for host, cert := range hostToCert {
+		certToHosts[cert] = append(certToHosts[cert], host)
+	}
+
+	// Register names in a fixed order, so they don't depend on the order of the config file
+	sortedEntries := append([]certificateEntry{}, entries...)
+	sort.SliceStable(sortedEntries, func(i, j int) bool { return sortedEntries[i].Name < sortedEntries[j].Name })
+	names := nameRegistry{}
+	entryNames := map[string]string{}
+	for _, cert := range sortedEntries {
+		entryNames[cert.Name] = names.name(cert.Name)
+	}
+
 	sniList := map[string]SniDetail{}
 	defaultCert := ""
-	for _, cert := range h.config.Certificates {
-		// For each host: Figure out whether we actually have a backend there
-		var hostsUsingCurrentCert []string
+	for _, cert := range entries {
 		isWildcard := false
-		for _, host := range cert.Domains {
-			if strings.Contains(host, "*") {
+		for _, domain := range cert.Domains {
+			if strings.HasPrefix(domain, "*.") {
 				isWildcard = true
-				domain := strings.Trim(host, "*")
-				for host := range hostToBackend {
-					if strings.HasSuffix(host, domain) {
-						hostsUsingCurrentCert = append(hostsUsingCurrentCert, host)
-						hostToCert[host] = cert.Name
-					}
-				}
-			} else {
-				if _, ok := hostToBackend[host]; ok {
-					hostsUsingCurrentCert = append(hostsUsingCurrentCert, host)
-					hostToCert[host] = cert.Name
-				}
 			}
 		}
-		currentCert := SniDetail{
-			Domains:          hostsUsingCurrentCert,
-			IsWildcard:       isWildcard,
-			Path:             cert.Cert,
-			LocalForwardPort: localForwardPort,
+		hostsUsingCurrentCert := certToHosts[cert.Name]
+		sort.Strings(hostsUsingCurrentCert)
+		name := entryNames[cert.Name]
+		clientCA, clientVerify, clientCRL := h.clientAuthSettings(cert.Name)
+		details := SniDetail{
+			Domains:      hostsUsingCurrentCert,
+			IsWildcard:   isWildcard,
+			Path:         cert.Path,
+			ClientCA:     clientCA,
+			ClientVerify: clientVerify,
+			ClientCRL:    clientCRL,
+		}
+		h.applyTLSSettings(cert.Name, &details)
+		sniList[name] = details
+		if cert.IsDefault || (isWildcard && defaultCert == "") {
+			defaultCert = name
+		}
+	}
+	if h.config.TLSTermination == config.TLSTerminationCrtList {
+		// All certificates share a single frontend
+		return hostToCert, sniList, defaultCert
+	}
+	var certNames []string
+	for name := range sniList {
+		certNames = append(certNames, name)
+	}
+	first, count := h.localPortRange()
+	ports, skipped := assignLocalPorts(certNames, first, count, h.localPorts, h.localPortAvailable)
+	h.localPorts = ports
+	for _, name := range skipped {
+		log.WithFields(log.Fields{
+			"certificate": name,
+			"first":       first,
+			"count":       count,
+		}).Error("Certificate skipped because the local port range is full")
+		// Its hosts are reported as not covered by any certificate
+		for _, host := range sniList[name].Domains {
+			delete(hostToCert, host)
 		}
-		sniList[cert.Name] = currentCert
-		localForwardPort++
-		if isWildcard {
-			defaultCert = cert.Name
+		delete(sniList, name)
+		if name == defaultCert {
+			defaultCert = ""
 		}
 	}
+	for name, port := range ports {
+		details := sniList[name]
+		details.LocalForwardPort = port
+		sniList[name] = details
+	}
 	return hostToCert, sniList, defaultCert
 }
 
-func (h *Handler) computeBackends(hostToClusters map[string][]string) (map[string]string, map[string][]Backend) {
+func (h *Handler) computeBackends(hostToClusters map[string][]string, hostToOptions map[string]state.K8RouterIngressOptions,
+	passthroughHosts map[string]string) (map[string]string, map[string][]PathBackend, map[string][]Backend,
+	map[string]BackendSettings) {
+	hostToClusterWeights := h.computeClusterWeights(hostToClusters)
+	hostToClusterPriorities := h.computeClusterPriorities(hostToClusters)
 	hostToBackendCombination := map[string]string{}
+	hostPaths := map[string][]PathBackend{}
 	backendCombinationList := map[string][]Backend{}
+	backendSettings := map[string]BackendSettings{}
 	for host, clusters := range hostToClusters {
+		service, passthrough := passthroughHosts[host]
+		if service != "" {
+			name, servers, settings := passthroughServiceBackend(service)
+			backendCombinationList[name] = servers
+			backendSettings[name] = settings
+			hostToBackendCombination[host] = name
+			continue
+		}
 		sort.Strings(clusters)
-		backendCombination := strings.Join(clusters, "-")
-		if _, ok := backendCombinationList[backendCombination]; !ok {
-			// We haven't seen this particular backend combination yet
-			var backends []Backend
-			for _, cluster := range clusters {
-				for _, backend := range h.clusterState[cluster].Backends {
-					backends = append(backends, Backend{
-						IP:   backend.IP,
-						Name: backend.Name,
-					})
+		fallbackClusters, fallbackWeights, paths := h.computeHostPaths(host, clusters, hostToClusterWeights[host])
+		hostToBackendCombination[host] = h.addBackendCombination(host, fallbackClusters, fallbackWeights,
+			hostToClusterPriorities[host], hostToOptions[host], passthrough, backendCombinationList, backendSettings)
+		if passthrough {
+			// Paths are hidden inside the passed through TLS connections
+			continue
+		}
+		for _, path := range paths {
+			hostPaths[host] = append(hostPaths[host], PathBackend{
+				Path:   path.path.Path,
+				Prefix: path.path.Prefix,
+				Backend: h.addBackendCombination(host, path.clusters, path.weights, hostToClusterPriorities[host],
+					hostToOptions[host], false, backendCombinationList, backendSettings),
+			})
+		}
+	}
+	return hostToBackendCombination, hostPaths, backendCombinationList, backendSettings
+}
+
+// Add the backend combining the given clusters of a host unless it exists already. Returns its name
+func (h *Handler) addBackendCombination(host string, clusters []string, clusterWeights map[string]int,
+	clusterPriorities map[string]int, options state.K8RouterIngressOptions, passthrough bool,
+	backendCombinationList map[string][]Backend, backendSettings map[string]BackendSettings) string {
+	active, drained := h.splitDrainedClusters(host, clusters)
+	primary, backup := splitByPriority(active, clusterPriorities)
+	// The backend name is readable, the hash makes sure that different combinations can't end up with the same
+	// name (e.g. cluster "a-b" vs. clusters "a" and "b")
+	backendCombination := strings.Join(clusters, "-")
+	var weights []string
+	if !isUniform(clusters, clusterWeights) {
+		for _, cluster := range clusters {
+			weights = append(weights, strconv.Itoa(clusterWeights[cluster]))
+		}
+		backendCombination += "_w" + strings.Join(weights, "-")
+	}
+	if len(backup) > 0 {
+		backendCombination += "_b" + strings.Join(backup, "-")
+	}
+	if len(drained) > 0 {
+		backendCombination += "_d" + strings.Join(drained, "-")
+	}
+	// Timeouts are set per backend, so hosts with different timeouts need separate backends. HTTP timeouts don't
+	// apply to passed through connections
+	settings := BackendSettings{TCP: true}
+	if !passthrough {
+		settings = toBackendSettings(options)
+	}
+	if settings.RequestTimeout != "" || settings.ResponseTimeout != "" {
+		backendCombination += "_t" + settings.RequestTimeout + "-" + settings.ResponseTimeout
+	}
+	hashParts := []string{fmt.Sprintf("%q", clusters), fmt.Sprintf("%q", weights), fmt.Sprintf("%q", backup),
+		fmt.Sprintf("%q", drained), settings.RequestTimeout, settings.ResponseTimeout}
+	if passthrough {
+		backendCombination += "_p"
+		hashParts = append(hashParts, "passthrough")
+	}
+	// The backend protocol of the clusters can be overridden per host
+	protocol := options.BackendProtocol
+	if passthrough {
+		protocol = ""
+	}
+	if protocol != "" {
+		backendCombination += "_" + protocol
+		hashParts = append(hashParts, "protocol "+protocol)
+	}
+	backendCombination = invalidNameCharacters.ReplaceAllString(backendCombination, "_") + "-" +
+		shortHash(hashParts...)
+	if _, ok := backendCombinationList[backendCombination]; !ok {
+		// We haven't seen this particular backend combination yet. Backup clusters only get traffic once all
+		// primary backends are down, so weights are computed separately for both
+		var backends []Backend
+		names := nameRegistry{}
+		for _, tier := range [][]string{primary, backup} {
+			serverWeights := h.computeServerWeights(tier, h.effectiveClusterWeights(host, tier, clusterWeights))
+			for _, cluster := range tier {
+				for _, backend := range sortedBackends(h.clusterState[cluster]) {
+					server := h.newBackend(names, cluster, backend)
+					server.Weight = serverWeights[cluster]
+					server.Backup = len(backup) > 0 && containsString(backup, cluster)
+					if passthrough {
+						server.Port = h.ingressTLSPort(cluster)
+					} else {
+						server.Proto = h.serverProto(cluster, protocol)
+					}
+					backends = append(backends, server)
+				}
+			}
+		}
+		// Drained clusters keep their existing connections until their grace period is over
+		for _, cluster := range drained {
+			if _, completed := h.drainState(cluster); completed {
+				continue
+			}
+			for _, backend := range sortedBackends(h.clusterState[cluster]) {
+				server := h.newBackend(names, cluster, backend)
+				server.Drain = true
+				if passthrough {
+					server.Port = h.ingressTLSPort(cluster)
+				} else {
+					server.Proto = h.serverProto(cluster, protocol)
 				}
+				backends = append(backends, server)
 			}
-			backendCombinationList[backendCombination] = backends
 		}
-		hostToBackendCombination[host] = backendCombination
+		if !passthrough {
+			var tcpFallback bool
+			settings.HealthCheckPath, settings.HealthCheckStatus, tcpFallback = h.backendHealthCheck(
+				backendCombination, clusters)
+			if tcpFallback {
+				// The health check port only answers HTTP checks, TCP checks go to the traffic port
+				for i := range backends {
+					backends[i].CheckPort = 0
+				}
+			}
+		}
+		// Server order mustn't depend on the order pods were discovered in
+		sort.Slice(backends, func(i, j int) bool { return backends[i].Name < backends[j].Name })
+		backendCombinationList[backendCombination] = backends
+		if settings != (BackendSettings{}) {
+			backendSettings[backendCombination] = settings
+		}
 	}
-	return hostToBackendCombination, backendCombinationList
+	return backendCombination
+}
+
+// Split the clusters of a host into active and drained ones. Draining is ignored if it would leave the host without
+// any cluster
+func (h *Handler) splitDrainedClusters(host string, clusters []string) ([]string, []string) {
+	var active, drained []string
+	for _, cluster := range clusters {
+		if isDrained, _ := h.drainState(cluster); isDrained {
+			drained = append(drained, cluster)
+		} else {
+			active = append(active, cluster)
+		}
+	}
+	if len(active) == 0 {
+		log.WithFields(log.Fields{
+			"host":     host,
+			"clusters": clusters,
+		}).Warning("All clusters of host are drained, ignoring drain state")
+		return clusters, nil
+	}
+	return active, drained
 }
 
 func (h *Handler) computeHostToClusterMap() map[string][]string {
@@ -191,27 +565,59 @@ func (h *Handler) computeHostToClusterMap() map[string][]string {
 	for _, cluster := range h.clusterState {
 		for _, ingress := range cluster.Ingresses {
 			for _, host := range ingress.Hosts {
-				hostToClusters[host] = append(hostToClusters[host], cluster.Name)
+				if !containsString(hostToClusters[host], cluster.Name) {
+					hostToClusters[host] = append(hostToClusters[host], cluster.Name)
+				}
 			}
 		}
 	}
 	return hostToClusters
 }
 
-func (h *Handler) writeConfigToHAProxy() {
+// Write the config and reload HAProxy if anything changed. Returns whether HAProxy was reloaded
+func (h *Handler) writeConfigToHAProxy() bool {
 	log.Debug("Writing config")
 
-	// TODO: Respect file mode setting
-	myConfigFile, err := os.OpenFile(h.config.HAProxyDropinPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	var rendered bytes.Buffer
+	err := h.template.Execute(&rendered, h.templateInfo)
 	if err != nil {
-		log.WithField("path", h.config.HAProxyDropinPath).WithError(err).Fatal(
-			"Couldn't open haproxy dropin path for writing")
+		log.WithError(err).Fatal("Couldn't template haproxy config")
+	}
+
+	if h.templateInfo.CrtListUsed {
+		crtListWritten, err := writeFileIfChanged(h.templateInfo.CrtListPath, renderCrtList(h.templateInfo), 0644)
+		if err != nil {
+			log.WithField("path", h.templateInfo.CrtListPath).WithError(err).Fatal("Couldn't write crt-list")
+		}
+		if crtListWritten {
+			// HAProxy only reads the crt-list on startup
+			h.certificatesChanged = true
+		}
 	}
 
-	err = h.template.Execute(myConfigFile, h.templateInfo)
+	// TODO: Respect file mode setting
+	written, err := writeFileIfChanged(h.config.HAProxyDropinPath, rendered.Bytes(), 0644)
 	if err != nil {
-		log.WithError(err).Fatal("Couldn't template haproxy config")
+		log.WithField("path", h.config.HAProxyDropinPath).WithError(err).Fatal(
+			"Couldn't write haproxy dropin")
+	}
+	if !written && !h.certificatesChanged {
+		log.Debug("Config unchanged, not reloading")
+		h.reloadRequired = false
+		return false
+	}
+	if !h.reloadRequired && !h.certificatesChanged && h.config.HAProxyRuntimeSocket != "" {
+		err = h.updateServerAddresses(h.appliedTemplateInfo)
+		if err == nil {
+			log.Info("Updated server addresses via runtime API")
+			h.appliedTemplateInfo = h.templateInfo
+			return false
+		}
+		log.WithError(err).Warning("Couldn't update server addresses via runtime API, reloading")
 	}
+	h.reloadRequired = false
+	h.certificatesChanged = false
+	h.appliedTemplateInfo = h.templateInfo
 
 	// TODO: Replace with systemd API
 	if h.debugFileEventChannel == nil {
@@ -221,12 +627,15 @@ func (h *Handler) writeConfigToHAProxy() {
 			log.WithError(err).Fatal("Couldn't reload haproxy")
 		}
 	}
+	return true
 }
 
 func (h *Handler) warnAboutMissingCerts(hostToBackend map[string]string, hostToCert map[string]string) {
 	for host := range hostToBackend {
 		if _, ok := hostToCert[host]; !ok {
 			log.WithField("host", host).Warning("Host skipped because it is not covered by any certificate!")
+			h.reportHostEvent(host, true, reasonNoCertificate,
+				"Host "+host+" is not covered by any certificate")
 		}
 	}
 }
@@ -3,14 +3,22 @@ package haproxy
 import (
 	"bytes"
 	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vsk8s/k8router/pkg/certificate"
+	"github.com/vsk8s/k8router/pkg/certificate/certificatetest"
 	"github.com/vsk8s/k8router/pkg/config"
 	"github.com/vsk8s/k8router/pkg/state"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"testing"
 	"text/template"
+	"time"
 )
 
 func findFile(name string) string {
@@ -41,29 +49,24 @@ func findFile(name string) string {
 
 func dummyClusterState() state.ClusterState {
 	ip := net.IPv4(127, 0, 0, 1)
-	return state.ClusterState{
-		Name: "default",
-		Backends: []state.K8RouterBackend{
-			{
-				Name: "foobar",
-				IP:   &ip,
-			},
+	clusterState := state.NewClusterState("default")
+	clusterState.AddBackend(state.K8RouterBackend{
+		Name: "foobar",
+		IP:   &ip,
+	})
+	clusterState.AddIngress(state.K8RouterIngress{
+		Name: "example-ingress",
+		Hosts: []string{
+			"test.example.org",
 		},
-		Ingresses: []state.K8RouterIngress{
-			{
-				Name: "example-ingress",
-				Hosts: []string{
-					"test.example.org",
-				},
-			},
-			{
-				Name: "example2-ingress",
-				Hosts: []string{
-					"foo.example.org",
-				},
-			},
+	})
+	clusterState.AddIngress(state.K8RouterIngress{
+		Name: "example2-ingress",
+		Hosts: []string{
+			"foo.example.org",
 		},
-	}
+	})
+	return clusterState
 }
 
 // Test templating of the configuration *only*
@@ -186,3 +189,739 @@ func TestConfigEventLoop(t *testing.T) {
 	g.Expect(err).To(gomega.BeNil(), "Unexpected error when inspecting generated file")
 	g.Expect(fileInfo.Size()).To(gomega.BeNumerically(">=", 100), "Generated file should be at least 100 bytes")
 }
+
+// Certificates without configured domains should use the SANs from the certificate file
+func TestCertificateDomainsFromFile(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-handler")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(24 * time.Hour)
+	cert := config.CertificateInternal{
+		Name: "derived",
+		Cert: certificatetest.Write(t, dir, "derived.pem", notAfter, "test.example.org"),
+	}
+	cert2 := config.CertificateInternal{
+		Name:    "mismatch",
+		Domains: []string{"foo.example.org", "bar.example.org"},
+		Cert:    certificatetest.Write(t, dir, "mismatch.pem", notAfter, "foo.example.org"),
+	}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": dummyClusterState()},
+		certificates: map[string]*certificate.Bundle{},
+		config: config.Config{
+			Certificates: []config.Certificate{
+				{CertificateInternal: &cert},
+				{CertificateInternal: &cert2},
+			},
+			CertificateDomainMismatch: config.DomainMismatchRefuse,
+		},
+	}
+	g.Expect(uut.refreshCertificates()).To(gomega.BeTrue())
+	g.Expect(uut.refreshCertificates()).To(gomega.BeFalse(), "Nothing changed on disk")
+	g.Expect(uut.certificateDomains(uut.config.Certificates[1])).To(gomega.Equal([]string{"foo.example.org"}))
+
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.SniList["derived"].Domains).To(gomega.Equal([]string{"test.example.org"}))
+	g.Expect(uut.templateInfo.SniList["mismatch"].Domains).To(gomega.Equal([]string{"foo.example.org"}))
+
+	// Replacing the certificate on disk has to update the domains
+	later := time.Now().Add(time.Minute)
+	certificatetest.Write(t, dir, "derived.pem", notAfter, "test.example.org", "foo.example.org")
+	g.Expect(os.Chtimes(cert.Cert, later, later)).To(gomega.BeNil())
+	g.Expect(uut.refreshCertificates()).To(gomega.BeTrue())
+	g.Expect(uut.certificateDomains(uut.config.Certificates[0])).To(gomega.Equal([]string{"foo.example.org", "test.example.org"}))
+}
+
+// Certificates synced from TLS secrets should be written to disk and used next to the configured ones
+func TestManagedCertificates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-managed")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	cert, key := certificatetest.Generate(t, time.Now().Add(time.Hour), "test.example.org")
+	clusterState := dummyClusterState()
+	clusterState.AddCertificate(state.K8RouterCertificate{
+		Name:  "app/app-tls",
+		Hosts: []string{"test.example.org", "foo.example.org"},
+		PEM:   append(cert, key...),
+	})
+	cluster := config.ClusterInternal{
+		Name:           "default",
+		SyncTLSSecrets: true,
+	}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": clusterState},
+		certificates: map[string]*certificate.Bundle{},
+		config: config.Config{
+			Clusters:                    []config.Cluster{{ClusterInternal: &cluster}},
+			ManagedCertificateDirectory: dir,
+		},
+	}
+	// Stale certificates have to be removed
+	stale := path.Join(dir, "secret-default-app-old.pem")
+	g.Expect(ioutil.WriteFile(stale, []byte("foo"), 0600)).To(gomega.BeNil())
+
+	uut.syncManagedCertificates()
+	uut.regenerateTemplateInfo()
+
+	name := "secret-default-app_app-tls-" + shortHash("default", "app/app-tls")
+	file := path.Join(dir, name+".pem")
+	info, err := os.Stat(file)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(info.Mode().Perm()).To(gomega.Equal(os.FileMode(0600)))
+	_, err = os.Stat(stale)
+	g.Expect(os.IsNotExist(err)).To(gomega.BeTrue())
+
+	// foo.example.org isn't covered by the certificate
+	detail := uut.templateInfo.SniList[name]
+	g.Expect(detail.Path).To(gomega.Equal(file))
+	g.Expect(detail.Domains).To(gomega.Equal([]string{"test.example.org"}))
+}
+
+// Secrets whose cluster, namespace and name only differ by the separators need distinct files
+func TestManagedCertificateNameCollisions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-managed")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	clusterStates := map[string]state.ClusterState{}
+	clusters := []config.Cluster{}
+	secrets := map[string][]string{
+		"x":   {"a-b/c", "a/b-c", "y-z/tls"},
+		"x-y": {"z/tls"},
+	}
+	for clusterName, names := range secrets {
+		clusterState := dummyClusterState()
+		for _, name := range names {
+			cert, key := certificatetest.Generate(t, time.Now().Add(time.Hour), name+".example.org")
+			clusterState.AddCertificate(state.K8RouterCertificate{
+				Name: name,
+				PEM:  append(cert, key...),
+			})
+		}
+		clusterStates[clusterName] = clusterState
+		clusters = append(clusters, config.Cluster{ClusterInternal: &config.ClusterInternal{
+			Name:           clusterName,
+			SyncTLSSecrets: true,
+		}})
+	}
+	uut := Handler{
+		clusterState: clusterStates,
+		certificates: map[string]*certificate.Bundle{},
+		config: config.Config{
+			Clusters:                    clusters,
+			ManagedCertificateDirectory: dir,
+		},
+	}
+	uut.syncManagedCertificates()
+
+	g.Expect(uut.managedCertificates).To(gomega.HaveLen(4))
+	files, err := ioutil.ReadDir(dir)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(files).To(gomega.HaveLen(4))
+}
+
+// Fake certificate issuer
+type fakeIssuer struct {
+	hosts        []string
+	certificates map[string]string
+}
+
+func (f *fakeIssuer) SetHosts(hosts []string) {
+	f.hosts = hosts
+}
+
+func (f *fakeIssuer) Certificates() map[string]string {
+	return f.certificates
+}
+
+func (f *fakeIssuer) Updates() <-chan bool {
+	return nil
+}
+
+func (f *fakeIssuer) ChallengeAddress() string {
+	return "127.0.0.1:8402"
+}
+
+// Hosts without a certificate should be passed to the issuer and use the issued certificates
+func TestCertificateIssuer(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cert := config.CertificateInternal{
+		Name:    "dummycert",
+		Domains: []string{"test.example.org"},
+		Cert:    "/etc/ssl/dummy.pem",
+	}
+	issuer := &fakeIssuer{
+		certificates: map[string]string{"foo.example.org": "/var/lib/k8router/acme/certs/foo.example.org.pem"},
+	}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": dummyClusterState()},
+		config: config.Config{
+			Certificates: []config.Certificate{{CertificateInternal: &cert}},
+		},
+	}
+	uut.SetCertificateIssuer(issuer)
+	uut.regenerateTemplateInfo()
+
+	g.Expect(issuer.hosts).To(gomega.Equal([]string{"foo.example.org"}))
+	g.Expect(uut.templateInfo.SniList["acme-foo.example.org"].Domains).To(gomega.Equal([]string{"foo.example.org"}))
+	g.Expect(uut.templateInfo.SniList["acme-foo.example.org"].Path).To(gomega.Equal(issuer.certificates["foo.example.org"]))
+
+	var err error
+	uut.template, err = template.New("template").ParseFiles(findFile("template"))
+	g.Expect(err).To(gomega.BeNil())
+	buf := bytes.NewBufferString("")
+	g.Expect(uut.template.Execute(buf, uut.templateInfo)).To(gomega.BeNil())
+	g.Expect(buf.String()).To(gomega.ContainSubstring("use_backend acme-challenge if acl-acme-challenge"))
+	g.Expect(buf.String()).To(gomega.ContainSubstring("server   acme-responder 127.0.0.1:8402"))
+}
+
+// Wildcard hosts can't be validated via HTTP-01, so they mustn't be passed to the issuer
+func TestCertificateIssuerSkipsWildcards(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	clusterState := dummyClusterState()
+	clusterState.Ingresses = map[string]state.K8RouterIngress{}
+	clusterState.AddIngress(state.K8RouterIngress{
+		Name:  "wildcard",
+		Hosts: []string{"*.apps.example.org", "foo.example.org"},
+	})
+	issuer := &fakeIssuer{}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": clusterState},
+	}
+	uut.SetCertificateIssuer(issuer)
+	uut.regenerateTemplateInfo()
+	g.Expect(issuer.hosts).To(gomega.Equal([]string{"foo.example.org"}))
+	g.Expect(uut.wildcardHostsWarned).To(gomega.Equal(map[string]bool{"*.apps.example.org": true}))
+}
+
+// Certificate selection has to prefer exact matches and respect wildcard semantics
+func TestCertificateSelection(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	clusterState := dummyClusterState()
+	clusterState.Ingresses = map[string]state.K8RouterIngress{}
+	clusterState.AddIngress(state.K8RouterIngress{
+		Name:  "example-ingress",
+		Hosts: []string{"a.example.org", "b.example.org", "x.a.example.org", "fooexample.org", "example.org"},
+	})
+	certs := []config.CertificateInternal{
+		{Name: "wildcard", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/wildcard.pem"},
+		{Name: "exact", Domains: []string{"b.example.org"}, Cert: "/etc/ssl/exact.pem"},
+		{Name: "exact-conflict", Domains: []string{"b.example.org", "example.org"}, Cert: "/etc/ssl/conflict.pem"},
+		{Name: "wildcard-conflict", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/wildcard2.pem"},
+		{Name: "toplevel", Domains: []string{"*.org"}, Cert: "/etc/ssl/toplevel.pem"},
+	}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": clusterState},
+	}
+	for i := range certs {
+		uut.config.Certificates = append(uut.config.Certificates, config.Certificate{CertificateInternal: &certs[i]})
+	}
+
+	hostToBackend := map[string]string{}
+	for _, host := range clusterState.Ingresses["example-ingress"].Hosts {
+		hostToBackend[host] = "default"
+	}
+	hostToCert, sniList, defaultCert := uut.computeCertsForHosts(hostToBackend)
+	g.Expect(hostToCert).To(gomega.Equal(map[string]string{
+		"a.example.org":  "wildcard",
+		"b.example.org":  "exact",
+		"example.org":    "exact-conflict",
+		"fooexample.org": "toplevel",
+	}))
+	g.Expect(sniList["wildcard"].Domains).To(gomega.Equal([]string{"a.example.org"}))
+	g.Expect(sniList["exact-conflict"].Domains).To(gomega.Equal([]string{"example.org"}))
+	g.Expect(sniList["wildcard-conflict"].Domains).To(gomega.BeEmpty())
+	// Without explicit default, the first wildcard certificate is used
+	g.Expect(defaultCert).To(gomega.Equal("wildcard"))
+
+	certs[4].Default = true
+	_, _, defaultCert = uut.computeCertsForHosts(hostToBackend)
+	g.Expect(defaultCert).To(gomega.Equal("toplevel"))
+}
+
+// Expiring certificates have to show up in the metrics and expired ones may be replaced by wildcards
+func TestCertificateExpiry(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-expiry")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	expired := config.CertificateInternal{
+		Name: "expired",
+		Cert: certificatetest.Write(t, dir, "expired.pem", time.Now().Add(-time.Hour), "test.example.org"),
+	}
+	expiring := config.CertificateInternal{
+		Name: "expiring",
+		Cert: certificatetest.Write(t, dir, "expiring.pem", time.Now().Add(5*24*time.Hour+time.Hour), "*.example.org"),
+	}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": dummyClusterState()},
+		certificates: map[string]*certificate.Bundle{},
+		config: config.Config{
+			Certificates: []config.Certificate{
+				{CertificateInternal: &expired},
+				{CertificateInternal: &expiring},
+			},
+			CertificateExpiry: config.CertificateExpiry{
+				WarningDays: []int{30, 7},
+			},
+		},
+	}
+	uut.refreshCertificates()
+	g.Expect(uut.checkCertificateExpiry()).To(gomega.BeTrue())
+	g.Expect(uut.checkCertificateExpiry()).To(gomega.BeFalse())
+	g.Expect(uut.expiryWarnings).To(gomega.Equal(map[string]int{"expiring": 7}))
+	g.Expect(testutil.ToFloat64(certificateExpiryDays.WithLabelValues("expiring", "*.example.org"))).To(
+		gomega.BeNumerically("~", 5, 0.1))
+	g.Expect(testutil.ToFloat64(certificateExpiryDays.WithLabelValues("expired", "test.example.org"))).To(
+		gomega.BeNumerically("<", 0))
+
+	// By default the exact (but expired) certificate still wins
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.SniList["expired"].Domains).To(gomega.Equal([]string{"test.example.org"}))
+
+	uut.config.CertificateExpiry.ReplaceExpired = true
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.SniList["expired"].Domains).To(gomega.BeEmpty())
+	g.Expect(uut.templateInfo.SniList["expiring"].Domains).To(gomega.Equal([]string{"foo.example.org", "test.example.org"}))
+}
+
+// Issued certificates have to be checked as well, and leaves sharing a SAN must report the earliest expiry
+func TestIssuedCertificateExpiry(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-expiry")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	chainDir := path.Join(dir, "chains")
+	g.Expect(os.Mkdir(chainDir, 0700)).To(gomega.BeNil())
+	certificatetest.Write(t, chainDir, "a.pem", time.Now().Add(3*24*time.Hour+time.Hour), "shared.example.org")
+	certificatetest.Write(t, chainDir, "b.pem", time.Now().Add(60*24*time.Hour), "shared.example.org")
+	chains := config.CertificateInternal{
+		Name: "chains",
+		Cert: chainDir,
+	}
+	issuer := &fakeIssuer{certificates: map[string]string{
+		"test.example.org": certificatetest.Write(t, dir, "issued.pem", time.Now().Add(-time.Hour), "test.example.org"),
+	}}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": dummyClusterState()},
+		certificates: map[string]*certificate.Bundle{},
+		issuer:       issuer,
+		config: config.Config{
+			Certificates: []config.Certificate{{CertificateInternal: &chains}},
+		},
+	}
+	uut.refreshCertificates()
+	g.Expect(uut.checkCertificateExpiry()).To(gomega.BeTrue())
+	g.Expect(uut.expiredCertificates).To(gomega.Equal(map[string]bool{"acme-test.example.org": true}))
+	g.Expect(testutil.ToFloat64(certificateExpiryDays.WithLabelValues("acme-test.example.org", "test.example.org"))).To(
+		gomega.BeNumerically("<", 0))
+	g.Expect(testutil.ToFloat64(certificateExpiryDays.WithLabelValues("chains", "shared.example.org"))).To(
+		gomega.BeNumerically("~", 3, 0.1))
+}
+
+// Build a cluster state with the given number of backends which exposes the given hosts
+func clusterStateWithBackends(name string, backends int, hosts ...string) state.ClusterState {
+	clusterState := state.NewClusterState(name)
+	clusterState.AddIngress(state.K8RouterIngress{
+		Name:  name + "-ingress",
+		Hosts: hosts,
+	})
+	for i := 0; i < backends; i++ {
+		ip := net.IPv4(10, 0, byte(len(name)), byte(i))
+		clusterState.AddBackend(state.K8RouterBackend{
+			Name: name + "-" + strconv.Itoa(i),
+			IP:   &ip,
+		})
+	}
+	return clusterState
+}
+
+func intPointer(value int) *int {
+	return &value
+}
+
+// Traffic should be split according to the cluster weights, not the number of backends
+func TestWeightedBackends(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	oldCluster := config.ClusterInternal{Name: "old", Weight: intPointer(90)}
+	newCluster := config.ClusterInternal{Name: "new", Weight: intPointer(10)}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{
+			"old": clusterStateWithBackends("old", 10, "test.example.org", "foo.example.org"),
+			"new": clusterStateWithBackends("new", 1, "test.example.org", "foo.example.org"),
+		},
+		config: config.Config{
+			Clusters: []config.Cluster{{ClusterInternal: &oldCluster}, {ClusterInternal: &newCluster}},
+		},
+	}
+	// Override the weight for a single host
+	weight := 50
+	newState := uut.clusterState["new"]
+	newState.AddIngress(state.K8RouterIngress{
+		Name:   "new-canary",
+		Hosts:  []string{"foo.example.org"},
+		Weight: &weight,
+	})
+	uut.clusterState["new"] = newState
+
+	hostToBackend, _, backendCombinationList, _ := uut.computeBackends(uut.computeHostToClusterMap(), nil, nil)
+	g.Expect(hostToBackend["test.example.org"]).To(gomega.HavePrefix("new-old_w10-90-"))
+	g.Expect(hostToBackend["foo.example.org"]).To(gomega.HavePrefix("new-old_w50-90-"))
+
+	sumWeights := func(backends []Backend, prefix string) int {
+		sum := 0
+		for _, backend := range backends {
+			if strings.HasPrefix(backend.Name, prefix) {
+				sum += backend.Weight
+			}
+		}
+		return sum
+	}
+	backends := backendCombinationList[hostToBackend["test.example.org"]]
+	g.Expect(backends).To(gomega.HaveLen(11))
+	g.Expect(float64(sumWeights(backends, "old-")) / float64(sumWeights(backends, "new-"))).To(gomega.BeNumerically("~", 9, 0.1))
+	for _, backend := range backends {
+		g.Expect(backend.Weight).To(gomega.BeNumerically("<=", maxServerWeight))
+	}
+	backends = backendCombinationList[hostToBackend["foo.example.org"]]
+	g.Expect(float64(sumWeights(backends, "old-")) / float64(sumWeights(backends, "new-"))).To(gomega.BeNumerically("~", 1.8, 0.1))
+
+	// Clusters with weight 0 don't get any traffic
+	newCluster.Weight = intPointer(0)
+	hostToBackend, _, backendCombinationList, _ = uut.computeBackends(uut.computeHostToClusterMap(), nil, nil)
+	backends = backendCombinationList[hostToBackend["test.example.org"]]
+	g.Expect(sumWeights(backends, "new-")).To(gomega.BeZero())
+	g.Expect(sumWeights(backends, "old-")).To(gomega.BeNumerically(">", 0))
+
+	// If all clusters have weight 0, the host would be down, so they are treated equally instead
+	oldCluster.Weight = intPointer(0)
+	events := make(chan state.IngressEvent, 10)
+	uut.ingressEvents = events
+	hostToBackend, _, backendCombinationList, _ = uut.computeBackends(uut.computeHostToClusterMap(), nil, nil)
+	backends = backendCombinationList[hostToBackend["test.example.org"]]
+	g.Expect(float64(sumWeights(backends, "old-")) / float64(sumWeights(backends, "new-"))).To(gomega.BeNumerically("~", 1, 0.1))
+	received := receiveEvents(events)
+	g.Expect(received).To(gomega.HaveLen(2))
+	for _, event := range received {
+		g.Expect(event.Warning).To(gomega.BeTrue())
+		g.Expect(event.Reason).To(gomega.Equal(reasonZeroWeights))
+	}
+}
+
+// Lower priority clusters should only be used as backup
+func TestBackupClusters(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	primaryCluster := config.ClusterInternal{Name: "primary", Weight: intPointer(100), Priority: 10}
+	drCluster := config.ClusterInternal{Name: "dr", Weight: intPointer(100)}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{
+			"primary": clusterStateWithBackends("primary", 2, "test.example.org", "foo.example.org"),
+			"dr":      clusterStateWithBackends("dr", 3, "test.example.org", "foo.example.org"),
+		},
+		config: config.Config{
+			Clusters: []config.Cluster{{ClusterInternal: &primaryCluster}, {ClusterInternal: &drCluster}},
+		},
+	}
+	// Make both clusters primary for a single host
+	priority := 10
+	drState := uut.clusterState["dr"]
+	drState.AddIngress(state.K8RouterIngress{
+		Name:     "dr-active",
+		Hosts:    []string{"foo.example.org"},
+		Priority: &priority,
+	})
+	uut.clusterState["dr"] = drState
+
+	hostToBackend, _, backendCombinationList, _ := uut.computeBackends(uut.computeHostToClusterMap(), nil, nil)
+	g.Expect(hostToBackend["test.example.org"]).To(gomega.HavePrefix("dr-primary_bdr-"))
+	g.Expect(hostToBackend["foo.example.org"]).To(gomega.HavePrefix("dr-primary-"))
+	for _, backend := range backendCombinationList[hostToBackend["test.example.org"]] {
+		g.Expect(backend.Backup).To(gomega.Equal(strings.HasPrefix(backend.Name, "dr-")))
+		g.Expect(backend.Weight).To(gomega.Equal(maxServerWeight))
+	}
+	for _, backend := range backendCombinationList[hostToBackend["foo.example.org"]] {
+		g.Expect(backend.Backup).To(gomega.BeFalse())
+	}
+}
+
+// Draining a cluster via the admin API should move its backends to drain state and survive restarts
+func TestDrainCluster(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-drain")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	blueCluster := config.ClusterInternal{Name: "blue", Weight: intPointer(100)}
+	greenCluster := config.ClusterInternal{Name: "green", Weight: intPointer(100)}
+	newUUT := func() *Handler {
+		return &Handler{
+			clusterState: map[string]state.ClusterState{
+				"blue":  clusterStateWithBackends("blue", 1, "test.example.org"),
+				"green": clusterStateWithBackends("green", 2, "test.example.org", "green.example.org"),
+			},
+			drainCompleted: map[string]bool{},
+			config: config.Config{
+				Clusters:       []config.Cluster{{ClusterInternal: &blueCluster}, {ClusterInternal: &greenCluster}},
+				DrainDirectory: dir,
+			},
+		}
+	}
+	uut := newUUT()
+	api := uut.DrainAPI()
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/clusters/green/drain", nil))
+	g.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(recorder.Body.String()).To(gomega.ContainSubstring(`"drained":true`))
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/clusters/unknown/drain", nil))
+	g.Expect(recorder.Code).To(gomega.Equal(http.StatusNotFound))
+
+	// A restarted handler has to pick up the drain state as well
+	for _, handler := range []*Handler{uut, newUUT()} {
+		g.Expect(handler.refreshDrainState()).To(gomega.BeTrue())
+		g.Expect(handler.refreshDrainState()).To(gomega.BeFalse())
+		hostToBackend, _, backendCombinationList, _ := handler.computeBackends(handler.computeHostToClusterMap(), nil, nil)
+		g.Expect(hostToBackend["test.example.org"]).To(gomega.HavePrefix("blue-green_dgreen-"))
+		for _, backend := range backendCombinationList[hostToBackend["test.example.org"]] {
+			isGreen := strings.HasPrefix(backend.Name, "green-")
+			g.Expect(backend.Drain).To(gomega.Equal(isGreen))
+			if isGreen {
+				g.Expect(backend.Weight).To(gomega.Equal(0))
+			} else {
+				g.Expect(backend.Weight).To(gomega.Equal(maxServerWeight))
+			}
+		}
+		handler.regenerateTemplateInfo()
+		rendered := renderedSection(renderTemplate(g, handler), "backend backend-"+hostToBackend["test.example.org"])
+		g.Expect(rendered).To(gomega.ContainSubstring("server   server-green-green-0 10.0.5.0:80 weight 0 check"))
+		// Hosts only available in a drained cluster stay routed there
+		g.Expect(hostToBackend["green.example.org"]).To(gomega.HavePrefix("green-"))
+		g.Expect(backendCombinationList[hostToBackend["green.example.org"]]).To(gomega.HaveLen(2))
+	}
+
+	// Drained backends are removed after the grace period
+	uut.config.DrainGracePeriod = time.Nanosecond
+	g.Expect(uut.refreshDrainState()).To(gomega.BeTrue())
+	hostToBackend, _, backendCombinationList, _ := uut.computeBackends(uut.computeHostToClusterMap(), nil, nil)
+	g.Expect(backendCombinationList[hostToBackend["test.example.org"]]).To(gomega.HaveLen(1))
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/clusters/green/drain", nil))
+	g.Expect(recorder.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(uut.refreshDrainState()).To(gomega.BeTrue())
+	hostToBackend, _, _, _ = uut.computeBackends(uut.computeHostToClusterMap(), nil, nil)
+	g.Expect(hostToBackend["test.example.org"]).To(gomega.HavePrefix("blue-green-"))
+}
+
+// Per-host options have to be resolved across clusters and end up in the right places of the config
+func TestHostOptions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cert := config.CertificateInternal{
+		Name:    "dummycert",
+		Domains: []string{"*.example.org"},
+		Cert:    "/etc/ssl/dummy.pem",
+	}
+	a := clusterStateWithBackends("a", 1, "app.example.org", "plain.example.org")
+	a.AddIngress(state.K8RouterIngress{
+		Name:  "a-ingress",
+		Hosts: []string{"app.example.org"},
+		Options: state.K8RouterIngressOptions{
+			ForceHTTPS:          true,
+			AllowedSourceRanges: []string{"10.0.0.0/8"},
+			HSTSMaxAge:          time.Hour,
+			ResponseTimeout:     time.Minute,
+			BasicAuthUserlist:   "admins",
+			BasicAuthRealm:      "k8router",
+		},
+	})
+	a.AddIngress(state.K8RouterIngress{Name: "plain", Hosts: []string{"plain.example.org"}})
+	b := clusterStateWithBackends("b", 1, "app.example.org")
+	b.AddIngress(state.K8RouterIngress{
+		Name:    "b-ingress",
+		Hosts:   []string{"app.example.org"},
+		Options: state.K8RouterIngressOptions{MaxBodySize: 1024},
+	})
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"a": a, "b": b},
+		config: config.Config{
+			Certificates: []config.Certificate{{CertificateInternal: &cert}},
+		},
+	}
+	uut.regenerateTemplateInfo()
+
+	// Cluster a comes first, so its options win
+	g.Expect(uut.templateInfo.HostOptions).To(gomega.Equal(map[string]HostOptions{
+		"app.example.org": {
+			AllowedSourceRanges: []string{"10.0.0.0/8"},
+			HSTSHeader:          "max-age=3600",
+			BasicAuthUserlist:   "admins",
+			BasicAuthRealm:      "k8router",
+		},
+	}))
+	g.Expect(uut.templateInfo.RedirectHosts).To(gomega.Equal(map[string]bool{"app.example.org": true}))
+	appBackend := uut.templateInfo.HostToBackend["app.example.org"]
+	g.Expect(appBackend).NotTo(gomega.Equal(uut.templateInfo.HostToBackend["plain.example.org"]))
+	g.Expect(uut.templateInfo.BackendSettings).To(gomega.Equal(map[string]BackendSettings{
+		appBackend: {ResponseTimeout: "60000ms"},
+	}))
+
+	rendered := renderTemplate(g, &uut)
+	g.Expect(rendered).To(gomega.ContainSubstring(
+		"http-request redirect scheme https code 301 if acl-http-app.example.org\n"))
+	g.Expect(rendered).To(gomega.ContainSubstring(
+		"http-request deny if acl-https-app.example.org !{ src 10.0.0.0/8 }\n"))
+	g.Expect(rendered).To(gomega.ContainSubstring(
+		"http-request auth realm \"k8router\" if acl-https-app.example.org !{ http_auth(admins) }\n"))
+	g.Expect(rendered).To(gomega.ContainSubstring(
+		"http-response set-header Strict-Transport-Security \"max-age=3600\" if { var(txn.host) -m str app.example.org }\n"))
+	g.Expect(rendered).To(gomega.ContainSubstring("timeout  server 60000ms\n"))
+	g.Expect(rendered).NotTo(gomega.ContainSubstring("plain.example.org !{"))
+	g.Expect(rendered).NotTo(gomega.ContainSubstring("deny_status 413"))
+}
+
+// Render the HAProxy config for the current template info
+func renderTemplate(g *gomega.WithT, uut *Handler) string {
+	var err error
+	uut.template, err = template.New("template").ParseFiles(findFile("template"))
+	g.Expect(err).To(gomega.BeNil())
+	buf := bytes.NewBufferString("")
+	g.Expect(uut.template.Execute(buf, uut.templateInfo)).To(gomega.BeNil())
+	return buf.String()
+}
+
+// Extract a frontend or backend section from a rendered config
+func renderedSection(rendered string, header string) string {
+	start := strings.Index(rendered, header+"\n")
+	if start < 0 {
+		return ""
+	}
+	section := rendered[start+len(header)+1:]
+	end := strings.Index(section, "\nfrontend ")
+	if backend := strings.Index(section, "\nbackend "); backend >= 0 && (end < 0 || backend < end) {
+		end = backend
+	}
+	if end >= 0 {
+		section = section[:end]
+	}
+	return section
+}
+
+// The global redirect policy can be overridden per certificate, ACME challenges are never redirected
+func TestHTTPSRedirect(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	noRedirect := false
+	hstsMaxAge := 24 * time.Hour
+	cert := config.CertificateInternal{
+		Name:       "dummycert",
+		Domains:    []string{"test.example.org"},
+		Cert:       "/etc/ssl/dummy.pem",
+		HSTSMaxAge: &hstsMaxAge,
+	}
+	cert2 := config.CertificateInternal{
+		Name:            "dummycert2",
+		Domains:         []string{"foo.example.org"},
+		Cert:            "/etc/ssl/dummy.pem",
+		RedirectToHTTPS: &noRedirect,
+	}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"default": dummyClusterState()},
+		config: config.Config{
+			Certificates:    []config.Certificate{{CertificateInternal: &cert}, {CertificateInternal: &cert2}},
+			RedirectToHTTPS: true,
+			HSTSMaxAge:      time.Hour,
+		},
+	}
+	uut.SetCertificateIssuer(&fakeIssuer{})
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.RedirectHosts).To(gomega.Equal(map[string]bool{"test.example.org": true}))
+	g.Expect(uut.templateInfo.HostOptions).To(gomega.Equal(map[string]HostOptions{
+		"test.example.org": {HSTSHeader: "max-age=86400"},
+		"foo.example.org":  {HSTSHeader: "max-age=3600"},
+	}))
+
+	http := renderedSection(renderTemplate(g, &uut), "frontend HTTP")
+	g.Expect(http).To(gomega.ContainSubstring(
+		"http-request redirect scheme https code 301 if acl-http-test.example.org\n"))
+	g.Expect(strings.Count(http, "http-request redirect")).To(gomega.Equal(1))
+	// HAProxy stops evaluating http-request rules after 'allow', so this has to come first
+	g.Expect(strings.Index(http, "http-request allow if acl-acme-challenge")).To(
+		gomega.BeNumerically("<", strings.Index(http, "http-request redirect")))
+	g.Expect(http).NotTo(gomega.ContainSubstring("Strict-Transport-Security"))
+
+	https := renderedSection(renderTemplate(g, &uut), "frontend wrap-frontend-dummycert")
+	g.Expect(https).NotTo(gomega.ContainSubstring("http-request redirect"))
+	g.Expect(https).To(gomega.ContainSubstring(
+		"http-response set-header Strict-Transport-Security \"max-age=86400\" if { var(txn.host) -m str test.example.org }"))
+
+	// Without any policy plain HTTP is proxied as before
+	uut.config.RedirectToHTTPS = false
+	uut.config.HSTSMaxAge = 0
+	cert.HSTSMaxAge = nil
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.RedirectHosts).To(gomega.BeEmpty())
+	rendered := renderTemplate(g, &uut)
+	g.Expect(rendered).NotTo(gomega.ContainSubstring("http-request redirect"))
+	g.Expect(rendered).NotTo(gomega.ContainSubstring("Strict-Transport-Security"))
+	g.Expect(renderedSection(rendered, "frontend HTTP")).To(gomega.ContainSubstring(
+		"use_backend backend-" + uut.templateInfo.HostToBackend["test.example.org"] + " if acl-http-test.example.org"))
+}
+
+// Health check settings have to end up in the backends, mixed HTTP checks fall back to TCP checks
+func TestHealthChecks(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	nginxCluster := config.ClusterInternal{
+		Name:        "nginx",
+		Weight:      intPointer(100),
+		IngressPort: 8080,
+		HealthCheck: config.HealthCheck{
+			Path:         "/healthz",
+			Port:         10254,
+			ExpectStatus: 200,
+			Interval:     2 * time.Second,
+			Rise:         2,
+			Fall:         3,
+			SlowStart:    30 * time.Second,
+		},
+	}
+	plainCluster := config.ClusterInternal{Name: "plain", Weight: intPointer(100)}
+	cert := config.CertificateInternal{
+		Name:    "dummycert",
+		Domains: []string{"*.example.org"},
+		Cert:    "/etc/ssl/dummy.pem",
+	}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{
+			"nginx": clusterStateWithBackends("nginx", 1, "test.example.org", "foo.example.org"),
+			"plain": clusterStateWithBackends("plain", 1, "foo.example.org"),
+		},
+		config: config.Config{
+			Clusters:     []config.Cluster{{ClusterInternal: &nginxCluster}, {ClusterInternal: &plainCluster}},
+			Certificates: []config.Certificate{{CertificateInternal: &cert}},
+		},
+	}
+	uut.regenerateTemplateInfo()
+	nginxBackend := uut.templateInfo.HostToBackend["test.example.org"]
+	g.Expect(uut.templateInfo.BackendSettings).To(gomega.Equal(map[string]BackendSettings{
+		nginxBackend: {HealthCheckPath: "/healthz", HealthCheckStatus: 200},
+	}))
+
+	rendered := renderTemplate(g, &uut)
+	nginx := renderedSection(rendered, "backend backend-"+nginxBackend)
+	g.Expect(nginx).To(gomega.ContainSubstring("option   httpchk GET /healthz\n"))
+	g.Expect(nginx).To(gomega.ContainSubstring("http-check expect status 200\n"))
+	g.Expect(nginx).To(gomega.ContainSubstring(
+		"server   server-nginx-nginx-0 10.0.5.0:8080 weight 256 check port 10254 inter 2000ms rise 2 fall 3 slowstart 30000ms"))
+	mixed := renderedSection(rendered, "backend backend-"+uut.templateInfo.HostToBackend["foo.example.org"])
+	g.Expect(mixed).NotTo(gomega.ContainSubstring("httpchk"))
+	g.Expect(mixed).To(gomega.ContainSubstring("server   server-plain-plain-0 10.0.5.0:80 weight 256 check\n"))
+	// TCP checks go to the traffic port
+	g.Expect(mixed).To(gomega.ContainSubstring(
+		"server   server-nginx-nginx-0 10.0.5.0:8080 weight 256 check inter 2000ms rise 2 fall 3 slowstart 30000ms"))
+}
@@ -0,0 +1,51 @@
+package haproxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/state"
+)
+
+// Port ingress pods listen on if their cluster doesn't configure one
+const defaultIngressPort = 80
+
+// Create the HAProxy server for an ingress pod of a cluster, including the cluster's health check settings. Server
+// names are unique within the given registry
+func (h *Handler) newBackend(names nameRegistry, cluster string, backend state.K8RouterBackend) Backend {
+	clusterConfig := h.clusterConfig(cluster)
+	port := clusterConfig.IngressPort
+	if port == 0 {
+		port = defaultIngressPort
+	}
+	check := clusterConfig.HealthCheck
+	return Backend{
+		IP: backend.IP,
+		// Pods of different clusters may have the same name
+		Name:          names.name(cluster, backend.Name),
+		Port:          port,
+		CheckPort:     check.Port,
+		CheckInterval: formatTimeout(check.Interval),
+		CheckRise:     check.Rise,
+		CheckFall:     check.Fall,
+		SlowStart:     formatTimeout(check.SlowStart),
+	}
+}
+
+// Figure out the HTTP health check of a backend combination. HAProxy only supports one per backend, so all clusters
+// have to agree on it. Otherwise we fall back to TCP checks of the traffic port, which is reported as well
+func (h *Handler) backendHealthCheck(backendCombination string, clusters []string) (string, int, bool) {
+	first := h.clusterConfig(clusters[0]).HealthCheck
+	for _, cluster := range clusters[1:] {
+		check := h.clusterConfig(cluster).HealthCheck
+		if check.Path != first.Path || check.ExpectStatus != first.ExpectStatus {
+			log.WithFields(log.Fields{
+				"backend":  backendCombination,
+				"clusters": clusters,
+			}).Warning("Clusters of backend have different HTTP health checks, falling back to TCP checks")
+			return "", 0, true
+		}
+	}
+	if first.Path == "" {
+		return "", 0, false
+	}
+	return first.Path, first.ExpectStatus, false
+}
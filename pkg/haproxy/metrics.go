@@ -0,0 +1,45 @@
+package haproxy
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	certificateExpiryDays = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "k8router",
+		Name:      "certificate_expiry_days",
+		Help:      "Days until a configured certificate expires, per certificate and SAN",
+	}, []string{"certificate", "san"})
+	clusterDrained = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "k8router",
+		Name:      "cluster_drained",
+		Help:      "Whether a cluster is drained (1) or not (0)",
+	}, []string{"cluster"})
+	hostPolicyViolations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "k8router",
+		Name:      "host_policy_violations",
+		Help:      "Hosts which are dropped because their ingress may not claim them",
+	}, []string{"cluster", "namespace", "ingress", "host"})
+	haproxyReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "k8router",
+		Name:      "haproxy_reloads_total",
+		Help:      "Number of HAProxy reloads",
+	})
+	changesCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "k8router",
+		Name:      "haproxy_changes_coalesced_total",
+		Help:      "Number of changes which were applied together with a later change instead of on their own",
+	})
+	urgentUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "k8router",
+		Name:      "haproxy_urgent_updates_total",
+		Help:      "Number of config updates which bypassed the reload limits because hosts lost all backends",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(certificateExpiryDays)
+	prometheus.MustRegister(clusterDrained)
+	prometheus.MustRegister(hostPolicyViolations)
+	prometheus.MustRegister(haproxyReloads)
+	prometheus.MustRegister(changesCoalesced)
+	prometheus.MustRegister(urgentUpdates)
+}
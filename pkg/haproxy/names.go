@@ -0,0 +1,65 @@
+package haproxy
+
+import (
+	"fmt"
+	"github.com/vsk8s/k8router/pkg/state"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Characters HAProxy doesn't accept in section, ACL and server names
+var invalidNameCharacters = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// Turn an arbitrary string into a name HAProxy accepts. Names which have to be changed get a hash of the original
+// appended, so different originals can't end up with the same name
+func sanitizeName(name string) string {
+	sanitized := invalidNameCharacters.ReplaceAllString(name, "_")
+	if sanitized == name && name != "" {
+		return name
+	}
+	return sanitized + "-" + shortHash(name)
+}
+
+// Compute a short, stable hash of a list of strings
+func shortHash(parts ...string) string {
+	hash := fnv.New32a()
+	for _, part := range parts {
+		// Prefix the length so that e.g. ("ab", "c") and ("a", "bc") differ
+		_, _ = fmt.Fprintf(hash, "%d:%s;", len(part), part)
+	}
+	return fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// Hands out unique HAProxy names within one namespace (e.g. the servers of a backend)
+type nameRegistry map[string]bool
+
+// Get a unique name for something identified by the given parts. The readable part of the name is derived from the
+// parts joined with '-', a hash is only appended when needed to keep names unique
+func (r nameRegistry) name(parts ...string) string {
+	readable := ""
+	for i, part := range parts {
+		if i > 0 {
+			readable += "-"
+		}
+		readable += part
+	}
+	name := sanitizeName(readable)
+	for i := 0; r[name]; i++ {
+		name = invalidNameCharacters.ReplaceAllString(readable, "_") + "-" + shortHash(append(parts, strconv.Itoa(i))...)
+	}
+	r[name] = true
+	return name
+}
+
+// Get the backends of a cluster sorted by name. Names have to be registered in a fixed order, otherwise the hashes
+// telling colliding names apart could change between reloads
+func sortedBackends(cluster state.ClusterState) []state.K8RouterBackend {
+	var backends []state.K8RouterBackend
+	for _, backend := range cluster.Backends {
+		backends = append(backends, backend)
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Name < backends[j].Name })
+	return backends
+}
@@ -0,0 +1,37 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/state"
+	"net"
+	"testing"
+)
+
+// Colliding names have to be told apart the same way every time, no matter the order of the cluster state
+func TestStableNameCollisions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	serverNames := func() []string {
+		blue := clusterStateWithBackends("blue", 0, "test.example.org")
+		// "x y" is sanitized to the name of the last backend
+		for _, name := range []string{"x-y", "x y", "x_y-" + shortHash("blue-x y"), "y"} {
+			ip := net.IPv4(10, 0, 0, byte(len(blue.Backends)))
+			blue.AddBackend(state.K8RouterBackend{Name: name, IP: &ip})
+		}
+		// "blue-x" / "y" collides with "blue" / "x-y"
+		blueX := clusterStateWithBackends("blue-x", 1, "test.example.org")
+		ip := net.IPv4(10, 0, 1, 1)
+		blueX.AddBackend(state.K8RouterBackend{Name: "y", IP: &ip})
+		uut := Handler{clusterState: map[string]state.ClusterState{"blue": blue, "blue-x": blueX}}
+		hostToBackend, _, backendCombinationList, _ := uut.computeBackends(uut.computeHostToClusterMap(), nil, nil)
+		var names []string
+		for _, server := range backendCombinationList[hostToBackend["test.example.org"]] {
+			names = append(names, server.Name+"="+server.IP.String())
+		}
+		return names
+	}
+	expected := serverNames()
+	g.Expect(expected).To(gomega.HaveLen(6))
+	for i := 0; i < 20; i++ {
+		g.Expect(serverNames()).To(gomega.Equal(expected))
+	}
+}
@@ -0,0 +1,131 @@
+package haproxy
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/state"
+	"sort"
+	"time"
+)
+
+// Figure out the options of each host. Ingresses without any options don't have an opinion, otherwise the first
+// ingress (ordered by cluster name, then ingress name) wins
+func (h *Handler) computeHostOptions(hostToClusters map[string][]string) map[string]state.K8RouterIngressOptions {
+	noOptions := state.K8RouterIngressOptions{}
+	hostToOptions := map[string]state.K8RouterIngressOptions{}
+	for host, clusters := range hostToClusters {
+		sortedClusters := append([]string{}, clusters...)
+		sort.Strings(sortedClusters)
+		source := ""
+		for _, cluster := range sortedClusters {
+			ingresses := h.clusterState[cluster].Ingresses
+			var ingressNames []string
+			for name := range ingresses {
+				ingressNames = append(ingressNames, name)
+			}
+			sort.Strings(ingressNames)
+			for _, name := range ingressNames {
+				ingress := ingresses[name]
+				if !containsString(ingress.Hosts, host) || state.IsIngressOptionsEquivalent(&ingress.Options, &noOptions) {
+					continue
+				}
+				if source == "" {
+					hostToOptions[host] = ingress.Options
+					source = cluster + "/" + ingress.Name
+					continue
+				}
+				current := hostToOptions[host]
+				if !state.IsIngressOptionsEquivalent(&ingress.Options, &current) {
+					log.WithFields(log.Fields{
+						"host":    host,
+						"used":    source,
+						"ignored": cluster + "/" + ingress.Name,
+					}).Warning("Conflicting annotations for host, using the first ingress")
+					h.reportIngressEvent(ingressEvent(cluster, &ingress, true, reasonConflictingAnnotations,
+						fmt.Sprintf("Annotations for host %s are ignored, they conflict with the ones of %s", host, source)))
+				}
+			}
+		}
+	}
+	return hostToOptions
+}
+
+// Combine the configured HTTPS policies with the ingress options of all hosts. Returns the frontend behavior of all
+// hosts with non-default behavior and the set of hosts to redirect to HTTPS
+func (h *Handler) computeHostPolicies(hostToOptions map[string]state.K8RouterIngressOptions,
+	hostToCert map[string]string) (map[string]HostOptions, map[string]bool) {
+	redirectHosts := map[string]bool{}
+	for host, options := range hostToOptions {
+		if options.ForceHTTPS {
+			redirectHosts[host] = true
+		}
+	}
+	hostOptions := map[string]HostOptions{}
+	for host, options := range hostToOptions {
+		hostOptions[host] = toHostOptions(options)
+	}
+	// Configured policies only make sense for hosts which can actually be reached via HTTPS
+	for host, cert := range hostToCert {
+		redirect, hstsMaxAge := h.certificatePolicy(cert)
+		if redirect {
+			redirectHosts[host] = true
+		}
+		options := hostToOptions[host]
+		if options.HSTSMaxAge == 0 && hstsMaxAge > 0 {
+			options.HSTSMaxAge = hstsMaxAge
+			hostOptions[host] = toHostOptions(options)
+		}
+	}
+	return hostOptions, redirectHosts
+}
+
+// Get the HTTPS policies of a certificate, falling back to the global ones
+func (h *Handler) certificatePolicy(name string) (bool, time.Duration) {
+	redirect := h.config.RedirectToHTTPS
+	hstsMaxAge := h.config.HSTSMaxAge
+	for _, cert := range h.config.Certificates {
+		if cert.Name != name {
+			continue
+		}
+		if cert.RedirectToHTTPS != nil {
+			redirect = *cert.RedirectToHTTPS
+		}
+		if cert.HSTSMaxAge != nil {
+			hstsMaxAge = *cert.HSTSMaxAge
+		}
+	}
+	return redirect, hstsMaxAge
+}
+
+// Convert ingress options to what the template needs for the frontends
+func toHostOptions(options state.K8RouterIngressOptions) HostOptions {
+	hostOptions := HostOptions{
+		AllowedSourceRanges: options.AllowedSourceRanges,
+		MaxBodySize:         options.MaxBodySize,
+		BasicAuthUserlist:   options.BasicAuthUserlist,
+		BasicAuthRealm:      options.BasicAuthRealm,
+	}
+	if options.HSTSMaxAge > 0 {
+		hostOptions.HSTSHeader = fmt.Sprintf("max-age=%d", int64(options.HSTSMaxAge/time.Second))
+		if options.HSTSIncludeSubdomains {
+			hostOptions.HSTSHeader += "; includeSubDomains"
+		}
+	}
+	return hostOptions
+}
+
+// Convert ingress options to what the template needs for the backends
+func toBackendSettings(options state.K8RouterIngressOptions) BackendSettings {
+	return BackendSettings{
+		RequestTimeout:  formatTimeout(options.RequestTimeout),
+		ResponseTimeout: formatTimeout(options.ResponseTimeout),
+	}
+}
+
+// Format a duration the way HAProxy expects it, empty for zero
+func formatTimeout(timeout time.Duration) string {
+	if timeout <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dms", int64(timeout/time.Millisecond))
+}
@@ -0,0 +1,59 @@
+package haproxy
+
+import (
+	"github.com/vsk8s/k8router/pkg/state"
+	"net"
+	"strconv"
+)
+
+// Port ingress pods terminate TLS on if their cluster doesn't configure one
+const defaultIngressTLSPort = 443
+
+// Figure out which hosts have their TLS connections passed through, either by annotation or by config. Returns the
+// configured service of each of these hosts, empty if the connections go to the TLS port of the host's ingress pods
+func (h *Handler) computePassthroughHosts(hostToClusters map[string][]string,
+	hostToOptions map[string]state.K8RouterIngressOptions) map[string]string {
+	passthroughHosts := map[string]string{}
+	for host := range hostToClusters {
+		if hostToOptions[host].SSLPassthrough {
+			passthroughHosts[host] = ""
+		}
+		// The first matching rule wins, its service beats the annotation
+		for _, rule := range h.config.Passthrough {
+			if matchesAnyDomain(rule.Hosts, host) {
+				passthroughHosts[host] = rule.Service
+				break
+			}
+		}
+	}
+	return passthroughHosts
+}
+
+// Get the hosts which are terminated by HAProxy (and therefore need a certificate)
+func terminatedHosts(hostToBackend map[string]string, passthroughHosts map[string]string) map[string]string {
+	terminated := map[string]string{}
+	for host, backend := range hostToBackend {
+		if _, ok := passthroughHosts[host]; !ok {
+			terminated[host] = backend
+		}
+	}
+	return terminated
+}
+
+// Get the port the ingress pods of a cluster terminate TLS on
+func (h *Handler) ingressTLSPort(cluster string) int {
+	port := h.clusterConfig(cluster).IngressTLSPort
+	if port == 0 {
+		port = defaultIngressTLSPort
+	}
+	return port
+}
+
+// Create the backend for a configured passthrough service. Returns its name, its servers and its settings
+func passthroughServiceBackend(service string) (string, []Backend, BackendSettings) {
+	address, port, _ := net.SplitHostPort(service)
+	ip := net.ParseIP(address)
+	portNumber, _ := strconv.Atoi(port)
+	servers := []Backend{{IP: &ip, Name: "service", Port: portNumber, Weight: 1}}
+	return sanitizeName("passthrough-" + service), servers, BackendSettings{TCP: true}
+}
@@ -0,0 +1,67 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"testing"
+)
+
+// Passthrough hosts go straight to the TLS port of their ingress pods (or the configured service) and don't need
+// a certificate
+func TestPassthroughHosts(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cert := config.CertificateInternal{Name: "dummycert", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/dummy.pem"}
+	cluster := config.ClusterInternal{Name: "a", IngressPort: 80, IngressTLSPort: 8443}
+	a := clusterStateWithBackends("a", 2, "www.example.org")
+	a.AddIngress(state.K8RouterIngress{
+		Name:    "vault",
+		Hosts:   []string{"vault.example.org", "vault.example.com"},
+		Options: state.K8RouterIngressOptions{SSLPassthrough: true},
+	})
+	a.AddIngress(state.K8RouterIngress{Name: "mtls", Hosts: []string{"api.mtls.example.com"}})
+	events := make(chan state.IngressEvent, 10)
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{"a": a},
+		config: config.Config{
+			Clusters:     []config.Cluster{{ClusterInternal: &cluster}},
+			Certificates: []config.Certificate{{CertificateInternal: &cert}},
+			Passthrough: []config.PassthroughRule{
+				{Hosts: []string{"*.mtls.example.com"}, Service: "10.0.0.10:9443"},
+			},
+		},
+		ingressEvents: events,
+	}
+	uut.regenerateTemplateInfo()
+	info := uut.templateInfo
+
+	g.Expect(receiveEvents(events)).To(gomega.BeEmpty(), "Passthrough hosts don't need a certificate")
+	g.Expect(info.SniList["dummycert"].Domains).To(gomega.Equal([]string{"www.example.org"}))
+	g.Expect(info.PassthroughHosts).To(gomega.Equal(map[string]bool{
+		"vault.example.org":    true,
+		"vault.example.com":    true,
+		"api.mtls.example.com": true,
+	}))
+
+	vaultBackend := info.HostToBackend["vault.example.org"]
+	g.Expect(info.HostToBackend["vault.example.com"]).To(gomega.Equal(vaultBackend))
+	g.Expect(vaultBackend).NotTo(gomega.Equal(info.HostToBackend["www.example.org"]))
+	g.Expect(info.BackendSettings[vaultBackend]).To(gomega.Equal(BackendSettings{TCP: true}))
+	g.Expect(info.BackendCombinationList[vaultBackend]).To(gomega.HaveLen(2))
+	for _, server := range info.BackendCombinationList[vaultBackend] {
+		g.Expect(server.Port).To(gomega.Equal(8443))
+	}
+	g.Expect(info.BackendSettings[info.HostToBackend["www.example.org"]].TCP).To(gomega.BeFalse())
+
+	serviceBackend := info.HostToBackend["api.mtls.example.com"]
+	g.Expect(info.BackendSettings[serviceBackend]).To(gomega.Equal(BackendSettings{TCP: true}))
+	servers := info.BackendCombinationList[serviceBackend]
+	g.Expect(servers).To(gomega.HaveLen(1))
+	g.Expect(servers[0].IP.String()).To(gomega.Equal("10.0.0.10"))
+	g.Expect(servers[0].Port).To(gomega.Equal(9443))
+
+	rendered := renderTemplate(g, &uut)
+	g.Expect(renderedSection(rendered, "frontend HTTPS")).To(gomega.ContainSubstring(
+		"use_backend backend-" + vaultBackend + " if acl-passthrough-vault.example.org"))
+	g.Expect(renderedSection(rendered, "backend backend-"+vaultBackend)).To(gomega.ContainSubstring("mode     tcp"))
+}
@@ -0,0 +1,121 @@
+package haproxy
+
+import (
+	"github.com/vsk8s/k8router/pkg/state"
+	"sort"
+	"strings"
+)
+
+// A path of a host together with the clusters serving it
+type hostPath struct {
+	path     state.K8RouterIngressPath
+	clusters []string
+	weights  map[string]int
+}
+
+// The path ingresses without paths serve
+var allPaths = state.K8RouterIngressPath{Path: "/", Prefix: true}
+
+// Figure out which clusters serve which paths of a host. Ingresses without paths serve all of them. Returns the
+// clusters and weights for requests which don't match any path, followed by the paths with their clusters and
+// weights, most specific first. Without ingresses serving all paths, requests not matching any path go to all clusters
+// of the host, so their Gateway implementations can answer them
+func (h *Handler) computeHostPaths(host string, clusters []string,
+	clusterWeights map[string]int) ([]string, map[string]int, []hostPath) {
+	clusterPaths := map[string][]state.K8RouterIngressPath{}
+	var paths []state.K8RouterIngressPath
+	restricted := false
+	for _, cluster := range clusters {
+		for _, ingress := range h.clusterState[cluster].Ingresses {
+			if !containsString(ingress.Hosts, host) {
+				continue
+			}
+			if len(ingress.Paths) == 0 {
+				clusterPaths[cluster] = append(clusterPaths[cluster], allPaths)
+				continue
+			}
+			restricted = true
+			clusterPaths[cluster] = append(clusterPaths[cluster], ingress.Paths...)
+			for _, path := range ingress.Paths {
+				path.Weight = nil
+				if path != allPaths && !containsPath(paths, path) {
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	if !restricted {
+		return clusters, clusterWeights, nil
+	}
+
+	fallback := h.pathClusters(allPaths, clusters, clusterPaths, clusterWeights)
+	if len(fallback.clusters) == 0 {
+		fallback = hostPath{clusters: clusters, weights: clusterWeights}
+	}
+	// HAProxy uses the first matching rule, so exact matches come first, then prefixes from long to short
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Prefix != paths[j].Prefix {
+			return !paths[i].Prefix
+		}
+		if len(paths[i].Path) != len(paths[j].Path) {
+			return len(paths[i].Path) > len(paths[j].Path)
+		}
+		return paths[i].Path < paths[j].Path
+	})
+	var hostPaths []hostPath
+	for _, path := range paths {
+		hostPaths = append(hostPaths, h.pathClusters(path, clusters, clusterPaths, clusterWeights))
+	}
+	return fallback.clusters, fallback.weights, hostPaths
+}
+
+// Find the clusters serving all requests a path matches. The most specific path of each cluster decides its weight,
+// if several paths are equally specific, the highest weight wins
+func (h *Handler) pathClusters(path state.K8RouterIngressPath, clusters []string,
+	clusterPaths map[string][]state.K8RouterIngressPath, clusterWeights map[string]int) hostPath {
+	result := hostPath{path: path, weights: map[string]int{}}
+	for _, cluster := range clusters {
+		best := -1
+		for _, candidate := range clusterPaths[cluster] {
+			if !pathCovers(candidate, path) {
+				continue
+			}
+			specificity := len(candidate.Path)
+			if !candidate.Prefix {
+				// Exact paths only cover themselves
+				specificity = len(candidate.Path) + 1
+			}
+			weight := clusterWeights[cluster]
+			if candidate.Weight != nil {
+				weight = *candidate.Weight
+			}
+			if specificity > best || (specificity == best && weight > result.weights[cluster]) {
+				result.weights[cluster] = weight
+			}
+			if specificity > best {
+				best = specificity
+			}
+		}
+		if best >= 0 {
+			result.clusters = append(result.clusters, cluster)
+		}
+	}
+	return result
+}
+
+// Check whether a path serves all requests another path matches
+func pathCovers(path state.K8RouterIngressPath, other state.K8RouterIngressPath) bool {
+	if !path.Prefix {
+		return !other.Prefix && path.Path == other.Path
+	}
+	return path.Path == "/" || other.Path == path.Path || strings.HasPrefix(other.Path, path.Path+"/")
+}
+
+func containsPath(list []state.K8RouterIngressPath, value state.K8RouterIngressPath) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
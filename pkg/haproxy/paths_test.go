@@ -0,0 +1,95 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"strings"
+	"testing"
+)
+
+// Paths served by other clusters than the rest of their host get their own backends, most specific first
+func TestHostPaths(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	green := clusterStateWithBackends("green", 1)
+	green.AddIngress(state.K8RouterIngress{
+		Name:  "httproute-shop-web",
+		Hosts: []string{"shop.example.org", "api.example.org"},
+		Paths: []state.K8RouterIngressPath{
+			{Path: "/api", Prefix: true},
+			{Path: "/static", Prefix: true, Weight: intPointer(0)},
+			{Path: "/health"},
+		},
+	})
+	wildcard := config.CertificateInternal{Name: "wildcard", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/w.pem"}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{
+			"blue":  clusterStateWithBackends("blue", 1, "shop.example.org"),
+			"green": green,
+		},
+		config: config.Config{Certificates: []config.Certificate{{CertificateInternal: &wildcard}}},
+	}
+	uut.regenerateTemplateInfo()
+	serverWeights := func(backend string) map[string]int {
+		weights := map[string]int{}
+		for _, server := range uut.templateInfo.BackendCombinationList[backend] {
+			weights[server.Name] = server.Weight
+		}
+		return weights
+	}
+
+	// Requests for other paths only go to the cluster serving the whole host
+	g.Expect(serverWeights(uut.templateInfo.HostToBackend["shop.example.org"])).To(gomega.Equal(
+		map[string]int{"blue-blue-0": 256}))
+	paths := uut.templateInfo.HostPaths["shop.example.org"]
+	g.Expect(paths).To(gomega.HaveLen(3))
+	g.Expect(paths[0].Path).To(gomega.Equal("/health"))
+	g.Expect(paths[0].Prefix).To(gomega.BeFalse())
+	g.Expect(serverWeights(paths[0].Backend)).To(gomega.Equal(map[string]int{"blue-blue-0": 256, "green-green-0": 256}))
+	g.Expect(paths[1].Path).To(gomega.Equal("/static"))
+	g.Expect(paths[1].Prefix).To(gomega.BeTrue())
+	g.Expect(serverWeights(paths[1].Backend)).To(gomega.Equal(map[string]int{"blue-blue-0": 256, "green-green-0": 0}))
+	g.Expect(paths[2].Path).To(gomega.Equal("/api"))
+	g.Expect(serverWeights(paths[2].Backend)).To(gomega.Equal(map[string]int{"blue-blue-0": 256, "green-green-0": 256}))
+
+	// Without a cluster serving the whole host, its clusters get all other requests
+	g.Expect(serverWeights(uut.templateInfo.HostToBackend["api.example.org"])).To(gomega.Equal(
+		map[string]int{"green-green-0": 256}))
+
+	rendered := renderedSection(renderTemplate(g, &uut), "frontend wrap-frontend-wildcard")
+	health := strings.Index(rendered, "    use_backend backend-"+paths[0].Backend+
+		" if acl-https-shop.example.org { path /health }\n")
+	static := strings.Index(rendered, "    use_backend backend-"+paths[1].Backend+
+		" if acl-https-shop.example.org { path /static } || acl-https-shop.example.org { path_beg /static/ }\n")
+	host := strings.Index(rendered, "    use_backend backend-"+uut.templateInfo.HostToBackend["shop.example.org"]+
+		" if acl-https-shop.example.org\n")
+	g.Expect(health).To(gomega.BeNumerically(">=", 0))
+	g.Expect(static).To(gomega.BeNumerically(">", health))
+	g.Expect(host).To(gomega.BeNumerically(">", static))
+}
+
+// The most specific path of a cluster decides whether and with which weight it serves a path
+func TestPathClusters(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	g.Expect(pathCovers(state.K8RouterIngressPath{Path: "/a", Prefix: true},
+		state.K8RouterIngressPath{Path: "/a/b"})).To(gomega.BeTrue())
+	g.Expect(pathCovers(state.K8RouterIngressPath{Path: "/a", Prefix: true},
+		state.K8RouterIngressPath{Path: "/ab", Prefix: true})).To(gomega.BeFalse())
+	g.Expect(pathCovers(state.K8RouterIngressPath{Path: "/a"},
+		state.K8RouterIngressPath{Path: "/a", Prefix: true})).To(gomega.BeFalse())
+	g.Expect(pathCovers(allPaths, state.K8RouterIngressPath{Path: "/a"})).To(gomega.BeTrue())
+
+	uut := Handler{}
+	clusterPaths := map[string][]state.K8RouterIngressPath{
+		"a": {allPaths, {Path: "/api", Prefix: true, Weight: intPointer(10)}},
+		"b": {{Path: "/api/v2", Prefix: true}},
+	}
+	clusterWeights := map[string]int{"a": 100, "b": 50}
+	result := uut.pathClusters(state.K8RouterIngressPath{Path: "/api/v2", Prefix: true}, []string{"a", "b"},
+		clusterPaths, clusterWeights)
+	g.Expect(result.clusters).To(gomega.Equal([]string{"a", "b"}))
+	g.Expect(result.weights).To(gomega.Equal(map[string]int{"a": 10, "b": 50}))
+	result = uut.pathClusters(state.K8RouterIngressPath{Path: "/api", Prefix: true}, []string{"a", "b"},
+		clusterPaths, clusterWeights)
+	g.Expect(result.clusters).To(gomega.Equal([]string{"a"}))
+}
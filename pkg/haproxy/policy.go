@@ -0,0 +1,188 @@
+package haproxy
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/certificate"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"sort"
+)
+
+// A host an ingress may not claim
+type hostViolation struct {
+	kind      string
+	namespace string
+	ingress   string
+	host      string
+	reason    string
+}
+
+// Check whether an ingress of a cluster may claim a host. Returns why it may not otherwise. Config rules own their
+// hosts, namespace claims only apply to hosts not covered by any rule
+func (h *Handler) checkHostPolicy(cluster string, ingress *state.K8RouterIngress, host string) (bool, string) {
+	covered := false
+	for _, rule := range h.config.HostPolicy.Rules {
+		if !matchesAnyDomain(rule.Hosts, host) {
+			continue
+		}
+		covered = true
+		if (len(rule.Clusters) == 0 || containsString(rule.Clusters, cluster)) &&
+			(len(rule.Namespaces) == 0 || containsString(rule.Namespaces, ingress.Namespace)) {
+			return true, ""
+		}
+	}
+	if covered {
+		return false, "the host is reserved for other namespaces"
+	}
+	if matchesAnyDomain(ingress.NamespaceClaims, host) {
+		return true, ""
+	}
+	if h.config.HostPolicy.Default == config.HostPolicyDeny {
+		return false, "the host isn't claimed by the namespace"
+	}
+	return true, ""
+}
+
+// Drop all hosts the ingresses of a cluster state may not claim, including the ones in their TLS blocks and synced
+// certificates. The state is only copied if anything is dropped
+func (h *Handler) applyHostPolicy(clusterState state.ClusterState) (state.ClusterState, []hostViolation) {
+	var names []string
+	for name := range clusterState.Ingresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var violations []hostViolation
+	filtered := clusterState
+	copied := false
+	for _, name := range names {
+		ingress := clusterState.Ingresses[name]
+		var allowed []string
+		rejected := map[string]bool{}
+		for _, host := range ingress.Hosts {
+			ok, reason := h.checkHostPolicy(clusterState.Name, &ingress, host)
+			if ok {
+				allowed = append(allowed, host)
+				continue
+			}
+			rejected[host] = true
+			violations = append(violations, hostViolation{
+				kind:      ingress.Kind,
+				namespace: ingress.Namespace,
+				ingress:   ingress.ObjectName,
+				host:      host,
+				reason:    reason,
+			})
+		}
+		if len(rejected) == 0 {
+			continue
+		}
+		if !copied {
+			filtered = clusterState.Copy()
+			copied = true
+		}
+		ingress.Hosts = allowed
+		var tlsBlocks []state.K8RouterIngressTLS
+		for _, tlsBlock := range ingress.TLS {
+			tlsBlock.Hosts = withoutHosts(tlsBlock.Hosts, rejected)
+			tlsBlocks = append(tlsBlocks, tlsBlock)
+		}
+		ingress.TLS = tlsBlocks
+		filtered.AddIngress(ingress)
+	}
+	if !copied {
+		return clusterState, nil
+	}
+
+	// Synced certificates are only used for hosts which are still referenced
+	secretHosts := map[string]map[string]bool{}
+	for _, ingress := range filtered.Ingresses {
+		for _, tlsBlock := range ingress.TLS {
+			if secretHosts[tlsBlock.SecretName] == nil {
+				secretHosts[tlsBlock.SecretName] = map[string]bool{}
+			}
+			for _, host := range tlsBlock.Hosts {
+				secretHosts[tlsBlock.SecretName][host] = true
+			}
+		}
+	}
+	for name, cert := range filtered.Certificates {
+		var hosts []string
+		for _, host := range cert.Hosts {
+			if secretHosts[name][host] {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) != len(cert.Hosts) {
+			cert.Hosts = hosts
+			filtered.AddCertificate(cert)
+		}
+	}
+	return filtered, violations
+}
+
+// Log, export and report violations of the host policy which appeared or disappeared
+func (h *Handler) reportHostViolations(cluster string, violations []hostViolation) {
+	current := map[hostViolation]bool{}
+	for _, violation := range violations {
+		current[violation] = true
+		if h.hostViolations[cluster][violation] {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"cluster":   cluster,
+			"namespace": violation.namespace,
+			"ingress":   violation.ingress,
+			"host":      violation.host,
+			"reason":    violation.reason,
+		}).Warning("Host rejected by host policy")
+		hostPolicyViolations.WithLabelValues(cluster, violation.namespace, violation.ingress, violation.host).Set(1)
+		h.reportIngressEvent(state.IngressEvent{
+			Cluster:   cluster,
+			Kind:      violation.kind,
+			Namespace: violation.namespace,
+			Name:      violation.ingress,
+			Warning:   true,
+			Reason:    reasonHostRejected,
+			Message:   fmt.Sprintf("Host %s is not routed by k8router: %s", violation.host, violation.reason),
+		})
+	}
+	for violation := range h.hostViolations[cluster] {
+		if current[violation] {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"cluster":   cluster,
+			"namespace": violation.namespace,
+			"ingress":   violation.ingress,
+			"host":      violation.host,
+		}).Info("Host policy violation resolved")
+		hostPolicyViolations.DeleteLabelValues(cluster, violation.namespace, violation.ingress, violation.host)
+	}
+	if h.hostViolations == nil {
+		h.hostViolations = map[string]map[hostViolation]bool{}
+	}
+	h.hostViolations[cluster] = current
+}
+
+// Check whether any of the domain patterns matches a host
+func matchesAnyDomain(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if certificate.MatchesDomain(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove some hosts from a list
+func withoutHosts(hosts []string, remove map[string]bool) []string {
+	var result []string
+	for _, host := range hosts {
+		if !remove[host] {
+			result = append(result, host)
+		}
+	}
+	return result
+}
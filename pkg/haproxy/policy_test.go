@@ -0,0 +1,105 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"testing"
+)
+
+// Ingresses may only claim the hosts the policy allows them to
+func TestHostPolicy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	events := make(chan state.IngressEvent, 10)
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{},
+		config: config.Config{
+			HostPolicy: config.HostPolicy{
+				Rules: []config.HostPolicyRule{
+					{
+						Hosts:      []string{"shop.example.org", "*.shop.example.org"},
+						Clusters:   []string{"prod"},
+						Namespaces: []string{"shop"},
+					},
+				},
+				Default: config.HostPolicyDeny,
+			},
+		},
+		ingressEvents: events,
+	}
+
+	prod := clusterStateWithBackends("prod", 1)
+	prod.Ingresses = map[string]state.K8RouterIngress{}
+	prod.AddIngress(state.K8RouterIngress{
+		Name:       "shop-web",
+		Namespace:  "shop",
+		ObjectName: "web",
+		Hosts:      []string{"shop.example.org", "api.shop.example.org"},
+		TLS:        []state.K8RouterIngressTLS{{Hosts: []string{"shop.example.org"}, SecretName: "shop/tls"}},
+	})
+	prod.AddIngress(state.K8RouterIngress{
+		Name:       "evil-hijack",
+		Namespace:  "evil",
+		ObjectName: "hijack",
+		Hosts:      []string{"shop.example.org", "free.example.org"},
+		TLS:        []state.K8RouterIngressTLS{{Hosts: []string{"shop.example.org"}, SecretName: "evil/tls"}},
+	})
+	prod.AddIngress(state.K8RouterIngress{
+		Name:            "blog-app",
+		Namespace:       "blog",
+		ObjectName:      "app",
+		Hosts:           []string{"blog.example.org", "www.shop.example.org"},
+		NamespaceClaims: []string{"blog.example.org", "*.shop.example.org"},
+	})
+	prod.AddCertificate(state.K8RouterCertificate{Name: "shop/tls", Hosts: []string{"shop.example.org"}})
+	prod.AddCertificate(state.K8RouterCertificate{Name: "evil/tls", Hosts: []string{"shop.example.org"}})
+
+	uut.applyClusterState(prod)
+	applied := uut.clusterState["prod"]
+	g.Expect(applied.Ingresses["shop-web"].Hosts).To(gomega.Equal([]string{"shop.example.org", "api.shop.example.org"}))
+	g.Expect(applied.Ingresses["evil-hijack"].Hosts).To(gomega.BeEmpty())
+	g.Expect(applied.Ingresses["evil-hijack"].TLS[0].Hosts).To(gomega.BeEmpty())
+	g.Expect(applied.Ingresses["blog-app"].Hosts).To(gomega.Equal([]string{"blog.example.org"}), "Rules win over claims")
+	g.Expect(applied.Certificates["shop/tls"].Hosts).To(gomega.Equal([]string{"shop.example.org"}))
+	g.Expect(applied.Certificates["evil/tls"].Hosts).To(gomega.BeEmpty())
+	g.Expect(prod.Ingresses["evil-hijack"].Hosts).To(gomega.HaveLen(2), "Published states must not be modified")
+	g.Expect(uut.computeHostToClusterMap()).NotTo(gomega.HaveKey("free.example.org"))
+
+	g.Expect(events).To(gomega.HaveLen(3))
+	event := <-events
+	g.Expect(event.Cluster).To(gomega.Equal("prod"))
+	g.Expect(event.Namespace).To(gomega.Equal("blog"))
+	g.Expect(event.Name).To(gomega.Equal("app"))
+	g.Expect(event.Warning).To(gomega.BeTrue())
+	g.Expect(event.Reason).To(gomega.Equal(reasonHostRejected))
+	g.Expect(event.Message).To(gomega.ContainSubstring("www.shop.example.org"))
+	g.Expect(testutil.ToFloat64(hostPolicyViolations.WithLabelValues("prod", "evil", "hijack", "free.example.org"))).To(
+		gomega.BeEquivalentTo(1))
+
+	// Known violations are only reported once
+	<-events
+	<-events
+	uut.applyClusterState(prod)
+	g.Expect(events).To(gomega.BeEmpty())
+
+	// Other clusters may not claim reserved hosts either
+	staging := clusterStateWithBackends("staging", 1)
+	staging.Ingresses = map[string]state.K8RouterIngress{}
+	staging.AddIngress(state.K8RouterIngress{
+		Name:       "shop-web",
+		Namespace:  "shop",
+		ObjectName: "web",
+		Hosts:      []string{"shop.example.org"},
+	})
+	uut.applyClusterState(staging)
+	g.Expect(uut.clusterState["staging"].Ingresses["shop-web"].Hosts).To(gomega.BeEmpty())
+	g.Expect(events).To(gomega.HaveLen(1))
+
+	// Resolved violations are forgotten
+	prod = prod.Copy()
+	delete(prod.Ingresses, "evil-hijack")
+	delete(prod.Ingresses, "blog-app")
+	uut.applyClusterState(prod)
+	g.Expect(uut.hostViolations["prod"]).To(gomega.BeEmpty())
+}
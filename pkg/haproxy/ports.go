@@ -0,0 +1,106 @@
+package haproxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/config"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Loopback frontends of certificates in a config we've written
+var localFrontendPattern = regexp.MustCompile(`frontend wrap-frontend-(\S+)\n\s+mode\s+http\n\s+bind\s+127\.0\.0\.1:(\d+)`)
+
+// Get the first port and size of the local port range
+func (h *Handler) localPortRange() (int, int) {
+	first, count := h.config.LocalPorts.First, h.config.LocalPorts.Count
+	if first == 0 {
+		first = config.DefaultLocalPortsFirst
+	}
+	if count == 0 {
+		count = config.DefaultLocalPortsCount
+	}
+	if h.config.TLSTermination == config.TLSTerminationCrtList {
+		// All certificates share a single frontend
+		count = 1
+	}
+	return first, count
+}
+
+// Read the local ports of the certificates' frontends from the config we've written before, so certificates keep
+// their ports across restarts
+func readLocalPorts(dropinPath string) map[string]int {
+	ports := map[string]int{}
+	previous, err := ioutil.ReadFile(dropinPath)
+	if err != nil {
+		return ports
+	}
+	for _, match := range localFrontendPattern.FindAllSubmatch(previous, -1) {
+		port, _ := strconv.Atoi(string(match[2]))
+		ports[string(match[1])] = port
+	}
+	return ports
+}
+
+// Assign each certificate a local port. Certificates keep the port they had before, others get a port derived from
+// a hash of their name or, if that is taken or not available, the next free one (in name order). Returns the ports
+// and the certificates which didn't get one as the range is full
+func assignLocalPorts(names []string, first, count int, previous map[string]int,
+	available func(port int) bool) (map[string]int, []string) {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	ports := map[string]int{}
+	taken := map[int]bool{}
+	for _, name := range sorted {
+		port, ok := previous[name]
+		if ok && port >= first && port < first+count && !taken[port] {
+			ports[name] = port
+			taken[port] = true
+		}
+	}
+	var skipped []string
+	for _, name := range sorted {
+		if _, ok := ports[name]; ok {
+			continue
+		}
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(name))
+		offset := int(hash.Sum32() % uint32(count))
+		for tries := 0; tries < count; tries++ {
+			port := first + (offset+tries)%count
+			if taken[port] {
+				continue
+			}
+			// Ports which aren't available stay taken, so they are only probed once
+			taken[port] = true
+			if available(port) {
+				ports[name] = port
+				break
+			}
+		}
+		if _, ok := ports[name]; !ok {
+			skipped = append(skipped, name)
+		}
+	}
+	return ports, skipped
+}
+
+// Check whether a local port can be assigned to a certificate. Ports of the current assignment are bound by HAProxy
+// on our behalf, all others must not be in use
+func (h *Handler) localPortAvailable(port int) bool {
+	for _, assigned := range h.localPorts {
+		if assigned == port {
+			return true
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		log.WithField("port", port).WithError(err).Warning("Local port is in use, skipping it")
+		return false
+	}
+	_ = listener.Close()
+	return true
+}
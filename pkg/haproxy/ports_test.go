@@ -0,0 +1,132 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+// Certificates keep their port when other certificates come and go
+func TestLocalPortAssignment(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	free := func(int) bool { return true }
+	ports, skipped := assignLocalPorts([]string{"shop", "wildcard"}, 20000, 10, nil, free)
+	g.Expect(skipped).To(gomega.BeEmpty())
+	g.Expect(ports).To(gomega.HaveLen(2))
+	for _, port := range ports {
+		g.Expect(port).To(gomega.BeNumerically(">=", 20000))
+		g.Expect(port).To(gomega.BeNumerically("<", 20010))
+	}
+	g.Expect(ports["shop"]).NotTo(gomega.Equal(ports["wildcard"]))
+
+	// New certificates only get ports nobody has, no matter where their hashes and names take them
+	names := []string{"shop", "wildcard"}
+	for i := 0; i < 8; i++ {
+		names = append(names, "acme-"+strconv.Itoa(i))
+		more, skipped := assignLocalPorts(names, 20000, 10, ports, free)
+		g.Expect(skipped).To(gomega.BeEmpty())
+		g.Expect(more).To(gomega.HaveLen(len(names)))
+		for name, port := range ports {
+			g.Expect(more[name]).To(gomega.Equal(port))
+		}
+		ports = more
+	}
+
+	// Ports outside of the range are assigned anew
+	moved, _ := assignLocalPorts([]string{"shop"}, 20000, 10, map[string]int{"shop": 12345}, free)
+	g.Expect(moved["shop"]).To(gomega.BeNumerically(">=", 20000))
+
+	// Collisions take the next free port
+	full, skipped := assignLocalPorts([]string{"a", "b", "c"}, 20000, 2, nil, free)
+	g.Expect(full).To(gomega.HaveLen(2))
+	g.Expect(full["a"]).NotTo(gomega.Equal(full["b"]))
+	g.Expect(skipped).To(gomega.Equal([]string{"c"}))
+}
+
+// Ports which aren't available are skipped, each of them is only probed once
+func TestLocalPortsUnavailable(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ports, _ := assignLocalPorts([]string{"shop"}, 20000, 10, nil, func(int) bool { return true })
+	probed := map[int]int{}
+	busy := func(port int) bool {
+		probed[port]++
+		return port != ports["shop"]
+	}
+	moved, skipped := assignLocalPorts([]string{"shop", "wildcard"}, 20000, 10, nil, busy)
+	g.Expect(skipped).To(gomega.BeEmpty())
+	g.Expect(moved["shop"]).NotTo(gomega.Equal(ports["shop"]))
+	g.Expect(moved["wildcard"]).NotTo(gomega.Equal(ports["shop"]))
+	for _, count := range probed {
+		g.Expect(count).To(gomega.Equal(1))
+	}
+
+	// Ports certificates already have aren't probed at all
+	probed = map[int]int{}
+	_, _ = assignLocalPorts([]string{"shop", "wildcard"}, 20000, 10, moved, busy)
+	g.Expect(probed).To(gomega.BeEmpty())
+
+	none, skipped := assignLocalPorts([]string{"shop"}, 20000, 1, nil, func(int) bool { return false })
+	g.Expect(none).To(gomega.BeEmpty())
+	g.Expect(skipped).To(gomega.Equal([]string{"shop"}))
+}
+
+// Hosts of certificates which don't fit into the port range are reported
+func TestLocalPortRangeFull(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut := goldenHandler(false)
+	uut.config.LocalPorts = config.LocalPorts{First: 20000, Count: 1}
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.SniList).To(gomega.HaveLen(1))
+	g.Expect(uut.templateInfo.SniList).To(gomega.HaveKey("shop"))
+	g.Expect(uut.templateInfo.DefaultWildcardCert).To(gomega.BeEmpty())
+	renderTemplate(g, uut)
+}
+
+// Ports in use by anybody but the HAProxy we configured aren't available
+func TestLocalPortsInUse(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-ports")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).To(gomega.BeNil())
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	uut := Handler{config: config.Config{LocalPorts: config.LocalPorts{First: port, Count: 1}}}
+	g.Expect(uut.localPortAvailable(port)).To(gomega.BeFalse())
+
+	// Assignments are read from the config written before
+	dropin := path.Join(dir, "k8router.cfg")
+	g.Expect(readLocalPorts(dropin)).To(gomega.BeEmpty())
+	content := "frontend wrap-frontend-foo\n    mode     http\n    bind     127.0.0.1:" + strconv.Itoa(port) +
+		" crt /etc/ssl/foo.pem ssl accept-proxy\n"
+	g.Expect(ioutil.WriteFile(dropin, []byte(content), 0644)).To(gomega.Succeed())
+	uut.localPorts = readLocalPorts(dropin)
+	g.Expect(uut.localPorts).To(gomega.Equal(map[string]int{"foo": port}))
+	g.Expect(uut.localPortAvailable(port)).To(gomega.BeTrue())
+}
+
+// The ports read back from a rendered config are the ones the certificates got
+func TestLocalPortsFromConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-ports")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	uut := goldenHandler(false)
+	uut.regenerateTemplateInfo()
+	dropin := path.Join(dir, "k8router.cfg")
+	g.Expect(ioutil.WriteFile(dropin, []byte(renderTemplate(g, uut)), 0644)).To(gomega.Succeed())
+	ports := map[string]int{}
+	for name, details := range uut.templateInfo.SniList {
+		ports[name] = details.LocalForwardPort
+	}
+	g.Expect(ports).NotTo(gomega.BeEmpty())
+	g.Expect(readLocalPorts(dropin)).To(gomega.Equal(ports))
+}
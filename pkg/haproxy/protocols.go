@@ -0,0 +1,40 @@
+package haproxy
+
+import (
+	"github.com/vsk8s/k8router/pkg/config"
+	"strings"
+)
+
+// Get the TLS settings of a certificate, falling back to the global ones. Certificates which aren't configured (e.g.
+// synced or issued ones) use the global settings
+func (h *Handler) tlsSettings(name string) config.TLS {
+	settings := h.config.TLS
+	for _, cert := range h.config.Certificates {
+		if cert.Name == name {
+			settings = settings.WithOverrides(cert.TLS)
+		}
+	}
+	return settings
+}
+
+// Add the TLS settings of a certificate to its details
+func (h *Handler) applyTLSSettings(name string, details *SniDetail) {
+	settings := h.tlsSettings(name)
+	details.ALPN = strings.Join(settings.Protocols(), ",")
+	details.MinVersion = settings.MinVersion
+	details.Ciphers = settings.Ciphers
+	details.CipherSuites = settings.CipherSuites
+}
+
+// Get the HAProxy 'proto' of the servers of a cluster, the host's annotation overrides the cluster's setting. Empty
+// for HTTP/1.1
+func (h *Handler) serverProto(cluster string, override string) string {
+	protocol := override
+	if protocol == "" {
+		protocol = h.clusterConfig(cluster).BackendProtocol
+	}
+	if protocol == config.BackendProtocolH2 {
+		return "h2"
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"testing"
+)
+
+// Clusters talk HTTP/2 to their ingress pods if configured, hosts can override this
+func TestBackendProtocols(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	grpc := config.ClusterInternal{Name: "grpc", BackendProtocol: config.BackendProtocolH2}
+	web := config.ClusterInternal{Name: "web", BackendProtocol: config.BackendProtocolHTTP1}
+	grpcState := clusterStateWithBackends("grpc", 1, "api.example.org")
+	grpcState.AddIngress(state.K8RouterIngress{
+		Name:    "legacy",
+		Hosts:   []string{"legacy.example.org"},
+		Options: state.K8RouterIngressOptions{BackendProtocol: config.BackendProtocolHTTP1},
+	})
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{
+			"grpc": grpcState,
+			"web":  clusterStateWithBackends("web", 1, "api.example.org"),
+		},
+		config: config.Config{Clusters: []config.Cluster{{ClusterInternal: &grpc}, {ClusterInternal: &web}}},
+	}
+	hostToBackend, _, backendCombinationList, _ := uut.computeBackends(uut.computeHostToClusterMap(),
+		uut.computeHostOptions(uut.computeHostToClusterMap()), nil)
+
+	protos := map[string]string{}
+	for _, server := range backendCombinationList[hostToBackend["api.example.org"]] {
+		protos[server.Name] = server.Proto
+	}
+	g.Expect(protos).To(gomega.Equal(map[string]string{"grpc-grpc-0": "h2", "web-web-0": ""}))
+	legacy := backendCombinationList[hostToBackend["legacy.example.org"]]
+	g.Expect(legacy).To(gomega.HaveLen(1))
+	g.Expect(legacy[0].Proto).To(gomega.BeEmpty())
+}
+
+// ALPN is offered according to the certificate's settings, falling back to the global ones
+func TestTLSSettings(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	http2 := false
+	legacy := config.CertificateInternal{
+		Name:    "legacy",
+		Domains: []string{"legacy.example.org"},
+		Cert:    "/etc/ssl/legacy.pem",
+		TLS:     config.TLS{HTTP2: &http2, MinVersion: "TLSv1.0"},
+	}
+	wildcard := config.CertificateInternal{Name: "wildcard", Domains: []string{"*.example.org"}, Cert: "/etc/ssl/w.pem"}
+	uut := Handler{
+		clusterState: map[string]state.ClusterState{
+			"a": clusterStateWithBackends("a", 1, "legacy.example.org", "www.example.org"),
+		},
+		config: config.Config{
+			Certificates: []config.Certificate{{CertificateInternal: &legacy}, {CertificateInternal: &wildcard}},
+			TLS: config.TLS{
+				ALPN:         []string{"h2", "http/1.1"},
+				MinVersion:   "TLSv1.2",
+				CipherSuites: "TLS_AES_128_GCM_SHA256",
+			},
+		},
+	}
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.templateInfo.SniList["wildcard"].ALPN).To(gomega.Equal("h2,http/1.1"))
+	g.Expect(uut.templateInfo.SniList["wildcard"].MinVersion).To(gomega.Equal("TLSv1.2"))
+	// The certificate's HTTP/2 switch replaces the global ALPN protocols
+	g.Expect(uut.templateInfo.SniList["legacy"].ALPN).To(gomega.BeEmpty())
+	g.Expect(uut.templateInfo.SniList["legacy"].MinVersion).To(gomega.Equal("TLSv1.0"))
+	g.Expect(uut.templateInfo.SniList["legacy"].CipherSuites).To(gomega.Equal("TLS_AES_128_GCM_SHA256"))
+}
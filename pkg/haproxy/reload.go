@@ -0,0 +1,115 @@
+package haproxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// How often to check whether pending changes are due
+const reloadCheckInterval = 100 * time.Millisecond
+
+// Remember that the config has to be updated. Urgent changes are applied as soon as possible, all others are
+// coalesced according to the reload settings
+func (h *Handler) scheduleUpdate(urgent bool) {
+	now := time.Now()
+	if !h.haproxyNeedsUpdate {
+		h.pendingSince = now
+	}
+	h.haproxyNeedsUpdate = true
+	h.lastChange = now
+	h.pendingChanges++
+	if urgent {
+		h.urgentUpdate = true
+	}
+}
+
+// Check whether pending changes should be applied now
+func (h *Handler) updateDue(now time.Time) bool {
+	if !h.haproxyNeedsUpdate {
+		return false
+	}
+	if h.urgentUpdate {
+		return true
+	}
+	limits := h.config.Reload
+	if limits.MaxPerMinute > 0 && h.mayReload() && h.recentReloads(now) >= limits.MaxPerMinute {
+		return false
+	}
+	if now.Sub(h.lastChange) >= limits.QuietPeriod {
+		return true
+	}
+	return now.Sub(h.pendingSince) >= limits.MaxDelay
+}
+
+// Check whether applying the pending changes may require a reload (instead of only using the runtime API)
+func (h *Handler) mayReload() bool {
+	return h.reloadRequired || h.certificatesChanged || h.config.HAProxyRuntimeSocket == ""
+}
+
+// Get the number of reloads within the last minute
+func (h *Handler) recentReloads(now time.Time) int {
+	recent := h.reloadTimes[:0]
+	for _, reloadTime := range h.reloadTimes {
+		if now.Sub(reloadTime) < time.Minute {
+			recent = append(recent, reloadTime)
+		}
+	}
+	h.reloadTimes = recent
+	return len(recent)
+}
+
+// Render the config with all pending changes and reload HAProxy if necessary
+func (h *Handler) applyPendingUpdate() {
+	log.WithFields(log.Fields{
+		"changes": h.pendingChanges,
+		"urgent":  h.urgentUpdate,
+		"delay":   time.Since(h.pendingSince),
+	}).Debug("Rebuilding config")
+	if h.pendingChanges > 1 {
+		changesCoalesced.Add(float64(h.pendingChanges - 1))
+	}
+	if h.urgentUpdate {
+		urgentUpdates.Inc()
+	}
+	h.haproxyNeedsUpdate = false
+	h.urgentUpdate = false
+	h.pendingChanges = 0
+
+	h.syncManagedCertificates()
+	// Synced and issued certificates may have changed, so their expiry has to be known before picking certificates
+	h.checkCertificateExpiry()
+	h.regenerateTemplateInfo()
+	log.WithField("templateInfo", h.templateInfo).Debug("Templating config")
+	if h.writeConfigToHAProxy() {
+		h.reloadTimes = append(h.reloadTimes, time.Now())
+		haproxyReloads.Inc()
+	}
+	h.reportRoutedHosts()
+	if h.debugFileEventChannel != nil {
+		h.debugFileEventChannel <- true
+	}
+}
+
+// Get all hosts and whether any of their clusters has backends
+func (h *Handler) hostsWithBackends() map[string]bool {
+	hosts := map[string]bool{}
+	for _, cluster := range h.clusterState {
+		for _, ingress := range cluster.Ingresses {
+			for _, host := range ingress.Hosts {
+				hosts[host] = hosts[host] || len(cluster.Backends) > 0
+			}
+		}
+	}
+	return hosts
+}
+
+// Get the hosts which still exist but lost all their backends
+func hostsLosingAllBackends(before map[string]bool, after map[string]bool) []string {
+	var hosts []string
+	for host, hadBackends := range before {
+		if hasBackends, exists := after[host]; hadBackends && exists && !hasBackends {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,87 @@
+package haproxy
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Changes should be coalesced until things calm down, but not longer than the maximum delay
+func TestReloadDebounce(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut := Handler{
+		config: config.Config{
+			Reload: config.Reload{QuietPeriod: time.Second, MaxDelay: 5 * time.Second, MaxPerMinute: 2},
+		},
+	}
+	g.Expect(uut.updateDue(time.Now())).To(gomega.BeFalse(), "Nothing changed")
+
+	uut.scheduleUpdate(false)
+	start := uut.pendingSince
+	g.Expect(uut.updateDue(start)).To(gomega.BeFalse())
+	g.Expect(uut.updateDue(start.Add(time.Second))).To(gomega.BeTrue())
+
+	// Things keep changing
+	uut.lastChange = start.Add(4500 * time.Millisecond)
+	g.Expect(uut.updateDue(start.Add(4900 * time.Millisecond))).To(gomega.BeFalse())
+	g.Expect(uut.updateDue(start.Add(5 * time.Second))).To(gomega.BeTrue())
+
+	// Too many reloads within the last minute
+	uut.reloadTimes = []time.Time{start.Add(-50 * time.Second), start.Add(-10 * time.Second)}
+	g.Expect(uut.updateDue(start.Add(5 * time.Second))).To(gomega.BeFalse())
+	g.Expect(uut.updateDue(start.Add(11 * time.Second))).To(gomega.BeTrue())
+	g.Expect(uut.reloadTimes).To(gomega.HaveLen(1), "Old reloads are forgotten")
+
+	// Address changes applied via the runtime API aren't limited
+	uut.reloadTimes = []time.Time{start, start}
+	uut.config.HAProxyRuntimeSocket = "/run/haproxy/admin.sock"
+	g.Expect(uut.updateDue(start.Add(5 * time.Second))).To(gomega.BeTrue())
+	uut.reloadRequired = true
+	g.Expect(uut.updateDue(start.Add(5 * time.Second))).To(gomega.BeFalse())
+
+	// Urgent changes bypass all limits
+	uut.scheduleUpdate(true)
+	g.Expect(uut.updateDue(uut.lastChange)).To(gomega.BeTrue())
+	g.Expect(uut.pendingChanges).To(gomega.Equal(2))
+}
+
+// Hosts losing all their backends have to be updated immediately
+func TestUrgentUpdates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-reload")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+
+	uut := goldenHandler(false)
+	uut.config.HAProxyDropinPath = path.Join(dir, "k8router.cfg")
+	uut.config.Reload = config.Reload{QuietPeriod: time.Minute, MaxDelay: time.Hour, MaxPerMinute: 1}
+	uut.debugFileEventChannel = make(chan bool, 1)
+	renderTemplate(g, uut)
+	uut.reloadTimes = []time.Time{time.Now()}
+
+	// Other clusters still serve these hosts
+	uut.applyClusterState(clusterStateWithBackends("green", 0, "www.example.org", "shop.example.org"))
+	g.Expect(uut.urgentUpdate).To(gomega.BeFalse())
+	g.Expect(uut.updateDue(time.Now())).To(gomega.BeFalse())
+
+	// Nobody serves the admin host anymore
+	blue := uut.clusterState["blue"]
+	blue = blue.Copy()
+	blue.Backends = map[string]state.K8RouterBackend{}
+	coalesced := testutil.ToFloat64(changesCoalesced)
+	uut.applyClusterState(blue)
+	g.Expect(uut.urgentUpdate).To(gomega.BeTrue())
+	g.Expect(uut.updateDue(time.Now())).To(gomega.BeTrue())
+
+	uut.applyPendingUpdate()
+	g.Expect(testutil.ToFloat64(changesCoalesced) - coalesced).To(gomega.BeEquivalentTo(1))
+	g.Expect(uut.urgentUpdate).To(gomega.BeFalse())
+	g.Expect(uut.updateDue(time.Now())).To(gomega.BeFalse())
+	g.Expect(uut.reloadTimes).To(gomega.HaveLen(2))
+}
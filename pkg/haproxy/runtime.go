@@ -0,0 +1,85 @@
+package haproxy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long to wait for HAProxy's runtime API
+const runtimeAPITimeout = 5 * time.Second
+
+// Apply changed server addresses to the running HAProxy. Fails if anything but server addresses changed
+func (h *Handler) updateServerAddresses(applied TemplateInfo) error {
+	commands, err := serverAddressCommands(applied, h.templateInfo)
+	if err != nil {
+		return err
+	}
+	for _, command := range commands {
+		response, err := runtimeCommand(h.config.HAProxyRuntimeSocket, command)
+		if err != nil {
+			return errors.Wrapf(err, "runtime API command '%s' failed", command)
+		}
+		if !strings.Contains(response, "changed") {
+			return errors.Errorf("runtime API command '%s' failed: %s", command, strings.TrimSpace(response))
+		}
+	}
+	return nil
+}
+
+// Compute the runtime API commands to get from one set of backends to another. Fails if anything but server
+// addresses changed
+func serverAddressCommands(from TemplateInfo, to TemplateInfo) ([]string, error) {
+	if len(from.BackendCombinationList) != len(to.BackendCombinationList) {
+		return nil, errors.New("backends were added or removed")
+	}
+	var backendNames []string
+	for name := range to.BackendCombinationList {
+		backendNames = append(backendNames, name)
+	}
+	sort.Strings(backendNames)
+	var commands []string
+	for _, name := range backendNames {
+		fromServers, ok := from.BackendCombinationList[name]
+		toServers := to.BackendCombinationList[name]
+		if !ok || len(fromServers) != len(toServers) {
+			return nil, errors.Errorf("servers of backend '%s' were added or removed", name)
+		}
+		for i, server := range toServers {
+			previous := fromServers[i]
+			if previous.Name != server.Name {
+				return nil, errors.Errorf("servers of backend '%s' were added or removed", name)
+			}
+			if previous.IP.Equal(*server.IP) && previous.Port == server.Port {
+				continue
+			}
+			commands = append(commands, fmt.Sprintf("set server backend-%s/server-%s addr %s port %d",
+				name, server.Name, server.IP, server.Port))
+		}
+	}
+	return commands, nil
+}
+
+// Send a single command to HAProxy's runtime API and return the response
+func runtimeCommand(socket string, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, runtimeAPITimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(runtimeAPITimeout))
+	if err != nil {
+		return "", err
+	}
+	_, err = conn.Write([]byte(command + "\n"))
+	if err != nil {
+		return "", err
+	}
+	// HAProxy closes the connection after answering a single command
+	response, err := ioutil.ReadAll(conn)
+	return string(response), err
+}
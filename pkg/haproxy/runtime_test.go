@@ -0,0 +1,74 @@
+package haproxy
+
+import (
+	"bufio"
+	"github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Fake HAProxy runtime API recording all commands
+func fakeRuntimeAPI(g *gomega.WithT, socket string) (chan string, func()) {
+	listener, err := net.Listen("unix", socket)
+	g.Expect(err).To(gomega.BeNil())
+	commands := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			commands <- strings.TrimSpace(command)
+			_, _ = conn.Write([]byte("IP changed from '10.0.4.0' to '192.0.2.10' by 'stats socket command'\n"))
+			_ = conn.Close()
+		}
+	}()
+	return commands, func() { _ = listener.Close() }
+}
+
+// Address changes are applied via the runtime API, everything else needs a reload
+func TestRuntimeAPIUpdates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-runtime")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+	commands, stop := fakeRuntimeAPI(g, path.Join(dir, "admin.sock"))
+	defer stop()
+
+	uut := goldenHandler(false)
+	uut.config.HAProxyDropinPath = path.Join(dir, "k8router.cfg")
+	uut.config.HAProxyRuntimeSocket = path.Join(dir, "admin.sock")
+	uut.debugFileEventChannel = make(chan bool)
+	renderTemplate(g, uut)
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+
+	moved := clusterStateWithBackends("green", 2, "www.example.org", "shop.example.org")
+	ip := net.IPv4(192, 0, 2, 10)
+	backend := moved.Backends["green-0"]
+	backend.IP = &ip
+	moved.AddBackend(backend)
+	uut.applyClusterState(moved)
+	g.Expect(uut.reloadRequired).To(gomega.BeFalse())
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeFalse())
+	// The server is part of both backends containing the green cluster
+	g.Expect(commands).To(gomega.HaveLen(2))
+	g.Expect(<-commands).To(gomega.MatchRegexp(`^set server backend-blue-.*/server-green-green-0 addr 192\.0\.2\.10 port 80$`))
+	g.Expect(<-commands).To(gomega.MatchRegexp(`^set server backend-blue-.*/server-green-green-0 addr 192\.0\.2\.10 port 80$`))
+	rendered, err := ioutil.ReadFile(uut.config.HAProxyDropinPath)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(string(rendered)).To(gomega.ContainSubstring("server   server-green-green-0 192.0.2.10:80"))
+
+	// Removing a pod changes the server weights
+	uut.applyClusterState(clusterStateWithBackends("green", 1, "www.example.org", "shop.example.org"))
+	g.Expect(uut.reloadRequired).To(gomega.BeTrue())
+	uut.regenerateTemplateInfo()
+	g.Expect(uut.writeConfigToHAProxy()).To(gomega.BeTrue())
+	g.Expect(commands).To(gomega.BeEmpty())
+}
@@ -12,12 +12,87 @@ type SniDetail struct {
 	LocalForwardPort int
 	// Path to concatenated x509 chain and key in PEM format
 	Path string
+	// CA bundle to verify client certificates with (clients aren't asked for certificates if empty)
+	ClientCA string
+	// Whether the bind requires client certificates ('required') or only verifies them if sent ('optional')
+	ClientVerify string
+	// Revocation list for client certificates (optional)
+	ClientCRL string
+	// Comma-separated protocols to offer via ALPN (HAProxy default if empty)
+	ALPN string
+	// Oldest TLS version to accept (HAProxy default if empty)
+	MinVersion string
+	// Cipher list for TLS up to 1.2 (HAProxy default if empty)
+	Ciphers string
+	// Cipher suites for TLS 1.3 (HAProxy default if empty)
+	CipherSuites string
 }
 
 // Backend represents an ingress backend
 type Backend struct {
 	IP   *net.IP
 	Name string
+	// Port the ingress pod listens on
+	Port int
+	// Port to send health checks to (the server's port if zero)
+	CheckPort int
+	// Time between two health checks (empty: HAProxy default)
+	CheckInterval string
+	// Number of successful health checks until the server is healthy (HAProxy default if zero)
+	CheckRise int
+	// Number of failed health checks until the server is unhealthy (HAProxy default if zero)
+	CheckFall int
+	// Time to ramp up the server's weight after it became healthy (empty: no ramp-up)
+	SlowStart string
+	// HAProxy server weight, normalized so that each cluster gets its share regardless of its number of backends
+	Weight int
+	// Whether this server only gets traffic once all non-backup servers are down
+	Backup bool
+	// Whether this server's cluster is drained. Rendered as weight 0, which is how HAProxy's drain state looks in a
+	// config file: existing connections finish, but no new ones are sent
+	Drain bool
+	// Protocol to talk to the server with ('h2'), HTTP/1.1 if empty
+	Proto string
+}
+
+// HostOptions contains per-host frontend behavior
+type HostOptions struct {
+	// Source IP ranges allowed to access the host, everybody if empty
+	AllowedSourceRanges []string
+	// Value of the Strict-Transport-Security header (empty if it shouldn't be set)
+	HSTSHeader string
+	// Maximum request body size in bytes, unlimited if zero
+	MaxBodySize int64
+	// Name of the HAProxy userlist to authenticate requests against, no authentication if empty
+	BasicAuthUserlist string
+	// Realm to use for basic authentication
+	BasicAuthRealm string
+	// Whether requests without a client certificate are denied (in case the bind doesn't require one)
+	RequireClientCert bool
+}
+
+// PathBackend sends the requests for a path of a host to another backend than the rest of the host's requests
+type PathBackend struct {
+	// Path to match, without trailing slash unless it is '/'
+	Path string
+	// Whether requests for paths below the path match as well
+	Prefix bool
+	// Name of the backend
+	Backend string
+}
+
+// BackendSettings contains per-backend behavior
+type BackendSettings struct {
+	// Value for "timeout http-request" (empty: HAProxy default)
+	RequestTimeout string
+	// Value for "timeout server" (empty: HAProxy default)
+	ResponseTimeout string
+	// HTTP path to check the servers' health with (TCP checks if empty)
+	HealthCheckPath string
+	// HTTP status the health check expects (any 2xx or 3xx if zero)
+	HealthCheckStatus int
+	// Whether the backend gets passed through TLS connections instead of HTTP requests
+	TCP bool
 }
 
 // TemplateInfo contains all information passed to the HAProxy config template
@@ -28,8 +103,28 @@ type TemplateInfo struct {
 	BackendCombinationList map[string][]Backend
 	// Map of host name to backend name
 	HostToBackend map[string]string
+	// Map of host name to the backends of its paths (only hosts whose paths are served by different clusters)
+	HostPaths map[string][]PathBackend
+	// Set of hosts whose TLS connections are passed through to their backend without decrypting them
+	PassthroughHosts map[string]bool
+	// Map of host name to its frontend behavior (only hosts with non-default behavior)
+	HostOptions map[string]HostOptions
+	// Set of hosts whose plain HTTP requests are redirected to HTTPS
+	RedirectHosts map[string]bool
+	// Map of backend name to its settings (only backends with non-default settings)
+	BackendSettings map[string]BackendSettings
 	// Default certificate to use
 	DefaultWildcardCert string
 	// List of IPs to listen on
 	IPs []*net.IP
+	// Address to forward ACME HTTP-01 challenges to (empty if ACME is disabled)
+	ACMEChallengeAddress string
+	// Header passing the client certificate's DN to the backends (empty if no certificate verifies clients)
+	ClientDNHeader string
+	// Path of the crt-list terminating all certificates on a single frontend (empty in loopback mode)
+	CrtListPath string
+	// Port of the loopback frontend using the crt-list if the SNI frontend has to pass through hosts
+	CrtListForwardPort int
+	// Whether the crt-list contains any certificate. HAProxy doesn't start with an empty one
+	CrtListUsed bool
 }
@@ -0,0 +1,175 @@
+package haproxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"math"
+)
+
+// Highest server weight HAProxy accepts
+const maxServerWeight = 256
+
+// Settings used for cluster states without matching cluster config
+var defaultClusterConfig = config.ClusterInternal{}
+
+// Get the configuration of a cluster by name
+func (h *Handler) clusterConfig(name string) *config.ClusterInternal {
+	for _, cluster := range h.config.Clusters {
+		if cluster.Name == name {
+			return cluster.ClusterInternal
+		}
+	}
+	return &defaultClusterConfig
+}
+
+// Figure out the weight of each cluster for each host. Ingress annotations override the cluster's configured weight
+func (h *Handler) computeClusterWeights(hostToClusters map[string][]string) map[string]map[string]int {
+	return h.resolveClusterSetting(hostToClusters, "weight",
+		func(cluster *config.ClusterInternal) int {
+			if cluster.Weight == nil {
+				return config.DefaultClusterWeight
+			}
+			return *cluster.Weight
+		},
+		func(ingress *state.K8RouterIngress) *int { return ingress.Weight })
+}
+
+// Figure out the priority of each cluster for each host. Ingress annotations override the cluster's configured
+// priority
+func (h *Handler) computeClusterPriorities(hostToClusters map[string][]string) map[string]map[string]int {
+	return h.resolveClusterSetting(hostToClusters, "priority",
+		func(cluster *config.ClusterInternal) int { return cluster.Priority },
+		func(ingress *state.K8RouterIngress) *int { return ingress.Priority })
+}
+
+// Resolve a per-cluster setting which may be overridden by ingress annotations for each host. If several ingresses
+// of the same cluster disagree, the highest value wins
+func (h *Handler) resolveClusterSetting(hostToClusters map[string][]string, setting string,
+	fromConfig func(*config.ClusterInternal) int, fromIngress func(*state.K8RouterIngress) *int) map[string]map[string]int {
+	hostToClusterValues := map[string]map[string]int{}
+	for host, clusters := range hostToClusters {
+		clusterValues := map[string]int{}
+		for _, cluster := range clusters {
+			clusterValues[cluster] = fromConfig(h.clusterConfig(cluster))
+			annotated := false
+			for _, ingress := range h.clusterState[cluster].Ingresses {
+				value := fromIngress(&ingress)
+				if value == nil || !containsString(ingress.Hosts, host) {
+					continue
+				}
+				if annotated && clusterValues[cluster] != *value {
+					log.WithFields(log.Fields{
+						"cluster": cluster,
+						"host":    host,
+						"ingress": ingress.Name,
+						"setting": setting,
+					}).Warning("Conflicting annotations for host, using the highest value")
+					h.reportIngressEvent(ingressEvent(cluster, &ingress, true, reasonConflictingAnnotations,
+						"The "+setting+" annotations of the ingresses for host "+host+" conflict, using the highest value"))
+				}
+				if !annotated || *value > clusterValues[cluster] {
+					clusterValues[cluster] = *value
+				}
+				annotated = true
+			}
+		}
+		hostToClusterValues[host] = clusterValues
+	}
+	return hostToClusterValues
+}
+
+// Compute the HAProxy weight of each server of each cluster so that each cluster gets its share of the traffic
+// independent of its number of backends
+func (h *Handler) computeServerWeights(clusters []string, clusterWeights map[string]int) map[string]int {
+	perServer := map[string]float64{}
+	highest := 0.0
+	for _, cluster := range clusters {
+		backends := len(h.clusterState[cluster].Backends)
+		if backends == 0 {
+			continue
+		}
+		perServer[cluster] = float64(clusterWeights[cluster]) / float64(backends)
+		highest = math.Max(highest, perServer[cluster])
+	}
+	serverWeights := map[string]int{}
+	for cluster, weight := range perServer {
+		if highest == 0 {
+			serverWeights[cluster] = 0
+			continue
+		}
+		serverWeights[cluster] = int(math.Round(weight * maxServerWeight / highest))
+		// Don't accidentally turn off clusters with a tiny share
+		if serverWeights[cluster] == 0 && weight > 0 {
+			serverWeights[cluster] = 1
+		}
+	}
+	return serverWeights
+}
+
+// Get the weights to use for a tier of clusters of a host. If none of its clusters with backends has a positive
+// weight, the host would silently return 503 for everything, so traffic is split equally instead
+func (h *Handler) effectiveClusterWeights(host string, clusters []string, clusterWeights map[string]int) map[string]int {
+	withBackends := false
+	for _, cluster := range clusters {
+		if len(h.clusterState[cluster].Backends) == 0 {
+			continue
+		}
+		if clusterWeights[cluster] > 0 {
+			return clusterWeights
+		}
+		withBackends = true
+	}
+	if !withBackends {
+		return clusterWeights
+	}
+	log.WithFields(log.Fields{
+		"host":     host,
+		"clusters": clusters,
+	}).Warning("All clusters of host have weight 0, splitting traffic equally")
+	h.reportHostEvent(host, true, reasonZeroWeights,
+		"All clusters of host "+host+" have weight 0, splitting traffic equally")
+	equalWeights := map[string]int{}
+	for _, cluster := range clusters {
+		equalWeights[cluster] = 1
+	}
+	return equalWeights
+}
+
+// Check whether all clusters have the same value for a setting
+func isUniform(clusters []string, clusterValues map[string]int) bool {
+	for _, cluster := range clusters {
+		if clusterValues[cluster] != clusterValues[clusters[0]] {
+			return false
+		}
+	}
+	return true
+}
+
+// Split clusters into the ones with the highest priority and all others
+func splitByPriority(clusters []string, clusterPriorities map[string]int) ([]string, []string) {
+	highest := clusterPriorities[clusters[0]]
+	for _, cluster := range clusters {
+		if clusterPriorities[cluster] > highest {
+			highest = clusterPriorities[cluster]
+		}
+	}
+	var primary, backup []string
+	for _, cluster := range clusters {
+		if clusterPriorities[cluster] == highest {
+			primary = append(primary, cluster)
+		} else {
+			backup = append(backup, cluster)
+		}
+	}
+	return primary, backup
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
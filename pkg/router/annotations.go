@@ -0,0 +1,186 @@
+package router
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix of all annotations k8router understands
+	annotationPrefix = "k8router.vsk8s.io/"
+	// Traffic weight of this cluster for the ingress' hosts, overrides the cluster's configured weight
+	annotationWeight = annotationPrefix + "weight"
+	// Priority of this cluster for the ingress' hosts, overrides the cluster's configured priority
+	annotationPriority = annotationPrefix + "priority"
+	// Redirect plain HTTP requests to HTTPS ("true"/"false")
+	annotationForceHTTPS = annotationPrefix + "force-https"
+	// Comma-separated list of source IP ranges allowed to access the ingress' hosts
+	annotationAllowedSourceRanges = annotationPrefix + "allowed-source-ranges"
+	// Max age of the Strict-Transport-Security header (e.g. "8760h")
+	annotationHSTSMaxAge = annotationPrefix + "hsts-max-age"
+	// Whether the Strict-Transport-Security header includes subdomains ("true"/"false")
+	annotationHSTSIncludeSubdomains = annotationPrefix + "hsts-include-subdomains"
+	// Time the client has to send its request (e.g. "30s")
+	annotationRequestTimeout = annotationPrefix + "request-timeout"
+	// Time the backend has to respond (e.g. "60s")
+	annotationResponseTimeout = annotationPrefix + "response-timeout"
+	// Maximum request body size (e.g. "10m")
+	annotationMaxBodySize = annotationPrefix + "max-body-size"
+	// Name of the HAProxy userlist to authenticate requests against
+	annotationBasicAuthUserlist = annotationPrefix + "basic-auth-userlist"
+	// Realm used for basic authentication
+	annotationBasicAuthRealm = annotationPrefix + "basic-auth-realm"
+	// Pass TLS connections for the ingress' hosts through to the cluster's TLS port without decrypting them
+	// ("true"/"false")
+	annotationSSLPassthrough = annotationPrefix + "ssl-passthrough"
+	// Client certificate verification for the ingress' hosts ("required", "optional" or "off"), overrides the
+	// certificate's setting
+	annotationClientVerify = annotationPrefix + "client-verify"
+	// Protocol to talk to the ingress pods with for the ingress' hosts ("http/1.1" or "h2"), overrides the cluster's
+	// setting
+	annotationBackendProtocol = annotationPrefix + "backend-protocol"
+)
+
+// Characters allowed in values which end up in the HAProxy config verbatim
+var haproxyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+var haproxyRealmPattern = regexp.MustCompile(`^[A-Za-z0-9_.:, -]+$`)
+
+// Parse all k8router annotations of an ingress (or route) into our representation
+func (c *Cluster) parseIngressAnnotations(annotations map[string]string, obj *state.K8RouterIngress) {
+	if value, ok := annotations[annotationWeight]; ok {
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 {
+			c.warnAboutAnnotation(obj, annotationWeight, value)
+		} else {
+			obj.Weight = &weight
+		}
+	}
+	if value, ok := annotations[annotationPriority]; ok {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			c.warnAboutAnnotation(obj, annotationPriority, value)
+		} else {
+			obj.Priority = &priority
+		}
+	}
+	obj.Options.ForceHTTPS = c.parseBoolAnnotation(annotations, obj, annotationForceHTTPS)
+	obj.Options.HSTSIncludeSubdomains = c.parseBoolAnnotation(annotations, obj, annotationHSTSIncludeSubdomains)
+	obj.Options.SSLPassthrough = c.parseBoolAnnotation(annotations, obj, annotationSSLPassthrough)
+	obj.Options.HSTSMaxAge = c.parseDurationAnnotation(annotations, obj, annotationHSTSMaxAge)
+	obj.Options.RequestTimeout = c.parseDurationAnnotation(annotations, obj, annotationRequestTimeout)
+	obj.Options.ResponseTimeout = c.parseDurationAnnotation(annotations, obj, annotationResponseTimeout)
+	if value, ok := annotations[annotationAllowedSourceRanges]; ok {
+		for _, sourceRange := range strings.Split(value, ",") {
+			sourceRange = strings.TrimSpace(sourceRange)
+			_, _, err := net.ParseCIDR(sourceRange)
+			if err != nil && net.ParseIP(sourceRange) == nil {
+				// Better deny everybody than allowing too much
+				c.warnAboutAnnotation(obj, annotationAllowedSourceRanges, value)
+				obj.Options.AllowedSourceRanges = []string{"127.0.0.1/32"}
+				break
+			}
+			obj.Options.AllowedSourceRanges = append(obj.Options.AllowedSourceRanges, sourceRange)
+		}
+	}
+	if value, ok := annotations[annotationClientVerify]; ok {
+		switch value {
+		case config.ClientVerifyRequired, config.ClientVerifyOptional, config.ClientVerifyOff:
+			obj.Options.ClientVerify = value
+		default:
+			// Better require client certificates than allowing too much
+			c.warnAboutAnnotation(obj, annotationClientVerify, value)
+			obj.Options.ClientVerify = config.ClientVerifyRequired
+		}
+	}
+	if value, ok := annotations[annotationBackendProtocol]; ok {
+		if value != config.BackendProtocolHTTP1 && value != config.BackendProtocolH2 {
+			c.warnAboutAnnotation(obj, annotationBackendProtocol, value)
+		} else {
+			obj.Options.BackendProtocol = value
+		}
+	}
+	if value, ok := annotations[annotationMaxBodySize]; ok {
+		size, err := parseSize(value)
+		if err != nil {
+			c.warnAboutAnnotation(obj, annotationMaxBodySize, value)
+		} else {
+			obj.Options.MaxBodySize = size
+		}
+	}
+	if value, ok := annotations[annotationBasicAuthUserlist]; ok {
+		if !haproxyNamePattern.MatchString(value) {
+			c.warnAboutAnnotation(obj, annotationBasicAuthUserlist, value)
+		} else {
+			obj.Options.BasicAuthUserlist = value
+			obj.Options.BasicAuthRealm = "k8router"
+		}
+	}
+	if value, ok := annotations[annotationBasicAuthRealm]; ok && obj.Options.BasicAuthUserlist != "" {
+		if !haproxyRealmPattern.MatchString(value) {
+			c.warnAboutAnnotation(obj, annotationBasicAuthRealm, value)
+		} else {
+			obj.Options.BasicAuthRealm = value
+		}
+	}
+}
+
+func (c *Cluster) parseBoolAnnotation(annotations map[string]string, obj *state.K8RouterIngress, annotation string) bool {
+	value, ok := annotations[annotation]
+	if !ok {
+		return false
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		c.warnAboutAnnotation(obj, annotation, value)
+		return false
+	}
+	return result
+}
+
+func (c *Cluster) parseDurationAnnotation(annotations map[string]string, obj *state.K8RouterIngress,
+	annotation string) time.Duration {
+	value, ok := annotations[annotation]
+	if !ok {
+		return 0
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil || result < 0 {
+		c.warnAboutAnnotation(obj, annotation, value)
+		return 0
+	}
+	return result
+}
+
+// Parse a size like "10m" (suffixes k, m and g are powers of 1024)
+func parseSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for suffix, factor := range map[string]int64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = factor
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return size * multiplier, nil
+}
+
+func (c *Cluster) warnAboutAnnotation(obj *state.K8RouterIngress, annotation string, value string) {
+	log.WithFields(log.Fields{
+		"cluster":    c.config.Name,
+		"ingress":    obj.Name,
+		"annotation": annotation,
+		"value":      value,
+	}).Warning("Ignoring invalid annotation")
+	c.recordInvalidAnnotation(obj, annotation, value)
+}
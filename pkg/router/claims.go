@@ -0,0 +1,71 @@
+package router
+
+import (
+	log "github.com/sirupsen/logrus"
+	v1coreapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"strings"
+)
+
+// Namespace annotation containing a comma-separated list of host patterns the namespace's ingresses may claim
+const annotationAllowedHosts = annotationPrefix + "allowed-hosts"
+
+// Hosts claimed by a namespace
+type namespaceClaims struct {
+	namespace string
+	hosts     []string
+}
+
+// Take care of namespace events from the namespace watch
+func (c *Cluster) handleNamespaceEvent(event interface{}, action watch.EventType) {
+	eventObj, ok := unwrapTombstone(event).(*v1coreapi.Namespace)
+	if !ok {
+		log.WithFields(log.Fields{
+			"cluster": c.config.Name,
+		}).Error("Got event in namespace handler which contains no namespace")
+		return
+	}
+	claims := namespaceClaims{namespace: eventObj.Name}
+	if action != watch.Deleted {
+		claims.hosts = parseHostList(eventObj.Annotations[annotationAllowedHosts])
+	}
+	c.namespaceEvents <- claims
+}
+
+// Parse a comma-separated list of hosts
+func parseHostList(value string) []string {
+	var hosts []string
+	for _, host := range strings.Split(value, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Apply changed namespace claims to the current cluster view. Returns whether any ingress changed
+func (c *Cluster) applyNamespaceClaims(claims namespaceClaims) bool {
+	if strings.Join(c.namespaceClaims[claims.namespace], ",") == strings.Join(claims.hosts, ",") {
+		return false
+	}
+	if len(claims.hosts) == 0 {
+		delete(c.namespaceClaims, claims.namespace)
+	} else {
+		c.namespaceClaims[claims.namespace] = claims.hosts
+		log.WithFields(log.Fields{
+			"cluster":   c.config.Name,
+			"namespace": claims.namespace,
+			"hosts":     claims.hosts,
+		}).Info("Namespace claims hosts")
+	}
+	changed := false
+	for _, ingress := range c.currentClusterState.Ingresses {
+		if ingress.Namespace == claims.namespace {
+			ingress.NamespaceClaims = claims.hosts
+			c.currentClusterState.AddIngress(ingress)
+			changed = true
+		}
+	}
+	return changed
+}
@@ -1,20 +1,31 @@
 package router
 
 import (
+	"bytes"
+	"crypto/tls"
 	log "github.com/sirupsen/logrus"
 	"github.com/vsk8s/k8router/pkg/config"
 	"github.com/vsk8s/k8router/pkg/state"
 	v1coreapi "k8s.io/api/core/v1"
 	v1beta1extensionsapi "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
 	"net"
+	"sort"
 	"time"
 )
 
+// Time to collect further events before publishing a new snapshot of the cluster state
+const snapshotDebounce = 100 * time.Millisecond
+
+// Number of events the informers can queue up while the aggregator is busy
+const eventBufferSize = 64
+
 // Cluster handles all single-cluster related tasks
 type Cluster struct {
 	config config.Cluster
@@ -23,14 +34,40 @@ type Cluster struct {
 
 	backendEvents chan state.BackendChange
 
+	certificateEvents chan state.CertificateChange
+
+	namespaceEvents chan namespaceClaims
+
+	// Objects which exist after reconnecting
+	liveObjectEvents chan liveObjects
+
+	gatewayAPIEvents chan gatewayAPIChange
+
+	// Route status to write, only consumed while connected
+	routeStatusQueue chan routeStatusUpdate
+
+	// Gateways of our GatewayClass and routes by kind, namespace and name, only used by the aggregator
+	gateways map[string]gateway
+	routes   map[string]watchedRoute
+
+	// Posts Kubernetes Events on ingresses
+	events *eventRecorder
+
+	// Host patterns claimed by namespaces, only used by the aggregator
+	namespaceClaims map[string][]string
+
 	// Channel used to indicate connection issues and clear all state
 	clearChannel chan bool
 
 	// Channel used to stop the aggregator logic
 	aggregatorStopChannel chan bool
 
+	// Current view of the cluster, only used by the aggregator
 	currentClusterState state.ClusterState
 
+	// Generation of the latest published snapshot of the cluster state
+	generation uint64
+
 	// Whether we want to stop right now
 	shallExit bool
 
@@ -41,9 +78,11 @@ type Cluster struct {
 
 	readinessChannel chan bool
 
-	knownIngresses map[string]state.K8RouterIngress
+	// Secret name to certificate for all valid TLS secrets, only used by the aggregator
+	knownCertificates map[string]state.K8RouterCertificate
 
-	knownPods map[string]state.K8RouterBackend
+	// Secrets referenced by ingresses which are missing or invalid, only used by the aggregator
+	missingSecrets map[string]bool
 
 	isFirstConnectionAttempt bool
 
@@ -53,25 +92,44 @@ type Cluster struct {
 
 	// Clientset used for the informer API
 	client kubernetes.Interface
+
+	// Client used for the Gateway API
+	dynamicClient dynamic.Interface
+
+	// Which objects to watch
+	scope watchScope
+
+	// Fingerprint of the files the current connection was built from
+	connectionFingerprint string
 }
 
 // Initialize a new cluster
 func Initialize(config config.Cluster, clusterStateChannel chan state.ClusterState, loadBalancerChannel chan state.LoadBalancerChange) *Cluster {
 	obj := Cluster{
 		config:                   config,
-		ingressEvents:            make(chan state.IngressChange, 2),
-		backendEvents:            make(chan state.BackendChange, 2),
+		ingressEvents:            make(chan state.IngressChange, eventBufferSize),
+		backendEvents:            make(chan state.BackendChange, eventBufferSize),
+		certificateEvents:        make(chan state.CertificateChange, eventBufferSize),
+		namespaceEvents:          make(chan namespaceClaims, eventBufferSize),
+		liveObjectEvents:         make(chan liveObjects, 1),
+		gatewayAPIEvents:         make(chan gatewayAPIChange, eventBufferSize),
+		routeStatusQueue:         make(chan routeStatusUpdate, eventBufferSize),
+		gateways:                 map[string]gateway{},
+		routes:                   map[string]watchedRoute{},
+		namespaceClaims:          map[string][]string{},
 		clusterStateChannel:      clusterStateChannel,
 		loadBalancerChannel:      loadBalancerChannel,
 		readinessChannel:         make(chan bool, 2),
 		clearChannel:             make(chan bool, 2),
 		aggregatorStopChannel:    make(chan bool, 2),
 		shallExit:                false,
-		knownIngresses:           map[string]state.K8RouterIngress{},
-		knownPods:                map[string]state.K8RouterBackend{},
+		knownCertificates:        map[string]state.K8RouterCertificate{},
+		missingSecrets:           map[string]bool{},
 		isFirstConnectionAttempt: true,
 	}
-	obj.currentClusterState.Name = config.Name
+	obj.currentClusterState = state.NewClusterState(config.Name)
+	obj.scope = newWatchScope(config.ClusterInternal)
+	obj.events = newEventRecorder()
 	return &obj
 }
 
@@ -137,84 +195,285 @@ func (c *Cluster) eventLoop() {
 	close(c.readinessChannel)
 	close(c.ingressEvents)
 	close(c.backendEvents)
+	close(c.certificateEvents)
 	log.WithField("cluster", c.config.Name).Debug("Work loop done")
 }
 
-// Aggregate all changes into a new cluster view
+// Aggregate all changes into a new cluster view. Bursts of events are coalesced into a single snapshot per debounce
+// window. Publishing snapshots doesn't block, so events keep being processed while the consumer is busy and it gets
+// the latest snapshot once it's ready
 func (c *Cluster) aggregateClusterView() {
+	debounce := time.NewTimer(snapshotDebounce)
+	debounce.Stop()
+	debouncing := false
+	changed := false
+	// Only set while a snapshot is waiting to be published
+	var publish chan state.ClusterState
+	var snapshot state.ClusterState
+	markChanged := func() {
+		changed = true
+		if !debouncing {
+			debounce.Reset(snapshotDebounce)
+			debouncing = true
+		}
+	}
 	for {
 		select {
 		case event := <-c.ingressEvents:
-			if event.Created {
-				c.currentClusterState.Ingresses = append(c.currentClusterState.Ingresses, event.Ingress)
-				log.WithFields(log.Fields{
-					"cluster": c.config.Name,
-					"ingress": event.Ingress.Name,
-				}).Info("Detected new ingress.")
-			} else {
-				for i, ingress := range c.currentClusterState.Ingresses {
-					if ingress.Name == event.Ingress.Name {
-						c.currentClusterState.Ingresses[i] = c.currentClusterState.Ingresses[len(c.currentClusterState.Ingresses)-1]
-						c.currentClusterState.Ingresses = c.currentClusterState.Ingresses[:len(c.currentClusterState.Ingresses)-1]
-						log.WithFields(log.Fields{
-							"cluster": c.config.Name,
-							"ingress": event.Ingress.Name,
-						}).Info("Removed old ingress.")
-						break
-					}
-				}
+			if c.applyIngressChange(event) {
+				markChanged()
 			}
-			c.clusterStateChannel <- c.currentClusterState
 		case event := <-c.backendEvents:
+			if c.applyBackendChange(event) {
+				markChanged()
+			}
+		case event := <-c.certificateEvents:
 			if event.Created {
-				c.currentClusterState.Backends = append(c.currentClusterState.Backends, event.Backend)
-				log.WithFields(log.Fields{
-					"cluster": c.config.Name,
-					"backend": event.Backend.Name,
-					"ip":      event.Backend.IP,
-				}).Info("Detected new backend pod.")
+				c.knownCertificates[event.Certificate.Name] = event.Certificate
 			} else {
-				log.WithFields(log.Fields{
-					"cluster": c.config.Name,
-					"backend": event.Backend.Name,
-					"ip":      event.Backend.IP,
-				}).Debug("Detected backend pod removal, searching...")
-				for i, backend := range c.currentClusterState.Backends {
-					if backend.Name == event.Backend.Name {
-						c.currentClusterState.Backends[i] = c.currentClusterState.Backends[len(c.currentClusterState.Backends)-1]
-						c.currentClusterState.Backends = c.currentClusterState.Backends[:len(c.currentClusterState.Backends)-1]
-						log.WithFields(log.Fields{
-							"cluster": c.config.Name,
-							"backend": event.Backend.Name,
-							"ip":      event.Backend.IP,
-						}).Info("Removed old backend pod.")
-						break
-					}
-				}
+				delete(c.knownCertificates, event.Certificate.Name)
+			}
+			if c.updateCertificates() {
+				markChanged()
+			}
+		case claims := <-c.namespaceEvents:
+			if c.applyNamespaceClaims(claims) {
+				markChanged()
+			}
+		case change := <-c.gatewayAPIEvents:
+			if c.applyGatewayAPIChange(change) {
+				markChanged()
 			}
-			c.clusterStateChannel <- c.currentClusterState
+		case objects := <-c.liveObjectEvents:
+			if c.removeStaleObjects(objects) {
+				markChanged()
+			}
+		case _ = <-debounce.C:
+			debouncing = false
+			if changed {
+				changed = false
+				c.generation++
+				snapshot = c.currentClusterState.Copy()
+				snapshot.Generation = c.generation
+				publish = c.clusterStateChannel
+			}
+		case publish <- snapshot:
+			publish = nil
 		case _ = <-c.aggregatorStopChannel:
+			debounce.Stop()
 			return
 		case _ = <-c.clearChannel:
 			log.WithFields(log.Fields{
 				"cluster": c.config.Name,
 			}).Debug("Clearing full cluster state...")
-			c.currentClusterState.Backends = nil
-			c.currentClusterState.Ingresses = nil
-			c.clusterStateChannel <- c.currentClusterState
+			c.currentClusterState = state.NewClusterState(c.config.Name)
+			c.knownCertificates = map[string]state.K8RouterCertificate{}
+			c.namespaceClaims = map[string][]string{}
+			c.missingSecrets = map[string]bool{}
+			c.gateways = map[string]gateway{}
+			c.routes = map[string]watchedRoute{}
+			markChanged()
 		}
 	}
 }
 
+// Objects which exist in the cluster, by their name in the cluster view
+type liveObjects struct {
+	backends  map[string]bool
+	ingresses map[string]bool
+	// Gateways and routes by their key
+	gatewayAPI map[string]bool
+}
+
+// Collect the objects of the informer stores
+func collectLiveObjects(podStore cache.Store, ingressStores []cache.Store,
+	gatewayAPIStores map[string][]cache.Store) liveObjects {
+	objects := liveObjects{backends: map[string]bool{}, ingresses: map[string]bool{}, gatewayAPI: map[string]bool{}}
+	for _, obj := range podStore.List() {
+		if pod, ok := obj.(*v1coreapi.Pod); ok {
+			objects.backends[pod.Name] = true
+		}
+	}
+	for _, store := range ingressStores {
+		for _, obj := range store.List() {
+			if ingress, ok := obj.(*v1beta1extensionsapi.Ingress); ok {
+				objects.ingresses[ingress.Namespace+"-"+ingress.Name] = true
+			}
+		}
+	}
+	for kind, stores := range gatewayAPIStores {
+		for _, store := range stores {
+			for _, obj := range store.List() {
+				if accessor, err := meta.Accessor(obj); err == nil {
+					objects.gatewayAPI[gatewayAPIKey(kind, accessor.GetNamespace(), accessor.GetName())] = true
+				}
+			}
+		}
+	}
+	return objects
+}
+
+// Remove ingresses, backends and Gateway API objects which don't exist anymore from the current cluster view. Returns
+// whether anything changed
+func (c *Cluster) removeStaleObjects(objects liveObjects) bool {
+	changed := false
+	for name, ingress := range c.currentClusterState.Ingresses {
+		if ingress.Kind == "" && !objects.ingresses[name] {
+			changed = c.applyIngressChange(state.IngressChange{Ingress: ingress, Created: false}) || changed
+		}
+	}
+	for name, backend := range c.currentClusterState.Backends {
+		if !objects.backends[name] {
+			changed = c.applyBackendChange(state.BackendChange{Backend: backend, Created: false}) || changed
+		}
+	}
+	staleGatewayAPIObjects := false
+	for key := range c.gateways {
+		if !objects.gatewayAPI[key] {
+			delete(c.gateways, key)
+			staleGatewayAPIObjects = true
+		}
+	}
+	for key := range c.routes {
+		if !objects.gatewayAPI[key] {
+			delete(c.routes, key)
+			staleGatewayAPIObjects = true
+		}
+	}
+	if staleGatewayAPIObjects {
+		changed = c.updateRoutes() || changed
+	}
+	return changed
+}
+
+// Apply an ingress change to the current cluster view. Returns whether anything changed
+func (c *Cluster) applyIngressChange(event state.IngressChange) bool {
+	if event.Created {
+		event.Ingress.NamespaceClaims = c.namespaceClaims[event.Ingress.Namespace]
+	}
+	current, known := c.currentClusterState.Ingresses[event.Ingress.Name]
+	entry := log.WithFields(log.Fields{
+		"cluster": c.config.Name,
+		"ingress": event.Ingress.Name,
+	})
+	switch {
+	case !event.Created && !known:
+		return false
+	case !event.Created:
+		delete(c.currentClusterState.Ingresses, event.Ingress.Name)
+		entry.Info("Removed old ingress.")
+	case known && state.IsIngressEquivalent(&current, &event.Ingress):
+		return false
+	case known:
+		c.currentClusterState.AddIngress(event.Ingress)
+		entry.Info("Detected ingress change.")
+	default:
+		c.currentClusterState.AddIngress(event.Ingress)
+		entry.Info("Detected new ingress.")
+	}
+	c.updateCertificates()
+	return true
+}
+
+// Apply a backend change to the current cluster view. Returns whether anything changed
+func (c *Cluster) applyBackendChange(event state.BackendChange) bool {
+	current, known := c.currentClusterState.Backends[event.Backend.Name]
+	entry := log.WithFields(log.Fields{
+		"cluster": c.config.Name,
+		"backend": event.Backend.Name,
+		"ip":      event.Backend.IP,
+	})
+	switch {
+	case !event.Created && !known:
+		return false
+	case !event.Created:
+		delete(c.currentClusterState.Backends, event.Backend.Name)
+		entry.Info("Removed old backend pod.")
+	case known && state.IsBackendEquivalent(&current, &event.Backend):
+		return false
+	case known:
+		c.currentClusterState.AddBackend(event.Backend)
+		entry.Info("Detected backend pod change.")
+	default:
+		c.currentClusterState.AddBackend(event.Backend)
+		entry.Info("Detected new backend pod.")
+	}
+	return true
+}
+
+// Join the TLS blocks of all ingresses with the known TLS secrets. Returns whether the certificates changed
+func (c *Cluster) updateCertificates() bool {
+	if !c.config.SyncTLSSecrets {
+		return false
+	}
+	secretToHosts := map[string][]string{}
+	for _, ingress := range c.currentClusterState.Ingresses {
+		for _, tlsBlock := range ingress.TLS {
+			secretToHosts[tlsBlock.SecretName] = append(secretToHosts[tlsBlock.SecretName], tlsBlock.Hosts...)
+		}
+	}
+	var secretNames []string
+	for secretName := range secretToHosts {
+		secretNames = append(secretNames, secretName)
+	}
+	sort.Strings(secretNames)
+
+	certificates := map[string]state.K8RouterCertificate{}
+	missingSecrets := map[string]bool{}
+	for _, secretName := range secretNames {
+		certificate, ok := c.knownCertificates[secretName]
+		if !ok {
+			missingSecrets[secretName] = true
+			if !c.missingSecrets[secretName] {
+				log.WithFields(log.Fields{
+					"cluster": c.config.Name,
+					"secret":  secretName,
+					"hosts":   secretToHosts[secretName],
+				}).Warning("TLS secret referenced by ingress is missing or invalid")
+			}
+			continue
+		}
+		hosts := secretToHosts[secretName]
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			if len(certificate.Hosts) == 0 || certificate.Hosts[len(certificate.Hosts)-1] != host {
+				certificate.Hosts = append(certificate.Hosts, host)
+			}
+		}
+		certificates[secretName] = certificate
+	}
+	c.missingSecrets = missingSecrets
+	changed := len(certificates) != len(c.currentClusterState.Certificates)
+	for name, certificate := range certificates {
+		current, ok := c.currentClusterState.Certificates[name]
+		if !ok || !state.IsCertificateEquivalent(&current, &certificate) {
+			changed = true
+		}
+	}
+	c.currentClusterState.Certificates = certificates
+	return changed
+}
+
 // Setup watchers and coordinate their goroutines
 func (c *Cluster) watch() error {
 	log.WithField("cluster", c.config.Name).Debug("Adding watches")
 
-	factory := informers.NewSharedInformerFactory(c.client, 0)
+	var gatewayAPIKinds map[string]bool
+	if c.config.GatewayClass != "" {
+		var err error
+		gatewayAPIKinds, err = c.installedGatewayAPIKinds()
+		if err != nil {
+			return err
+		}
+	}
+
 	stopper := make(chan struct{})
 	defer close(stopper)
 
-	podInformer := factory.Core().V1().Pods().Informer()
+	podInformer := c.scope.podInformerFactory(c.client, c.config.IngressNamespace).Core().V1().Pods().Informer()
+	podStore := podInformer.GetStore()
+	var ingressStores []cache.Store
+	synced := []cache.InformerSynced{podInformer.HasSynced}
 	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    func(obj interface{}) { c.handlePodEvents(obj, watch.Added) },
 		DeleteFunc: func(obj interface{}) { c.handlePodEvents(obj, watch.Deleted) },
@@ -222,27 +481,88 @@ func (c *Cluster) watch() error {
 	})
 	go podInformer.Run(stopper)
 
-	ingressInformer := factory.Extensions().V1beta1().Ingresses().Informer()
-	ingressInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    func(obj interface{}) { c.handleIngressEvent(obj, watch.Added) },
-		DeleteFunc: func(obj interface{}) { c.handleIngressEvent(obj, watch.Deleted) },
-		UpdateFunc: func(old interface{}, new interface{}) { c.handleIngressEvent(new, watch.Modified) },
-	})
-	go ingressInformer.Run(stopper)
+	for _, factory := range c.scope.informerFactories(c.client, c.scope.ingressSelector) {
+		ingressInformer := factory.Extensions().V1beta1().Ingresses().Informer()
+		ingressStores = append(ingressStores, ingressInformer.GetStore())
+		synced = append(synced, ingressInformer.HasSynced)
+		ingressInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.handleIngressEvent(obj, watch.Added) },
+			DeleteFunc: func(obj interface{}) { c.handleIngressEvent(obj, watch.Deleted) },
+			UpdateFunc: func(old interface{}, new interface{}) { c.handleIngressEvent(new, watch.Modified) },
+		})
+		go ingressInformer.Run(stopper)
+	}
 
-	LoadBalancerInformer := factory.Core().V1().Services().Informer()
-	LoadBalancerInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    func(obj interface{}) { c.handleLoadBalancerEvent(obj, watch.Added) },
-		DeleteFunc: func(obj interface{}) { c.handleLoadBalancerEvent(obj, watch.Deleted) },
-		UpdateFunc: func(old interface{}, new interface{}) { c.handleLoadBalancerEvent(new, watch.Modified) },
-	})
-	go LoadBalancerInformer.Run(stopper)
+	for _, factory := range c.scope.informerFactories(c.client, c.scope.serviceSelector) {
+		LoadBalancerInformer := factory.Core().V1().Services().Informer()
+		LoadBalancerInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.handleLoadBalancerEvent(obj, watch.Added) },
+			DeleteFunc: func(obj interface{}) { c.handleLoadBalancerEvent(obj, watch.Deleted) },
+			UpdateFunc: func(old interface{}, new interface{}) { c.handleLoadBalancerEvent(new, watch.Modified) },
+		})
+		go LoadBalancerInformer.Run(stopper)
+	}
+
+	if c.config.SyncTLSSecrets {
+		for _, factory := range c.scope.informerFactories(c.client, labels.Everything()) {
+			secretInformer := factory.Core().V1().Secrets().Informer()
+			secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(obj interface{}) { c.handleSecretEvent(obj, watch.Added) },
+				DeleteFunc: func(obj interface{}) { c.handleSecretEvent(obj, watch.Deleted) },
+				UpdateFunc: func(old interface{}, new interface{}) { c.handleSecretEvent(new, watch.Modified) },
+			})
+			go secretInformer.Run(stopper)
+		}
+	}
+
+	var gatewayAPIStores map[string][]cache.Store
+	if c.config.GatewayClass != "" {
+		gatewayAPIStores, synced = c.watchGatewayAPI(stopper, gatewayAPIKinds, synced)
+	}
+
+	if c.config.NamespaceHostClaims {
+		namespaceInformer := informers.NewSharedInformerFactory(c.client, 0).Core().V1().Namespaces().Informer()
+		namespaceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.handleNamespaceEvent(obj, watch.Added) },
+			DeleteFunc: func(obj interface{}) { c.handleNamespaceEvent(obj, watch.Deleted) },
+			UpdateFunc: func(old interface{}, new interface{}) { c.handleNamespaceEvent(new, watch.Modified) },
+		})
+		go namespaceInformer.Run(stopper)
+	}
 
 	if c.isFirstConnectionAttempt {
 		c.readinessChannel <- true
 		c.isFirstConnectionAttempt = false
+	} else {
+		// Objects deleted while we weren't connected are still part of the cluster view
+		go func() {
+			if !cache.WaitForCacheSync(stopper, synced...) {
+				return
+			}
+			select {
+			case c.liveObjectEvents <- collectLiveObjects(podStore, ingressStores, gatewayAPIStores):
+			case _ = <-stopper:
+			}
+		}()
+	}
+	eventWatch := c.events.broadcaster.StartRecordingToSink(&eventSink{client: c.client})
+	defer eventWatch.Stop()
+
+	connectionChecks := time.NewTicker(connectionCheckInterval)
+	defer connectionChecks.Stop()
+	for running := true; running; {
+		select {
+		case _ = <-connectionChecks.C:
+			if c.connectionFingerprint != "" && c.connectionFingerprint != connectionFingerprint(c.config.ClusterInternal) {
+				log.WithField("cluster", c.config.Name).Info("Connection settings changed, reconnecting")
+				running = false
+			}
+		case update := <-c.routeStatusQueue:
+			c.writeRouteStatus(update)
+		case _ = <-c.aggregatorStopChannel:
+			running = false
+		}
 	}
-	<-c.aggregatorStopChannel
 	log.WithField("cluster", c.config.Name).Debug("Waiting for watches to exit...")
 
 	log.WithFields(log.Fields{
@@ -258,50 +578,45 @@ func (c *Cluster) handlePodEvents(event interface{}, action watch.EventType) {
 		"cluster": c.config.Name,
 		"obj":     event,
 	}).Debug("Pod event handler tick")
-	eventObj, ok := event.(*v1coreapi.Pod)
-	if eventObj.Namespace != c.config.IngressNamespace {
-		return
-	}
+	eventObj, ok := unwrapTombstone(event).(*v1coreapi.Pod)
 	if !ok {
 		log.WithFields(log.Fields{
 			"cluster": c.config.Name,
 		}).Error("Got event in pod handler which does not contain a pod?")
 		return
 	}
-	c.latestPodVersion = eventObj.ResourceVersion
-	ip := net.ParseIP(eventObj.Status.PodIP)
-	if ip == nil {
-		log.WithFields(log.Fields{
-			"cluster": c.config.Name,
-			"pod":     eventObj.Name,
-			"ip":      eventObj.Status.PodIP,
-		}).Error("Couldn't parse pod ip")
+	if eventObj.Namespace != c.config.IngressNamespace {
 		return
 	}
-	obj := state.K8RouterBackend{
-		IP:   &ip,
-		Name: eventObj.Name,
+	if action != watch.Deleted && !c.scope.podSelector.Matches(labels.Set(eventObj.Labels)) {
+		// The pod's labels changed, it's no ingress pod anymore
+		action = watch.Deleted
 	}
+	c.latestPodVersion = eventObj.ResourceVersion
 	myEvent := state.BackendChange{
-		Backend: obj,
+		Backend: state.K8RouterBackend{
+			Name: eventObj.Name,
+		},
 		Created: false,
 	}
 	switch action {
 	case watch.Deleted:
-		delete(c.knownPods, eventObj.Namespace+"-"+eventObj.Name)
-		c.backendEvents <- myEvent
-	case watch.Modified:
 		c.backendEvents <- myEvent
-		myEvent.Created = true
-		c.backendEvents <- myEvent
-		c.knownPods[eventObj.Namespace+"-"+eventObj.Name] = obj
-	case watch.Added:
-		val, ok := c.knownPods[eventObj.Namespace+"-"+eventObj.Name]
-		if !ok || !state.IsBackendEquivalent(&obj, &val) {
-			myEvent.Created = true
+	case watch.Added, watch.Modified:
+		ip := net.ParseIP(eventObj.Status.PodIP)
+		if ip == nil {
+			// Pods don't have an IP until they're scheduled and lose it once they're done
+			log.WithFields(log.Fields{
+				"cluster": c.config.Name,
+				"pod":     eventObj.Name,
+				"ip":      eventObj.Status.PodIP,
+			}).Debug("Pod has no IP")
 			c.backendEvents <- myEvent
+			return
 		}
-		c.knownPods[eventObj.Namespace+"-"+eventObj.Name] = obj
+		myEvent.Backend.IP = &ip
+		myEvent.Created = true
+		c.backendEvents <- myEvent
 	default:
 		log.WithFields(log.Fields{
 			"cluster": c.config.Name,
@@ -311,7 +626,7 @@ func (c *Cluster) handlePodEvents(event interface{}, action watch.EventType) {
 
 // Take care of ingress events from the ingress watch
 func (c *Cluster) handleIngressEvent(event interface{}, action watch.EventType) {
-	eventObj, ok := event.(*v1beta1extensionsapi.Ingress)
+	eventObj, ok := unwrapTombstone(event).(*v1beta1extensionsapi.Ingress)
 	if !ok {
 		if action != watch.Error {
 			log.WithFields(log.Fields{
@@ -325,6 +640,13 @@ func (c *Cluster) handleIngressEvent(event interface{}, action watch.EventType)
 		}
 		return
 	}
+	if !c.scope.namespaceWatched(eventObj.Namespace) {
+		return
+	}
+	if action != watch.Deleted && !c.scope.ingressSelector.Matches(labels.Set(eventObj.Labels)) {
+		// The ingress' labels changed, so it isn't watched anymore
+		action = watch.Deleted
+	}
 	c.latestIngressVersion = eventObj.ResourceVersion
 	switch action {
 	case watch.Deleted:
@@ -335,36 +657,92 @@ func (c *Cluster) handleIngressEvent(event interface{}, action watch.EventType)
 			},
 			Created: false,
 		}
-		delete(c.knownIngresses, event.Ingress.Name)
 		c.ingressEvents <- event
-	case watch.Modified:
-	case watch.Added:
+	case watch.Added, watch.Modified:
 		obj := state.K8RouterIngress{
-			Name:  eventObj.Namespace + "-" + eventObj.Name,
-			Hosts: []string{},
+			Name:       eventObj.Namespace + "-" + eventObj.Name,
+			Namespace:  eventObj.Namespace,
+			ObjectName: eventObj.Name,
+			Hosts:      []string{},
 		}
 		for _, rule := range eventObj.Spec.Rules {
 			obj.Hosts = append(obj.Hosts, rule.Host)
 		}
-		myEvent := state.IngressChange{
-			Ingress: obj,
-			Created: false,
+		c.parseIngressAnnotations(eventObj.Annotations, &obj)
+		for _, tlsBlock := range eventObj.Spec.TLS {
+			if tlsBlock.SecretName == "" {
+				continue
+			}
+			obj.TLS = append(obj.TLS, state.K8RouterIngressTLS{
+				Hosts:      tlsBlock.Hosts,
+				SecretName: eventObj.Namespace + "/" + tlsBlock.SecretName,
+			})
 		}
-		val, _ := c.knownIngresses[obj.Name]
-		isEquivalent := ok && state.IsIngressEquivalent(&obj, &val)
-		if action == watch.Modified && !isEquivalent {
-			c.ingressEvents <- myEvent
+		c.ingressEvents <- state.IngressChange{
+			Ingress: obj,
+			Created: true,
 		}
-		if !isEquivalent {
-			myEvent.Created = true
-			c.ingressEvents <- myEvent
+	}
+}
+
+// Take care of TLS secret events from the secret watch
+func (c *Cluster) handleSecretEvent(event interface{}, action watch.EventType) {
+	eventObj, ok := unwrapTombstone(event).(*v1coreapi.Secret)
+	if !ok {
+		log.WithFields(log.Fields{
+			"cluster": c.config.Name,
+		}).Error("Got event in secret handler which contains no secret")
+		return
+	}
+	if eventObj.Type != v1coreapi.SecretTypeTLS || !c.scope.namespaceWatched(eventObj.Namespace) {
+		return
+	}
+	myEvent := state.CertificateChange{
+		Certificate: state.K8RouterCertificate{
+			Name: eventObj.Namespace + "/" + eventObj.Name,
+		},
+		Created: action != watch.Deleted,
+	}
+	if myEvent.Created {
+		combined, err := combineTLSSecret(eventObj)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"cluster": c.config.Name,
+				"secret":  myEvent.Certificate.Name,
+			}).WithError(err).Warning("Ignoring invalid TLS secret")
+			myEvent.Created = false
 		}
-		c.knownIngresses[obj.Name] = obj
+		myEvent.Certificate.PEM = combined
+	}
+	c.certificateEvents <- myEvent
+}
+
+// Get the last known state of objects whose deletion was missed while the watch was disconnected
+func unwrapTombstone(event interface{}) interface{} {
+	if tombstone, ok := event.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
 	}
+	return event
+}
+
+// Concatenate certificate chain and key of a TLS secret after making sure they actually fit together
+func combineTLSSecret(secret *v1coreapi.Secret) ([]byte, error) {
+	cert := bytes.TrimSpace(secret.Data[v1coreapi.TLSCertKey])
+	key := bytes.TrimSpace(secret.Data[v1coreapi.TLSPrivateKeyKey])
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return nil, err
+	}
+	// Don't append to the secret's buffers, they're shared with the informer cache
+	var combined bytes.Buffer
+	combined.Write(cert)
+	combined.WriteByte('\n')
+	combined.Write(key)
+	combined.WriteByte('\n')
+	return combined.Bytes(), nil
 }
 
 func (c *Cluster) handleLoadBalancerEvent(event interface{}, action watch.EventType) {
-	eventObj, ok := event.(*v1coreapi.Service)
+	eventObj, ok := unwrapTombstone(event).(*v1coreapi.Service)
 	if !ok {
 		if action != watch.Error {
 			log.WithFields(log.Fields{
@@ -378,9 +756,13 @@ func (c *Cluster) handleLoadBalancerEvent(event interface{}, action watch.EventT
 		}
 		return
 	}
-	if eventObj.Spec.Type != "LoadBalancer" {
+	if eventObj.Spec.Type != "LoadBalancer" || !c.scope.namespaceWatched(eventObj.Namespace) {
 		return
 	}
+	if action != watch.Deleted && !c.scope.serviceSelector.Matches(labels.Set(eventObj.Labels)) {
+		// The service's labels changed, so it isn't watched anymore
+		action = watch.Deleted
+	}
 
 	for _, port := range eventObj.Spec.Ports {
 		ip := net.ParseIP(eventObj.Spec.ClusterIP)
@@ -422,15 +804,16 @@ func (c *Cluster) handleLoadBalancerEvent(event interface{}, action watch.EventT
 }
 
 func (c *Cluster) connect() error {
-	kubeConfig, err := clientcmd.LoadFromFile(c.config.Kubeconfig)
+	c.connectionFingerprint = connectionFingerprint(c.config.ClusterInternal)
+	restConfig, err := clientConfig(c.config.ClusterInternal)
 	if err != nil {
 		return err
 	}
-	clientConfig, err := clientcmd.NewDefaultClientConfig(*kubeConfig, &clientcmd.ConfigOverrides{}).ClientConfig()
+	c.client, err = kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		return err
 	}
-	c.client, err = kubernetes.NewForConfig(clientConfig)
+	c.dynamicClient, err = dynamic.NewForConfig(restConfig)
 	if err != nil {
 		return err
 	}
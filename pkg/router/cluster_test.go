@@ -2,42 +2,74 @@ package router
 
 import (
 	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/certificate/certificatetest"
 	"github.com/vsk8s/k8router/pkg/config"
 	"github.com/vsk8s/k8router/pkg/state"
 	v1coreapi "k8s.io/api/core/v1"
 	v1beta1extensionsapi "k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 	"strconv"
 	"testing"
+	"time"
 )
 
 // Get a fake kubernetes client and a cluster handler which are linked to each other
-func createFakeClientsetAndUUT(t *testing.T, objects ...runtime.Object) (*fake.Clientset, *Cluster) {
+func createFakeClientsetAndUUT(t testing.TB, objects ...runtime.Object) (*fake.Clientset, *Cluster) {
+	cfg := config.ClusterInternal{
+		Name:             "fake",
+		IngressNamespace: "ingress-nginx",
+	}
+	return createFakeClientsetAndUUTWithConfig(t, cfg, objects...)
+}
+
+// Same as createFakeClientsetAndUUT, but with a custom cluster config
+func createFakeClientsetAndUUTWithConfig(t testing.TB, cfg config.ClusterInternal, objects ...runtime.Object) (*fake.Clientset, *Cluster) {
 	objects = append(objects, &v1coreapi.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "ingress-nginx",
 		},
 	})
-	client := fake.NewSimpleClientset(objects...)
+	// Gateway API objects are served by the dynamic client
+	var typedObjects []runtime.Object
+	var dynamicObjects []*unstructured.Unstructured
+	for _, obj := range objects {
+		if dynamicObj, ok := obj.(*unstructured.Unstructured); ok {
+			dynamicObjects = append(dynamicObjects, dynamicObj)
+		} else {
+			typedObjects = append(typedObjects, obj)
+		}
+	}
+	client := fake.NewSimpleClientset(typedObjects...)
+	client.Resources = gatewayAPIResourceLists(kindGateway, kindHTTPRoute, kindTLSRoute)
+	// The fake guesses resources from kinds ("gatewaies"), so objects are created with their actual resource
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	for _, obj := range dynamicObjects {
+		_, err := dynamicClient.Resource(gatewayAPIResources[obj.GetKind()]).Namespace(obj.GetNamespace()).
+			Create(obj, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 	clusterStateChannel := make(chan state.ClusterState)
 	loadBalancerChannel := make(chan state.LoadBalancerChange)
-	cfg := config.ClusterInternal{
-		Name:             "fake",
-		IngressNamespace: "ingress-nginx",
-	}
 	uut := Initialize(config.Cluster{
 		ClusterInternal: &cfg,
 	}, clusterStateChannel,
 		loadBalancerChannel)
 	uut.client = client
+	uut.dynamicClient = dynamicClient
 	go func() {
 		go uut.aggregateClusterView()
 		err := uut.watch()
 		uut.aggregatorStopChannel <- true
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 	// Wait until UUT signals readiness
@@ -45,32 +77,51 @@ func createFakeClientsetAndUUT(t *testing.T, objects ...runtime.Object) (*fake.C
 	return client, uut
 }
 
-// Test basic event handling by pointing the cluster handler to an empty mock fake client, producing a single pod
-// event and checking whether it is received correctly
-func TestClusterBasicEventHandling(t *testing.T) {
-	g := gomega.NewGomegaWithT(t)
-	client, uut := createFakeClientsetAndUUT(t)
-	// Create pod
+// Read published cluster states until one matches the condition
+func waitForClusterState(t testing.TB, uut *Cluster, condition func(state.ClusterState) bool) state.ClusterState {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case clusterState := <-uut.clusterStateChannel:
+			if condition(clusterState) {
+				return clusterState
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for cluster state")
+		}
+	}
+}
+
+// Create a pod which looks like an ingress pod
+func createIngressPod(client *fake.Clientset, name string, ip string) error {
 	_, err := client.CoreV1().Pods("ingress-nginx").Create(&v1coreapi.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "ingress-nginx",
+			Name:      name,
 			Namespace: "ingress-nginx",
 			Labels: map[string]string{
 				"app.kubernetes.io/name": "ingress-nginx",
 			},
 		},
 		Status: v1coreapi.PodStatus{
-			PodIP: "1.2.3.4",
+			PodIP: ip,
 		},
 	})
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	// This should give precisely one event
+	return err
+}
+
+// Test basic event handling by pointing the cluster handler to an empty mock fake client, producing a single pod
+// event and checking whether it is received correctly
+func TestClusterBasicEventHandling(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	client, uut := createFakeClientsetAndUUT(t)
+	err := createIngressPod(client, "ingress-nginx", "1.2.3.4")
+	g.Expect(err).To(gomega.BeNil())
+	// This should give precisely one snapshot
 	clusterState := <-uut.clusterStateChannel
-	g.Expect(len(clusterState.Ingresses)).To(gomega.BeIdenticalTo(0))
-	g.Expect(len(clusterState.Backends)).To(gomega.BeIdenticalTo(1))
+	g.Expect(clusterState.Ingresses).To(gomega.BeEmpty())
+	g.Expect(clusterState.Backends).To(gomega.HaveLen(1))
+	g.Expect(clusterState.Backends["ingress-nginx"].IP.String()).To(gomega.Equal("1.2.3.4"))
+	g.Expect(clusterState.Generation).To(gomega.BeEquivalentTo(1))
 	uut.Stop()
 }
 
@@ -79,24 +130,9 @@ func TestClusterBasicEventHandling(t *testing.T) {
 func TestClusterEventHandling(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
 	client, uut := createFakeClientsetAndUUT(t)
-	// Create pods
 	for i := 0; i < 3; i++ {
-		_, err := client.CoreV1().Pods("ingress-nginx").Create(&v1coreapi.Pod{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "ingress-nginx-" + strconv.Itoa(i),
-				Namespace: "ingress-nginx",
-				Labels: map[string]string{
-					"app.kubernetes.io/name": "ingress-nginx",
-				},
-			},
-			Status: v1coreapi.PodStatus{
-				PodIP: "1.2.3." + strconv.Itoa(i),
-			},
-		})
-		if err != nil {
-			t.Error(err)
-			return
-		}
+		err := createIngressPod(client, "ingress-nginx-"+strconv.Itoa(i), "1.2.3."+strconv.Itoa(i))
+		g.Expect(err).To(gomega.BeNil())
 	}
 
 	// Create ingress
@@ -114,53 +150,495 @@ func TestClusterEventHandling(t *testing.T) {
 		},
 	}
 	_, err := client.ExtensionsV1beta1().Ingresses("ingress-nginx").Create(&originalIngress)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	// This should give precisely four events
-	clusterState := <-uut.clusterStateChannel
-	for i := 0; i < 3; i++ {
-		clusterState = <-uut.clusterStateChannel
+	g.Expect(err).To(gomega.BeNil())
+	clusterState := waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses) == 1 && len(clusterState.Backends) == 3
+	})
+	g.Expect(clusterState.Ingresses["ingress-nginx-dummy-ingress"].Hosts).To(gomega.Equal([]string{"test.example.org"}))
+	generation := clusterState.Generation
+
+	// Edit ingress domain
+	newIngress := originalIngress
+	newIngress.Spec.Rules = []v1beta1extensionsapi.IngressRule{
+		{
+			Host: "othertest.example.org",
+		},
 	}
-	g.Expect(len(clusterState.Ingresses)).To(gomega.BeIdenticalTo(1))
-	g.Expect(len(clusterState.Backends)).To(gomega.BeIdenticalTo(3))
+	_, err = client.ExtensionsV1beta1().Ingresses("ingress-nginx").Update(&newIngress)
+	g.Expect(err).To(gomega.BeNil())
+	clusterState = waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses["ingress-nginx-dummy-ingress"].Hosts) == 1 &&
+			clusterState.Ingresses["ingress-nginx-dummy-ingress"].Hosts[0] == "othertest.example.org"
+	})
+	g.Expect(clusterState.Ingresses).To(gomega.HaveLen(1))
+	g.Expect(clusterState.Generation).To(gomega.BeNumerically(">", generation))
 
-	// Delete first two pods
+	// Delete first two pods and the ingress
 	for i := 0; i < 2; i++ {
 		name := "ingress-nginx-" + strconv.Itoa(i)
 		err := client.CoreV1().Pods("ingress-nginx").Delete(name, metav1.NewDeleteOptions(100))
-		if err != nil {
-			t.Error(err)
-			return
+		g.Expect(err).To(gomega.BeNil())
+	}
+	err = client.ExtensionsV1beta1().Ingresses("ingress-nginx").Delete("dummy-ingress", metav1.NewDeleteOptions(100))
+	g.Expect(err).To(gomega.BeNil(), "Unexpected deletion error")
+	clusterState = waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses) == 0 && len(clusterState.Backends) == 1
+	})
+	g.Expect(clusterState.Backends).To(gomega.HaveKey("ingress-nginx-2"))
+
+	uut.Stop()
+}
+
+// Test that bursts of events are coalesced into few snapshots
+func TestClusterEventCoalescing(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	client, uut := createFakeClientsetAndUUT(t)
+	for i := 0; i < 50; i++ {
+		err := createIngressPod(client, "ingress-nginx-"+strconv.Itoa(i), "10.0.0."+strconv.Itoa(i+1))
+		g.Expect(err).To(gomega.BeNil())
+	}
+	snapshots := 0
+	clusterState := waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		snapshots++
+		return len(clusterState.Backends) == 50
+	})
+	g.Expect(snapshots).To(gomega.BeNumerically("<", 50))
+	g.Expect(clusterState.Generation).To(gomega.BeEquivalentTo(snapshots))
+
+	// Events which don't change anything don't produce a snapshot
+	pod, err := client.CoreV1().Pods("ingress-nginx").Get("ingress-nginx-0", metav1.GetOptions{})
+	g.Expect(err).To(gomega.BeNil())
+	pod.Labels["unrelated"] = "label"
+	_, err = client.CoreV1().Pods("ingress-nginx").Update(pod)
+	g.Expect(err).To(gomega.BeNil())
+	g.Consistently(uut.clusterStateChannel, 3*snapshotDebounce).ShouldNot(gomega.Receive())
+
+	// Pods which lose their IP are removed
+	pod.Status.PodIP = ""
+	_, err = client.CoreV1().Pods("ingress-nginx").Update(pod)
+	g.Expect(err).To(gomega.BeNil())
+	clusterState = waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Backends) == 49
+	})
+	g.Expect(clusterState.Backends).NotTo(gomega.HaveKey("ingress-nginx-0"))
+
+	uut.Stop()
+}
+
+// Only ingresses and pods in scope should end up in the cluster state
+func TestClusterWatchScope(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cfg := config.ClusterInternal{
+		Name:               "fake",
+		IngressNamespace:   "ingress-nginx",
+		IngressAppName:     "ingress-nginx",
+		PodSelector:        "app.kubernetes.io/name=ingress-nginx,component=controller",
+		Namespaces:         []string{"app", "other"},
+		ExcludedNamespaces: []string{"other"},
+		IngressSelector:    "k8router=enabled",
+	}
+	ingress := func(namespace string, name string, labels map[string]string) *v1beta1extensionsapi.Ingress {
+		return &v1beta1extensionsapi.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    labels,
+			},
+			Spec: v1beta1extensionsapi.IngressSpec{
+				Rules: []v1beta1extensionsapi.IngressRule{
+					{
+						Host: name + ".example.org",
+					},
+				},
+			},
 		}
 	}
-	/* TODO: The following code fragment does not work for some reason
-	 * In theory it should generate an update event. Find out why it doesn't
-	// Edit ingress domain
-	newIngress := v1beta1extensionsapi.Ingress{
+	pod := func(namespace string, name string, labels map[string]string) *v1coreapi.Pod {
+		return &v1coreapi.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    labels,
+			},
+			Status: v1coreapi.PodStatus{
+				PodIP: "10.0.0.1",
+			},
+		}
+	}
+	enabled := map[string]string{"k8router": "enabled"}
+	controller := map[string]string{"app.kubernetes.io/name": "ingress-nginx", "component": "controller"}
+	client, uut := createFakeClientsetAndUUTWithConfig(t, cfg,
+		ingress("app", "unlabeled", nil),
+		ingress("other", "excluded", enabled),
+		ingress("third", "unlisted", enabled),
+		pod("ingress-nginx", "admission", map[string]string{"app.kubernetes.io/name": "ingress-nginx"}),
+		pod("app", "lookalike", controller),
+		ingress("app", "selected", enabled),
+		pod("ingress-nginx", "controller", controller))
+
+	clusterState := waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses) > 0 && len(clusterState.Backends) > 0
+	})
+	g.Expect(clusterState.Ingresses).To(gomega.HaveLen(1))
+	g.Expect(clusterState.Ingresses).To(gomega.HaveKey("app-selected"))
+	g.Expect(clusterState.Backends).To(gomega.HaveLen(1))
+	g.Expect(clusterState.Backends).To(gomega.HaveKey("controller"))
+	g.Consistently(uut.clusterStateChannel, 3*snapshotDebounce).ShouldNot(gomega.Receive())
+
+	// Ingresses losing their label are removed
+	_, err := client.ExtensionsV1beta1().Ingresses("app").Update(ingress("app", "selected", nil))
+	g.Expect(err).To(gomega.BeNil())
+	waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses) == 0
+	})
+
+	uut.Stop()
+}
+
+// LoadBalancer services losing their label or whose deletion was missed have to be removed
+func TestLoadBalancerServiceEvents(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	loadBalancerChannel := make(chan state.LoadBalancerChange, 10)
+	uut := Initialize(config.Cluster{ClusterInternal: &config.ClusterInternal{
+		Name:            "fake",
+		ServiceSelector: "k8router=enabled",
+	}}, nil, loadBalancerChannel)
+	service := func(labels map[string]string) *v1coreapi.Service {
+		return &v1coreapi.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "lb",
+				Namespace: "app",
+				Labels:    labels,
+			},
+			Spec: v1coreapi.ServiceSpec{
+				Type:      v1coreapi.ServiceTypeLoadBalancer,
+				ClusterIP: "10.96.0.10",
+				Ports:     []v1coreapi.ServicePort{{Port: 53, Protocol: v1coreapi.ProtocolUDP}},
+			},
+		}
+	}
+
+	uut.handleLoadBalancerEvent(service(map[string]string{"k8router": "enabled"}), watch.Added)
+	g.Expect((<-loadBalancerChannel).Created).To(gomega.BeTrue())
+
+	uut.handleLoadBalancerEvent(service(nil), watch.Modified)
+	change := <-loadBalancerChannel
+	g.Expect(change.Created).To(gomega.BeFalse())
+	g.Expect(change.Service.Port).To(gomega.Equal(int32(53)))
+	g.Expect(loadBalancerChannel).To(gomega.BeEmpty())
+
+	uut.handleLoadBalancerEvent(cache.DeletedFinalStateUnknown{
+		Key: "app/lb",
+		Obj: service(map[string]string{"k8router": "enabled"}),
+	}, watch.Deleted)
+	g.Expect((<-loadBalancerChannel).Created).To(gomega.BeFalse())
+}
+
+// Without a pod selector, all pods in the ingress namespace are ingress pods
+func TestClusterDefaultPodScope(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cfg := config.ClusterInternal{
+		Name:             "fake",
+		IngressNamespace: "ingress-nginx",
+		IngressAppName:   "ingress-nginx",
+	}
+	client, uut := createFakeClientsetAndUUTWithConfig(t, cfg)
+	_, err := client.CoreV1().Pods("ingress-nginx").Create(&v1coreapi.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "unlabeled", Namespace: "ingress-nginx"},
+		Status:     v1coreapi.PodStatus{PodIP: "10.0.0.1"},
+	})
+	g.Expect(err).To(gomega.BeNil())
+	clusterState := waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Backends) > 0
+	})
+	g.Expect(clusterState.Backends).To(gomega.HaveKey("unlabeled"))
+
+	uut.Stop()
+}
+
+// Namespaces may claim hosts via annotation, k8router reports back via events
+func TestNamespaceClaimsAndEvents(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cfg := config.ClusterInternal{
+		Name:                "fake",
+		IngressNamespace:    "ingress-nginx",
+		NamespaceHostClaims: true,
+	}
+	client, uut := createFakeClientsetAndUUTWithConfig(t, cfg, &v1coreapi.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "dummy-ingress",
-			Namespace: "ingress-nginx",
+			Name:        "shop",
+			Annotations: map[string]string{annotationAllowedHosts: "shop.example.org, *.Shop.example.org"},
+		},
+	}, &v1beta1extensionsapi.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "shop",
 		},
 		Spec: v1beta1extensionsapi.IngressSpec{
 			Rules: []v1beta1extensionsapi.IngressRule{
 				{
-					Host: "othertest.example.org",
+					Host: "shop.example.org",
 				},
 			},
 		},
+	})
+	clusterState := waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses["shop-web"].NamespaceClaims) > 0
+	})
+	g.Expect(clusterState.Ingresses["shop-web"].Namespace).To(gomega.Equal("shop"))
+	g.Expect(clusterState.Ingresses["shop-web"].ObjectName).To(gomega.Equal("web"))
+	g.Expect(clusterState.Ingresses["shop-web"].NamespaceClaims).To(gomega.Equal(
+		[]string{"shop.example.org", "*.shop.example.org"}))
+
+	// Changed claims apply to all ingresses of the namespace
+	namespace, err := client.CoreV1().Namespaces().Get("shop", metav1.GetOptions{})
+	g.Expect(err).To(gomega.BeNil())
+	delete(namespace.Annotations, annotationAllowedHosts)
+	_, err = client.CoreV1().Namespaces().Update(namespace)
+	g.Expect(err).To(gomega.BeNil())
+	waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses["shop-web"].NamespaceClaims) == 0
+	})
+
+	uut.RecordIngressEvent(state.IngressEvent{
+		Cluster:   "fake",
+		Namespace: "shop",
+		Name:      "web",
+		Warning:   true,
+		Reason:    "HostRejected",
+		Message:   "Host shop.example.org is not routed by k8router",
+	})
+	var events *v1coreapi.EventList
+	g.Eventually(func() []v1coreapi.Event {
+		events, err = client.CoreV1().Events("shop").List(metav1.ListOptions{})
+		g.Expect(err).To(gomega.BeNil())
+		return events.Items
+	}).Should(gomega.HaveLen(1))
+	g.Expect(events.Items[0].InvolvedObject.Kind).To(gomega.Equal("Ingress"))
+	g.Expect(events.Items[0].InvolvedObject.Name).To(gomega.Equal("web"))
+	g.Expect(events.Items[0].Type).To(gomega.Equal(v1coreapi.EventTypeWarning))
+	g.Expect(events.Items[0].Reason).To(gomega.Equal("HostRejected"))
+
+	uut.Stop()
+}
+
+// Measure how long it takes to aggregate the initial state of a large cluster
+func BenchmarkAggregateLargeCluster(b *testing.B) {
+	const ingresses = 5000
+	const pods = 200
+	var objects []runtime.Object
+	for i := 0; i < ingresses; i++ {
+		objects = append(objects, &v1beta1extensionsapi.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-" + strconv.Itoa(i),
+				Namespace: "apps",
+			},
+			Spec: v1beta1extensionsapi.IngressSpec{
+				Rules: []v1beta1extensionsapi.IngressRule{
+					{
+						Host: "app-" + strconv.Itoa(i) + ".example.org",
+					},
+				},
+			},
+		})
 	}
-	_, err = client.ExtensionsV1beta1().Ingresses("ingress-nginx").Update(&newIngress)*/
-	err = client.ExtensionsV1beta1().Ingresses("ingress-nginx").Delete("dummy-ingress", metav1.NewDeleteOptions(100))
-	g.Expect(err).To(gomega.BeNil(), "Unexpected deletion error")
-	// This should give precisely three events
-	clusterState = <-uut.clusterStateChannel
-	for i := 0; i < 2; i++ {
-		clusterState = <-uut.clusterStateChannel
+	for i := 0; i < pods; i++ {
+		objects = append(objects, &v1coreapi.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ingress-nginx-" + strconv.Itoa(i),
+				Namespace: "ingress-nginx",
+				Labels: map[string]string{
+					"app.kubernetes.io/name": "ingress-nginx",
+				},
+			},
+			Status: v1coreapi.PodStatus{
+				PodIP: "10.0." + strconv.Itoa(i/250) + "." + strconv.Itoa(i%250+1),
+			},
+		})
 	}
-	g.Expect(len(clusterState.Ingresses)).To(gomega.BeIdenticalTo(0))
-	g.Expect(len(clusterState.Backends)).To(gomega.BeIdenticalTo(1))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, uut := createFakeClientsetAndUUT(b, objects...)
+		waitForClusterState(b, uut, func(clusterState state.ClusterState) bool {
+			return len(clusterState.Ingresses) == ingresses && len(clusterState.Backends) == pods
+		})
+		uut.Stop()
+	}
+}
+
+// Test syncing TLS secrets referenced by ingresses
+func TestClusterTLSSecretSync(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cfg := config.ClusterInternal{
+		Name:             "fake",
+		IngressNamespace: "ingress-nginx",
+		SyncTLSSecrets:   true,
+	}
+	client, uut := createFakeClientsetAndUUTWithConfig(t, cfg)
+
+	// Ingress referencing a secret which doesn't exist yet
+	_, err := client.ExtensionsV1beta1().Ingresses("app").Create(&v1beta1extensionsapi.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "app",
+		},
+		Spec: v1beta1extensionsapi.IngressSpec{
+			TLS: []v1beta1extensionsapi.IngressTLS{
+				{
+					Hosts:      []string{"app.example.org"},
+					SecretName: "app-tls",
+				},
+			},
+			Rules: []v1beta1extensionsapi.IngressRule{
+				{
+					Host: "app.example.org",
+				},
+			},
+		},
+	})
+	g.Expect(err).To(gomega.BeNil())
+	clusterState := <-uut.clusterStateChannel
+	g.Expect(clusterState.Ingresses).To(gomega.HaveLen(1))
+	g.Expect(clusterState.Certificates).To(gomega.BeEmpty())
+
+	// Invalid secrets are ignored
+	_, err = client.CoreV1().Secrets("app").Create(&v1coreapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "broken-tls",
+			Namespace: "app",
+		},
+		Type: v1coreapi.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1coreapi.TLSCertKey:       []byte("foo"),
+			v1coreapi.TLSPrivateKeyKey: []byte("bar"),
+		},
+	})
+	g.Expect(err).To(gomega.BeNil())
+	g.Consistently(uut.clusterStateChannel, 3*snapshotDebounce).ShouldNot(gomega.Receive())
+
+	cert, key := certificatetest.Generate(t, time.Now().Add(time.Hour), "app.example.org")
+	_, err = client.CoreV1().Secrets("app").Create(&v1coreapi.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-tls",
+			Namespace: "app",
+		},
+		Type: v1coreapi.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1coreapi.TLSCertKey:       cert,
+			v1coreapi.TLSPrivateKeyKey: key,
+		},
+	})
+	g.Expect(err).To(gomega.BeNil())
+	clusterState = <-uut.clusterStateChannel
+	g.Expect(clusterState.Certificates).To(gomega.HaveLen(1))
+	g.Expect(clusterState.Certificates["app/app-tls"].Name).To(gomega.Equal("app/app-tls"))
+	g.Expect(clusterState.Certificates["app/app-tls"].Hosts).To(gomega.Equal([]string{"app.example.org"}))
+	g.Expect(string(clusterState.Certificates["app/app-tls"].PEM)).To(gomega.ContainSubstring("PRIVATE KEY"))
 
 	uut.Stop()
 }
+
+// Test parsing of k8router annotations
+func TestIngressAnnotations(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cfg := config.ClusterInternal{Name: "fake"}
+	uut := Initialize(config.Cluster{ClusterInternal: &cfg}, nil, nil)
+
+	annotations := map[string]string{
+		annotationWeight:   "10",
+		annotationPriority: "-5",
+	}
+	newIngress := func() state.K8RouterIngress {
+		return state.K8RouterIngress{Name: "app-app", Namespace: "app", ObjectName: "app"}
+	}
+	obj := newIngress()
+	uut.parseIngressAnnotations(annotations, &obj)
+	g.Expect(obj.Weight).NotTo(gomega.BeNil())
+	g.Expect(*obj.Weight).To(gomega.Equal(10))
+	g.Expect(*obj.Priority).To(gomega.Equal(-5))
+
+	annotations[annotationWeight] = "-1"
+	obj = newIngress()
+	uut.parseIngressAnnotations(annotations, &obj)
+	g.Expect(obj.Weight).To(gomega.BeNil())
+
+	annotations = map[string]string{
+		annotationForceHTTPS:            "true",
+		annotationAllowedSourceRanges:   "10.0.0.0/8, 192.168.1.1",
+		annotationHSTSMaxAge:            "8760h",
+		annotationHSTSIncludeSubdomains: "true",
+		annotationRequestTimeout:        "5s",
+		annotationResponseTimeout:       "1m",
+		annotationMaxBodySize:           "10m",
+		annotationBasicAuthUserlist:     "admins",
+		annotationSSLPassthrough:        "true",
+		annotationClientVerify:          "optional",
+		annotationBackendProtocol:       "h2",
+	}
+	obj = newIngress()
+	uut.parseIngressAnnotations(annotations, &obj)
+	g.Expect(obj.Options).To(gomega.Equal(state.K8RouterIngressOptions{
+		ForceHTTPS:            true,
+		AllowedSourceRanges:   []string{"10.0.0.0/8", "192.168.1.1"},
+		HSTSMaxAge:            8760 * time.Hour,
+		HSTSIncludeSubdomains: true,
+		RequestTimeout:        5 * time.Second,
+		ResponseTimeout:       time.Minute,
+		MaxBodySize:           10 << 20,
+		BasicAuthUserlist:     "admins",
+		BasicAuthRealm:        "k8router",
+		SSLPassthrough:        true,
+		ClientVerify:          config.ClientVerifyOptional,
+		BackendProtocol:       config.BackendProtocolH2,
+	}))
+
+	// Invalid values must never end up in the HAProxy config
+	annotations = map[string]string{
+		annotationForceHTTPS:          "maybe",
+		annotationAllowedSourceRanges: "10.0.0.0/8, everybody",
+		annotationRequestTimeout:      "5",
+		annotationMaxBodySize:         "10x",
+		annotationBasicAuthUserlist:   "admins if TRUE",
+		annotationClientVerify:        "sometimes",
+		annotationBackendProtocol:     "grpc",
+	}
+	obj = newIngress()
+	uut.parseIngressAnnotations(annotations, &obj)
+	g.Expect(obj.Options).To(gomega.Equal(state.K8RouterIngressOptions{
+		AllowedSourceRanges: []string{"127.0.0.1/32"},
+		ClientVerify:        config.ClientVerifyRequired,
+	}))
+	// The owners of the ingress are told about each of them, including the invalid weight
+	g.Expect(uut.events.lastRecorded).To(gomega.HaveLen(8))
+	for event := range uut.events.lastRecorded {
+		g.Expect(event.Reason).To(gomega.Equal(reasonInvalidAnnotation))
+		g.Expect(event.Warning).To(gomega.BeTrue())
+	}
+}
+
+// Repeated events and events beyond the rate limit are dropped
+func TestIngressEventLimits(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut := newEventRecorder()
+	uut.configure(config.Events{
+		RepeatInterval: time.Hour,
+		QPS:            0.001,
+		Burst:          2,
+	})
+	event := state.IngressEvent{
+		Namespace: "app",
+		Name:      "app",
+		Reason:    "HostRouted",
+		Message:   "Host app.example.org is routed by k8router",
+	}
+	g.Expect(uut.record(event)).To(gomega.BeTrue())
+	g.Expect(uut.record(event)).To(gomega.BeFalse())
+	event.Message = "Host www.example.org is routed by k8router"
+	g.Expect(uut.record(event)).To(gomega.BeTrue())
+	event.Name = "other"
+	g.Expect(uut.record(event)).To(gomega.BeFalse())
+
+	// Repeating is fine once the interval has passed
+	uut.configure(config.Events{RepeatInterval: time.Nanosecond})
+	g.Expect(uut.record(event)).To(gomega.BeTrue())
+}
@@ -0,0 +1,166 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/config"
+	"io/ioutil"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token of the pod's service account, rotated by the kubelet
+const inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// How often token files are re-read
+const tokenRefreshInterval = time.Minute
+
+// How often the kubeconfig is checked for changes
+const connectionCheckInterval = 10 * time.Second
+
+// Build the client config of a cluster from its kubeconfig (or the pod's service account) and the configured
+// overrides
+func clientConfig(cfg *config.ClusterInternal) (*rest.Config, error) {
+	var restConfig *rest.Config
+	var err error
+	if cfg.InCluster {
+		restConfig, err = rest.InClusterConfig()
+	} else {
+		var kubeConfig *clientcmdapi.Config
+		kubeConfig, err = clientcmd.LoadFromFile(cfg.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: cfg.Context}
+		restConfig, err = clientcmd.NewDefaultClientConfig(*kubeConfig, overrides).ClientConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	connection := cfg.Connection
+	if connection.Server != "" {
+		restConfig.Host = connection.Server
+	}
+	if connection.CAFile != "" {
+		restConfig.TLSClientConfig.CAFile = connection.CAFile
+		restConfig.TLSClientConfig.CAData = nil
+	}
+	tokenFile := connection.TokenFile
+	if tokenFile == "" && cfg.InCluster && connection.Exec == nil {
+		// client-go only reads the service account token once
+		tokenFile = inClusterTokenFile
+	}
+	if tokenFile != "" {
+		restConfig.BearerToken = ""
+		wrapTransport := restConfig.WrapTransport
+		restConfig.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+			if wrapTransport != nil {
+				rt = wrapTransport(rt)
+			}
+			return &tokenFileTransport{path: tokenFile, base: rt}
+		}
+	}
+	if connection.Exec != nil {
+		restConfig.BearerToken = ""
+		restConfig.ExecProvider = toExecConfig(connection.Exec)
+	}
+	if connection.QPS > 0 {
+		restConfig.QPS = connection.QPS
+	}
+	if connection.Burst > 0 {
+		restConfig.Burst = connection.Burst
+	}
+	if connection.Timeout > 0 {
+		restConfig.Timeout = connection.Timeout
+	}
+	return restConfig, nil
+}
+
+// Convert the configured credential plugin to what client-go expects
+func toExecConfig(exec *config.ExecCredential) *clientcmdapi.ExecConfig {
+	execConfig := &clientcmdapi.ExecConfig{
+		Command:    exec.Command,
+		Args:       exec.Args,
+		APIVersion: exec.APIVersion,
+	}
+	var names []string
+	for name := range exec.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		execConfig.Env = append(execConfig.Env, clientcmdapi.ExecEnvVar{Name: name, Value: exec.Env[name]})
+	}
+	return execConfig
+}
+
+// Fingerprint of all files the connection to a cluster is built from, except for token files which are re-read
+// anyway
+func connectionFingerprint(cfg *config.ClusterInternal) string {
+	hash := sha256.New()
+	for _, file := range []string{cfg.Kubeconfig, cfg.Connection.CAFile} {
+		if file == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			content = []byte(err.Error())
+		}
+		hash.Write([]byte(file + "\x00"))
+		hash.Write(content)
+		hash.Write([]byte("\x00"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Adds a bearer token read from a file to all requests. The file is re-read regularly so the token can be rotated
+type tokenFileTransport struct {
+	path string
+	base http.RoundTripper
+
+	lock   sync.Mutex
+	token  string
+	readAt time.Time
+}
+
+// RoundTrip sends the request with the current token
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.currentToken()
+	if token == "" {
+		return t.base.RoundTrip(req)
+	}
+	req = utilnet.CloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// Get the current token, re-reading the file if necessary. The last token is kept if the file can't be read
+func (t *tokenFileTransport) currentToken() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != "" && time.Since(t.readAt) < tokenRefreshInterval {
+		return t.token
+	}
+	content, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		log.WithField("file", t.path).WithError(err).Warning("Couldn't read token file, keeping the last token")
+		return t.token
+	}
+	t.token = strings.TrimSpace(string(content))
+	t.readAt = time.Now()
+	return t.token
+}
+
+// WrappedRoundTripper returns the transport the tokens are added to
+func (t *tokenFileTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.base
+}
@@ -0,0 +1,169 @@
+package router
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	"io/ioutil"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+  - name: prod
+    cluster:
+      server: https://prod.example.org:6443
+  - name: staging
+    cluster:
+      server: https://staging.example.org:6443
+users:
+  - name: admin
+    user:
+      token: static-token
+contexts:
+  - name: prod
+    context:
+      cluster: prod
+      user: admin
+  - name: staging
+    context:
+      cluster: staging
+      user: admin
+`
+
+// Write a file to a temporary directory
+func writeTempFile(g *gomega.WithT, dir string, name string, content string) string {
+	file := path.Join(dir, name)
+	g.Expect(ioutil.WriteFile(file, []byte(content), 0600)).To(gomega.Succeed())
+	return file
+}
+
+// Contexts and overrides are applied on top of the kubeconfig
+func TestClientConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-connection")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+	cfg := config.ClusterInternal{Kubeconfig: writeTempFile(g, dir, "kubeconfig", testKubeconfig)}
+
+	restConfig, err := clientConfig(&cfg)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(restConfig.Host).To(gomega.Equal("https://prod.example.org:6443"))
+	g.Expect(restConfig.BearerToken).To(gomega.Equal("static-token"))
+
+	cfg.Context = "staging"
+	cfg.Connection = config.Connection{
+		Server:  "https://10.0.0.1:6443",
+		CAFile:  "/etc/k8router/ca.pem",
+		QPS:     20,
+		Burst:   40,
+		Timeout: 30 * time.Second,
+		Exec: &config.ExecCredential{
+			Command:    "get-token",
+			Env:        map[string]string{"USER": "k8router", "CLUSTER": "staging"},
+			APIVersion: config.DefaultExecAPIVersion,
+		},
+	}
+	restConfig, err = clientConfig(&cfg)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(restConfig.Host).To(gomega.Equal("https://10.0.0.1:6443"))
+	g.Expect(restConfig.TLSClientConfig.CAFile).To(gomega.Equal("/etc/k8router/ca.pem"))
+	g.Expect(restConfig.QPS).To(gomega.BeEquivalentTo(20))
+	g.Expect(restConfig.Burst).To(gomega.Equal(40))
+	g.Expect(restConfig.Timeout).To(gomega.Equal(30 * time.Second))
+	g.Expect(restConfig.BearerToken).To(gomega.BeEmpty(), "The plugin replaces the kubeconfig's credentials")
+	g.Expect(restConfig.ExecProvider.Env).To(gomega.Equal([]clientcmdapi.ExecEnvVar{
+		{Name: "CLUSTER", Value: "staging"},
+		{Name: "USER", Value: "k8router"},
+	}))
+
+	cfg.Context = "missing"
+	_, err = clientConfig(&cfg)
+	g.Expect(err).NotTo(gomega.BeNil())
+}
+
+// Rotated tokens should be picked up without reconnecting
+func TestTokenFileRotation(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-connection")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+	tokenFile := writeTempFile(g, dir, "token", "first\n")
+
+	authorization := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	client := http.Client{Transport: &tokenFileTransport{path: tokenFile, base: http.DefaultTransport}}
+	request := func() string {
+		response, err := client.Get(server.URL)
+		g.Expect(err).To(gomega.BeNil())
+		response.Body.Close()
+		return <-authorization
+	}
+
+	g.Expect(request()).To(gomega.Equal("Bearer first"))
+	writeTempFile(g, dir, "token", "second")
+	g.Expect(request()).To(gomega.Equal("Bearer first"), "Tokens are cached for a while")
+	client.Transport.(*tokenFileTransport).readAt = time.Now().Add(-tokenRefreshInterval)
+	g.Expect(request()).To(gomega.Equal("Bearer second"))
+
+	// Keep the last token while the file is being replaced
+	g.Expect(os.Remove(tokenFile)).To(gomega.Succeed())
+	client.Transport.(*tokenFileTransport).readAt = time.Now().Add(-tokenRefreshInterval)
+	g.Expect(request()).To(gomega.Equal("Bearer second"))
+}
+
+// Changes of the kubeconfig should trigger a reconnect
+func TestConnectionFingerprint(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	dir, err := ioutil.TempDir("", "k8router-connection")
+	g.Expect(err).To(gomega.BeNil())
+	defer os.RemoveAll(dir)
+	cfg := config.ClusterInternal{Kubeconfig: writeTempFile(g, dir, "kubeconfig", testKubeconfig)}
+
+	fingerprint := connectionFingerprint(&cfg)
+	g.Expect(connectionFingerprint(&cfg)).To(gomega.Equal(fingerprint))
+	writeTempFile(g, dir, "kubeconfig", testKubeconfig+"preferences: {}\n")
+	g.Expect(connectionFingerprint(&cfg)).NotTo(gomega.Equal(fingerprint))
+	fingerprint = connectionFingerprint(&cfg)
+	g.Expect(os.Remove(cfg.Kubeconfig)).To(gomega.Succeed())
+	g.Expect(connectionFingerprint(&cfg)).NotTo(gomega.Equal(fingerprint))
+}
+
+// Objects deleted while reconnecting have to be removed from the cluster view
+func TestRemoveStaleObjects(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut := Initialize(config.Cluster{ClusterInternal: &config.ClusterInternal{Name: "fake"}}, nil, nil)
+	ip := net.IPv4(10, 0, 0, 1)
+	for _, name := range []string{"pod-a", "pod-b"} {
+		uut.currentClusterState.AddBackend(state.K8RouterBackend{Name: name, IP: &ip})
+	}
+	for _, name := range []string{"app-a", "app-b"} {
+		uut.currentClusterState.AddIngress(state.K8RouterIngress{Name: name})
+	}
+
+	g.Expect(uut.removeStaleObjects(liveObjects{
+		backends:  map[string]bool{"pod-a": true, "pod-b": true},
+		ingresses: map[string]bool{"app-a": true, "app-b": true, "app-c": true},
+	})).To(gomega.BeFalse())
+	g.Expect(uut.removeStaleObjects(liveObjects{
+		backends:  map[string]bool{"pod-b": true},
+		ingresses: map[string]bool{"app-a": true},
+	})).To(gomega.BeTrue())
+	g.Expect(uut.currentClusterState.Backends).To(gomega.HaveLen(1))
+	g.Expect(uut.currentClusterState.Backends).To(gomega.HaveKey("pod-b"))
+	g.Expect(uut.currentClusterState.Ingresses).To(gomega.HaveLen(1))
+	g.Expect(uut.currentClusterState.Ingresses).To(gomega.HaveKey("app-a"))
+}
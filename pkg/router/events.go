@@ -0,0 +1,144 @@
+package router
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	v1coreapi "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	"os"
+	"sync"
+	"time"
+)
+
+// Component reported as the source of our Kubernetes Events
+const eventSourceComponent = "k8router"
+
+// Reason of events about invalid annotations
+const reasonInvalidAnnotation = "InvalidAnnotation"
+
+// Records Kubernetes Events on ingresses, dropping repeated events and anything beyond the rate limit
+type eventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+
+	settings config.Events
+	limiter  flowcontrol.RateLimiter
+
+	// When each event was last recorded
+	lastRecorded map[state.IngressEvent]time.Time
+	lock         sync.Mutex
+}
+
+// Create a new event recorder with the default limits. Events only reach the cluster while a sink is connected
+func newEventRecorder() *eventRecorder {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithError(err).Warning("Couldn't determine hostname for events")
+	}
+	broadcaster := record.NewBroadcaster()
+	recorder := &eventRecorder{
+		broadcaster: broadcaster,
+		recorder: broadcaster.NewRecorder(scheme.Scheme, v1coreapi.EventSource{
+			Component: eventSourceComponent,
+			Host:      hostname,
+		}),
+		lastRecorded: map[state.IngressEvent]time.Time{},
+	}
+	recorder.configure(config.Events{})
+	return recorder
+}
+
+// Change the limits of the recorder
+func (r *eventRecorder) configure(settings config.Events) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.settings = settings.WithDefaults()
+	r.limiter = flowcontrol.NewTokenBucketRateLimiter(r.settings.QPS, r.settings.Burst)
+}
+
+// Record an event unless it was recorded recently or the rate limit is exceeded. Returns whether it was recorded
+func (r *eventRecorder) record(event state.IngressEvent) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if last, ok := r.lastRecorded[event]; ok && now.Sub(last) < r.settings.RepeatInterval {
+		return false
+	}
+	if !r.limiter.TryAccept() {
+		return false
+	}
+	for known, last := range r.lastRecorded {
+		if now.Sub(last) >= r.settings.RepeatInterval {
+			delete(r.lastRecorded, known)
+		}
+	}
+	r.lastRecorded[event] = now
+
+	eventType := v1coreapi.EventTypeNormal
+	if event.Warning {
+		eventType = v1coreapi.EventTypeWarning
+	}
+	kind, apiVersion := "Ingress", "extensions/v1beta1"
+	if event.Kind != "" {
+		kind, apiVersion = event.Kind, gatewayAPIVersions[event.Kind]
+	}
+	r.recorder.Event(&v1coreapi.ObjectReference{
+		Kind:       kind,
+		APIVersion: apiVersion,
+		Namespace:  event.Namespace,
+		Name:       event.Name,
+	}, eventType, event.Reason, event.Message)
+	return true
+}
+
+// Sink posting events to the namespace of each event
+type eventSink struct {
+	client kubernetes.Interface
+}
+
+func (s *eventSink) Create(event *v1coreapi.Event) (*v1coreapi.Event, error) {
+	return s.client.CoreV1().Events(event.Namespace).CreateWithEventNamespace(event)
+}
+
+func (s *eventSink) Update(event *v1coreapi.Event) (*v1coreapi.Event, error) {
+	return s.client.CoreV1().Events(event.Namespace).UpdateWithEventNamespace(event)
+}
+
+func (s *eventSink) Patch(event *v1coreapi.Event, data []byte) (*v1coreapi.Event, error) {
+	return s.client.CoreV1().Events(event.Namespace).PatchWithEventNamespace(event, data)
+}
+
+// SetEventSettings configures how many Kubernetes Events are posted on ingresses. Must be called before Start
+func (c *Cluster) SetEventSettings(settings config.Events) {
+	c.events.configure(settings)
+}
+
+// RecordIngressEvent posts a Kubernetes Event on an ingress of this cluster. Repeated events and events beyond the
+// rate limit are dropped, as are events while the cluster is unreachable
+func (c *Cluster) RecordIngressEvent(event state.IngressEvent) {
+	event.Cluster = c.config.Name
+	if !c.events.record(event) {
+		log.WithFields(log.Fields{
+			"cluster":   c.config.Name,
+			"namespace": event.Namespace,
+			"ingress":   event.Name,
+			"reason":    event.Reason,
+		}).Debug("Dropping repeated or rate limited event")
+	}
+}
+
+// Tell the owners of an ingress about an annotation we ignore
+func (c *Cluster) recordInvalidAnnotation(ingress *state.K8RouterIngress, annotation string, value string) {
+	c.RecordIngressEvent(state.IngressEvent{
+		Kind:      ingress.Kind,
+		Namespace: ingress.Namespace,
+		Name:      ingress.ObjectName,
+		Warning:   true,
+		Reason:    reasonInvalidAnnotation,
+		Message:   "Ignoring invalid value '" + value + "' of annotation " + annotation,
+	})
+}
@@ -0,0 +1,674 @@
+package router
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/state"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// API group of the Gateway API
+	gatewayAPIGroup = "gateway.networking.k8s.io"
+	// Controller name we report route status with
+	gatewayControllerName = "k8router.vsk8s.io/router"
+
+	kindGateway   = "Gateway"
+	kindHTTPRoute = "HTTPRoute"
+	kindTLSRoute  = "TLSRoute"
+)
+
+// Versions of the Gateway API resources we watch by kind
+var gatewayAPIVersions = map[string]string{
+	kindGateway:   gatewayAPIGroup + "/v1",
+	kindHTTPRoute: gatewayAPIGroup + "/v1",
+	kindTLSRoute:  gatewayAPIGroup + "/v1alpha2",
+}
+
+// Resources of the Gateway API we watch by kind
+var gatewayAPIResources = map[string]schema.GroupVersionResource{
+	kindGateway:   {Group: gatewayAPIGroup, Version: "v1", Resource: "gateways"},
+	kindHTTPRoute: {Group: gatewayAPIGroup, Version: "v1", Resource: "httproutes"},
+	kindTLSRoute:  {Group: gatewayAPIGroup, Version: "v1alpha2", Resource: "tlsroutes"},
+}
+
+// Path match values which can be put into the HAProxy config as they are. The CRD doesn't allow anything else but
+// quotes
+var pathMatchPattern = regexp.MustCompile(`^/[-A-Za-z0-9/._~!$&()*+,;=:@%]*$`)
+
+// Protocols of the listeners each kind of route may attach to
+var routeProtocols = map[string][]string{
+	kindHTTPRoute: {"HTTP", "HTTPS"},
+	kindTLSRoute:  {"TLS"},
+}
+
+// The parts of a Gateway we need
+type gateway struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		GatewayClassName string            `json:"gatewayClassName"`
+		Listeners        []gatewayListener `json:"listeners"`
+	} `json:"spec"`
+}
+
+type gatewayListener struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname,omitempty"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	TLS      *struct {
+		Mode            string            `json:"mode,omitempty"`
+		CertificateRefs []objectReference `json:"certificateRefs,omitempty"`
+	} `json:"tls,omitempty"`
+	AllowedRoutes *struct {
+		Namespaces *struct {
+			From string `json:"from,omitempty"`
+		} `json:"namespaces,omitempty"`
+	} `json:"allowedRoutes,omitempty"`
+}
+
+type objectReference struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// The parts of an HTTPRoute or TLSRoute we need
+type route struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ParentRefs []parentReference `json:"parentRefs,omitempty"`
+		Hostnames  []string          `json:"hostnames,omitempty"`
+		Rules      []routeRule       `json:"rules,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Parents []routeParentStatus `json:"parents,omitempty"`
+	} `json:"status"`
+}
+
+type routeRule struct {
+	// Only set for HTTPRoutes
+	Matches []struct {
+		Path *struct {
+			Type  string `json:"type,omitempty"`
+			Value string `json:"value,omitempty"`
+		} `json:"path,omitempty"`
+	} `json:"matches,omitempty"`
+	BackendRefs []struct {
+		Name   string `json:"name"`
+		Weight *int32 `json:"weight,omitempty"`
+	} `json:"backendRefs,omitempty"`
+}
+
+type parentReference struct {
+	Group       string `json:"group,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name"`
+	SectionName string `json:"sectionName,omitempty"`
+	Port        *int32 `json:"port,omitempty"`
+}
+
+type routeParentStatus struct {
+	ParentRef      parentReference  `json:"parentRef"`
+	ControllerName string           `json:"controllerName"`
+	Conditions     []routeCondition `json:"conditions,omitempty"`
+}
+
+type routeCondition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+	Reason             string      `json:"reason"`
+	Message            string      `json:"message"`
+}
+
+// A route together with what its annotations say
+type watchedRoute struct {
+	kind  string
+	route route
+	// Name, object and options of the route's state representation, without hosts
+	ingress state.K8RouterIngress
+}
+
+// A change of a Gateway or route of our GatewayClass
+type gatewayAPIChange struct {
+	kind    string
+	key     string
+	deleted bool
+	gateway gateway
+	route   watchedRoute
+}
+
+// Route status to write back to the cluster
+type routeStatusUpdate struct {
+	kind      string
+	namespace string
+	name      string
+	parents   []routeParentStatus
+}
+
+// Key of a Gateway API object in the aggregator's maps
+func gatewayAPIKey(kind string, namespace string, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// Take care of Gateway events from the Gateway watch
+func (c *Cluster) handleGatewayEvent(event interface{}, action watch.EventType) {
+	obj, ok := unwrapTombstone(event).(*unstructured.Unstructured)
+	if !ok {
+		log.WithField("cluster", c.config.Name).Error("Got event in gateway handler which contains no object")
+		return
+	}
+	var gw gateway
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &gw); err != nil {
+		log.WithFields(log.Fields{
+			"cluster": c.config.Name,
+			"gateway": obj.GetNamespace() + "/" + obj.GetName(),
+		}).WithError(err).Warning("Ignoring invalid gateway")
+		return
+	}
+	if !c.scope.namespaceWatched(gw.Namespace) {
+		return
+	}
+	c.gatewayAPIEvents <- gatewayAPIChange{
+		kind: kindGateway,
+		key:  gatewayAPIKey(kindGateway, gw.Namespace, gw.Name),
+		// Gateways of other classes are none of our business
+		deleted: action == watch.Deleted || gw.Spec.GatewayClassName != c.config.GatewayClass,
+		gateway: gw,
+	}
+}
+
+// Take care of HTTPRoute and TLSRoute events from the route watches
+func (c *Cluster) handleRouteEvent(kind string, event interface{}, action watch.EventType) {
+	obj, ok := unwrapTombstone(event).(*unstructured.Unstructured)
+	if !ok {
+		log.WithField("cluster", c.config.Name).Error("Got event in route handler which contains no object")
+		return
+	}
+	var r route
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &r); err != nil {
+		log.WithFields(log.Fields{
+			"cluster": c.config.Name,
+			"route":   obj.GetNamespace() + "/" + obj.GetName(),
+			"kind":    kind,
+		}).WithError(err).Warning("Ignoring invalid route")
+		return
+	}
+	if !c.scope.namespaceWatched(r.Namespace) {
+		return
+	}
+	change := gatewayAPIChange{
+		kind: kind,
+		key:  gatewayAPIKey(kind, r.Namespace, r.Name),
+		// The route's labels may have changed, so it isn't watched anymore
+		deleted: action == watch.Deleted || !c.scope.ingressSelector.Matches(labels.Set(r.Labels)),
+	}
+	if !change.deleted {
+		change.route = watchedRoute{
+			kind:  kind,
+			route: r,
+			ingress: state.K8RouterIngress{
+				Name:       strings.ToLower(kind) + "-" + r.Namespace + "-" + r.Name,
+				Kind:       kind,
+				Namespace:  r.Namespace,
+				ObjectName: r.Name,
+				Paths:      routePaths(&r),
+			},
+		}
+		c.parseIngressAnnotations(r.Annotations, &change.route.ingress)
+	}
+	c.gatewayAPIEvents <- change
+}
+
+// Find the Gateway API kinds whose CRDs are installed in the cluster. Informers of missing kinds would never sync
+func (c *Cluster) installedGatewayAPIKinds() (map[string]bool, error) {
+	groups, err := c.client.Discovery().ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+	installed := map[string]bool{}
+	for _, group := range groups.Groups {
+		if group.Name != gatewayAPIGroup {
+			continue
+		}
+		for _, version := range group.Versions {
+			resources, err := c.client.Discovery().ServerResourcesForGroupVersion(version.GroupVersion)
+			if err != nil {
+				return nil, err
+			}
+			for _, resource := range resources.APIResources {
+				for kind, gvr := range gatewayAPIResources {
+					if gvr.Version == version.Version && gvr.Resource == resource.Name {
+						installed[kind] = true
+					}
+				}
+			}
+		}
+	}
+	return installed, nil
+}
+
+// Watch the installed kinds of Gateways, HTTPRoutes and TLSRoutes. Returns the informer stores by kind and adds the
+// informers to the synced functions
+func (c *Cluster) watchGatewayAPI(stopper chan struct{}, installed map[string]bool,
+	synced []cache.InformerSynced) (map[string][]cache.Store, []cache.InformerSynced) {
+	stores := map[string][]cache.Store{}
+	for _, kind := range []string{kindGateway, kindHTTPRoute, kindTLSRoute} {
+		if !installed[kind] {
+			log.WithFields(log.Fields{
+				"cluster": c.config.Name,
+				"kind":    kind,
+			}).Warning("Gateway API kind isn't installed, not watching it")
+		}
+	}
+	if !installed[kindGateway] {
+		// Routes can't attach to anything without Gateways
+		return stores, synced
+	}
+	for _, factory := range c.scope.dynamicInformerFactories(c.dynamicClient, labels.Everything()) {
+		informer := factory.ForResource(gatewayAPIResources[kindGateway]).Informer()
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.handleGatewayEvent(obj, watch.Added) },
+			DeleteFunc: func(obj interface{}) { c.handleGatewayEvent(obj, watch.Deleted) },
+			UpdateFunc: func(old interface{}, new interface{}) { c.handleGatewayEvent(new, watch.Modified) },
+		})
+		stores[kindGateway] = append(stores[kindGateway], informer.GetStore())
+		synced = append(synced, informer.HasSynced)
+		go informer.Run(stopper)
+	}
+	for _, kind := range []string{kindHTTPRoute, kindTLSRoute} {
+		if !installed[kind] {
+			continue
+		}
+		kind := kind
+		for _, factory := range c.scope.dynamicInformerFactories(c.dynamicClient, c.scope.ingressSelector) {
+			informer := factory.ForResource(gatewayAPIResources[kind]).Informer()
+			informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(obj interface{}) { c.handleRouteEvent(kind, obj, watch.Added) },
+				DeleteFunc: func(obj interface{}) { c.handleRouteEvent(kind, obj, watch.Deleted) },
+				UpdateFunc: func(old interface{}, new interface{}) { c.handleRouteEvent(kind, new, watch.Modified) },
+			})
+			stores[kind] = append(stores[kind], informer.GetStore())
+			synced = append(synced, informer.HasSynced)
+			go informer.Run(stopper)
+		}
+	}
+	return stores, synced
+}
+
+// Apply a Gateway API change to the current cluster view. Returns whether anything changed
+func (c *Cluster) applyGatewayAPIChange(change gatewayAPIChange) bool {
+	switch {
+	case change.kind == kindGateway && change.deleted:
+		if _, ok := c.gateways[change.key]; !ok {
+			return false
+		}
+		delete(c.gateways, change.key)
+	case change.kind == kindGateway:
+		c.gateways[change.key] = change.gateway
+	case change.deleted:
+		if _, ok := c.routes[change.key]; !ok {
+			return false
+		}
+		delete(c.routes, change.key)
+	default:
+		c.routes[change.key] = change.route
+	}
+	return c.updateRoutes()
+}
+
+// Map all routes attached to our Gateways into the current cluster view and report their status. Returns whether
+// the cluster view changed
+func (c *Cluster) updateRoutes() bool {
+	changed := false
+	current := map[string]bool{}
+	var keys []string
+	for key := range c.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		watched := c.routes[key]
+		ingress, parents := c.resolveRoute(&watched)
+		c.updateRouteStatus(&watched, parents)
+		current[ingress.Name] = true
+		changed = c.applyIngressChange(state.IngressChange{Ingress: ingress, Created: true}) || changed
+	}
+	for name, ingress := range c.currentClusterState.Ingresses {
+		if ingress.Kind != "" && !current[name] {
+			changed = c.applyIngressChange(state.IngressChange{Ingress: ingress, Created: false}) || changed
+		}
+	}
+	return changed
+}
+
+// Find the hosts and TLS blocks of a route on all our Gateways it attaches to. Returns its state representation
+// and its status for each of these Gateways
+func (c *Cluster) resolveRoute(watched *watchedRoute) (state.K8RouterIngress, []routeParentStatus) {
+	ingress := watched.ingress
+	ingress.Hosts = []string{}
+	r := &watched.route
+	servesTraffic := routeServesTraffic(r)
+	var parents []routeParentStatus
+	for _, parentRef := range r.Spec.ParentRefs {
+		if (parentRef.Group != "" && parentRef.Group != gatewayAPIGroup) ||
+			(parentRef.Kind != "" && parentRef.Kind != kindGateway) {
+			continue
+		}
+		namespace := parentRef.Namespace
+		if namespace == "" {
+			namespace = r.Namespace
+		}
+		gw, ok := c.gateways[gatewayAPIKey(kindGateway, namespace, parentRef.Name)]
+		if !ok {
+			// Not one of ours
+			continue
+		}
+		accepted, reason, message := c.attachRoute(watched.kind, r, &gw, &parentRef, &ingress, servesTraffic)
+		status := "False"
+		if accepted {
+			status = "True"
+		}
+		parents = append(parents, routeParentStatus{
+			ParentRef:      parentRef,
+			ControllerName: gatewayControllerName,
+			Conditions: []routeCondition{{
+				Type:               "Accepted",
+				Status:             status,
+				ObservedGeneration: r.Generation,
+				Reason:             reason,
+				Message:            message,
+			}},
+		})
+	}
+	return ingress, parents
+}
+
+// Attach a route to the matching listeners of a Gateway, adding the resulting hosts and TLS blocks to the route's
+// state representation. Returns whether the route was accepted, and the reason and message of its condition
+func (c *Cluster) attachRoute(kind string, r *route, gw *gateway, parentRef *parentReference,
+	ingress *state.K8RouterIngress, servesTraffic bool) (bool, string, string) {
+	var listeners []gatewayListener
+	for _, listener := range gw.Spec.Listeners {
+		if parentRef.SectionName != "" && listener.Name != parentRef.SectionName {
+			continue
+		}
+		if parentRef.Port != nil && listener.Port != *parentRef.Port {
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return false, "NoMatchingParent", "No listener of the gateway matches the parentRef"
+	}
+
+	accepted := false
+	var hosts []string
+	for _, listener := range listeners {
+		if !containsString(routeProtocols[kind], listener.Protocol) || !routeAllowed(r, gw, &listener) {
+			continue
+		}
+		listenerHosts := intersectHostnames(listener.Hostname, r.Spec.Hostnames)
+		if len(listenerHosts) == 0 {
+			continue
+		}
+		accepted = true
+		hosts = append(hosts, listenerHosts...)
+		if listener.TLS == nil {
+			continue
+		}
+		if listener.TLS.Mode == "Passthrough" {
+			// Options apply to all hosts of a route, so a single passthrough listener passes all of them through
+			ingress.Options.SSLPassthrough = true
+			continue
+		}
+		for _, ref := range listener.TLS.CertificateRefs {
+			if (ref.Group != "" || (ref.Kind != "" && ref.Kind != "Secret")) ||
+				(ref.Namespace != "" && ref.Namespace != gw.Namespace) {
+				// Other kinds and cross-namespace references aren't supported
+				continue
+			}
+			ingress.TLS = append(ingress.TLS, state.K8RouterIngressTLS{
+				Hosts:      listenerHosts,
+				SecretName: gw.Namespace + "/" + ref.Name,
+			})
+		}
+	}
+	if !accepted {
+		if len(r.Spec.Hostnames) == 0 {
+			return false, "NoMatchingListenerHostname", "Routes need a hostname unless the listener has one"
+		}
+		return false, "NotAllowedByListeners", "No listener of the gateway accepts the route's hostnames"
+	}
+	if servesTraffic {
+		for _, host := range hosts {
+			if !containsString(ingress.Hosts, host) {
+				ingress.Hosts = append(ingress.Hosts, host)
+			}
+		}
+	}
+	return true, "Accepted", "Route is accepted"
+}
+
+// Check whether a route's namespace may attach to a listener. Selecting namespaces by label isn't supported
+func routeAllowed(r *route, gw *gateway, listener *gatewayListener) bool {
+	from := "Same"
+	if listener.AllowedRoutes != nil && listener.AllowedRoutes.Namespaces != nil &&
+		listener.AllowedRoutes.Namespaces.From != "" {
+		from = listener.AllowedRoutes.Namespaces.From
+	}
+	return from == "All" || (from == "Same" && r.Namespace == gw.Namespace)
+}
+
+// Check whether any rule of a route sends traffic to a backend. Routes without rules are served by the gateway
+// itself
+func routeServesTraffic(r *route) bool {
+	if len(r.Spec.Rules) == 0 {
+		return true
+	}
+	for _, rule := range r.Spec.Rules {
+		for _, backendRef := range rule.BackendRefs {
+			if backendRef.Weight == nil || *backendRef.Weight > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Map the rules of a route to the paths it serves. A rule's weight is the sum of its backendRefs' weights if any of
+// them has one, so it works like the weight annotation for the rule's paths. Rules without backendRefs don't serve
+// anything, matches without path or with a regular expression serve all paths. Returns nil if the route serves all
+// paths with the same weight
+func routePaths(r *route) []state.K8RouterIngressPath {
+	var paths []state.K8RouterIngressPath
+	seen := map[state.K8RouterIngressPath]bool{}
+	for _, rule := range r.Spec.Rules {
+		if len(rule.BackendRefs) == 0 {
+			continue
+		}
+		sum := 0
+		weighted := false
+		for _, backendRef := range rule.BackendRefs {
+			if backendRef.Weight == nil {
+				// The Gateway API's default weight
+				sum++
+				continue
+			}
+			sum += int(*backendRef.Weight)
+			weighted = true
+		}
+		var weight *int
+		if weighted {
+			weight = &sum
+		}
+		matches := []state.K8RouterIngressPath{{Path: "/", Prefix: true}}
+		if len(rule.Matches) > 0 {
+			matches = nil
+			for _, match := range rule.Matches {
+				path := state.K8RouterIngressPath{Path: "/", Prefix: true}
+				if match.Path != nil && pathMatchPattern.MatchString(match.Path.Value) {
+					switch match.Path.Type {
+					case "", "PathPrefix":
+						path.Path = strings.TrimRight(match.Path.Value, "/")
+						if path.Path == "" {
+							path.Path = "/"
+						}
+					case "Exact":
+						path = state.K8RouterIngressPath{Path: match.Path.Value}
+					}
+				}
+				matches = append(matches, path)
+			}
+		}
+		for _, path := range matches {
+			// Identical matches of later rules never get any requests
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			path.Weight = weight
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 1 && paths[0].Path == "/" && paths[0].Prefix && paths[0].Weight == nil {
+		return nil
+	}
+	return paths
+}
+
+// Get the hostnames a route gets on a listener. Wildcards only ever cover a single label
+func intersectHostnames(listenerHostname string, routeHostnames []string) []string {
+	if len(routeHostnames) == 0 {
+		if listenerHostname == "" {
+			return nil
+		}
+		return []string{listenerHostname}
+	}
+	if listenerHostname == "" {
+		return routeHostnames
+	}
+	var hosts []string
+	for _, hostname := range routeHostnames {
+		switch {
+		case hostnameCovers(listenerHostname, hostname):
+			hosts = append(hosts, hostname)
+		case hostnameCovers(hostname, listenerHostname):
+			hosts = append(hosts, listenerHostname)
+		}
+	}
+	return hosts
+}
+
+// Check whether a hostname (possibly a wildcard) covers another one
+func hostnameCovers(pattern string, hostname string) bool {
+	if pattern == hostname {
+		return true
+	}
+	if !strings.HasPrefix(pattern, "*.") || strings.HasPrefix(hostname, "*.") {
+		return false
+	}
+	suffix := pattern[1:]
+	return strings.HasSuffix(hostname, suffix) && !strings.Contains(strings.TrimSuffix(hostname, suffix), ".")
+}
+
+// Queue a status update if our part of a route's status changed
+func (c *Cluster) updateRouteStatus(watched *watchedRoute, parents []routeParentStatus) {
+	var current []routeParentStatus
+	for _, parent := range watched.route.Status.Parents {
+		if parent.ControllerName == gatewayControllerName {
+			current = append(current, parent)
+		}
+	}
+	// Keep the transition times of unchanged conditions, so all routers agree on the status
+	now := metav1.Now()
+	for i := range parents {
+		for j := range parents[i].Conditions {
+			condition := &parents[i].Conditions[j]
+			condition.LastTransitionTime = now
+			for _, parent := range current {
+				if !reflect.DeepEqual(parent.ParentRef, parents[i].ParentRef) {
+					continue
+				}
+				for _, known := range parent.Conditions {
+					if known.Type == condition.Type && known.Status == condition.Status {
+						condition.LastTransitionTime = known.LastTransitionTime
+					}
+				}
+			}
+		}
+	}
+	if (len(current) == 0 && len(parents) == 0) || reflect.DeepEqual(current, parents) {
+		return
+	}
+	update := routeStatusUpdate{
+		kind:      watched.kind,
+		namespace: watched.route.Namespace,
+		name:      watched.route.Name,
+		parents:   parents,
+	}
+	select {
+	case c.routeStatusQueue <- update:
+	default:
+		log.WithFields(log.Fields{
+			"cluster": c.config.Name,
+			"route":   update.namespace + "/" + update.name,
+		}).Warning("Route status queue full, dropping status update")
+	}
+}
+
+// Write our part of a route's status. Only called from the watch goroutine which owns the client
+func (c *Cluster) writeRouteStatus(update routeStatusUpdate) {
+	entry := log.WithFields(log.Fields{
+		"cluster": c.config.Name,
+		"kind":    update.kind,
+		"route":   update.namespace + "/" + update.name,
+	})
+	client := c.dynamicClient.Resource(gatewayAPIResources[update.kind]).Namespace(update.namespace)
+	obj, err := client.Get(update.name, metav1.GetOptions{})
+	if err != nil {
+		entry.WithError(err).Debug("Couldn't get route to update its status")
+		return
+	}
+	existing, _, err := unstructured.NestedSlice(obj.Object, "status", "parents")
+	if err != nil {
+		existing = nil
+	}
+	var parents []interface{}
+	for _, parent := range existing {
+		if parentMap, ok := parent.(map[string]interface{}); ok && parentMap["controllerName"] == gatewayControllerName {
+			continue
+		}
+		parents = append(parents, parent)
+	}
+	for _, parent := range update.parents {
+		converted, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&parent)
+		if err != nil {
+			entry.WithError(err).Warning("Couldn't convert route status")
+			return
+		}
+		parents = append(parents, converted)
+	}
+	if err := unstructured.SetNestedSlice(obj.Object, parents, "status", "parents"); err != nil {
+		entry.WithError(err).Warning("Couldn't set route status")
+		return
+	}
+	if _, err := client.UpdateStatus(obj, metav1.UpdateOptions{}); err != nil {
+		entry.WithError(err).Info("Couldn't update route status")
+		return
+	}
+	entry.Debug("Updated route status")
+}
@@ -0,0 +1,293 @@
+package router
+
+import (
+	"github.com/onsi/gomega"
+	"github.com/vsk8s/k8router/pkg/config"
+	"github.com/vsk8s/k8router/pkg/state"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+// Build a Gateway API object
+func gatewayAPIObject(kind string, namespace string, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": gatewayAPIVersions[kind],
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"namespace":  namespace,
+			"name":       name,
+			"generation": int64(1),
+		},
+		"spec": spec,
+	}}
+}
+
+// Build the discovery information of the given Gateway API kinds
+func gatewayAPIResourceLists(kinds ...string) []*metav1.APIResourceList {
+	var lists []*metav1.APIResourceList
+	byGroupVersion := map[string]*metav1.APIResourceList{}
+	for _, kind := range kinds {
+		gvr := gatewayAPIResources[kind]
+		list, ok := byGroupVersion[gvr.GroupVersion().String()]
+		if !ok {
+			list = &metav1.APIResourceList{GroupVersion: gvr.GroupVersion().String()}
+			byGroupVersion[list.GroupVersion] = list
+			lists = append(lists, list)
+		}
+		list.APIResources = append(list.APIResources, metav1.APIResource{Name: gvr.Resource, Kind: kind, Namespaced: true})
+	}
+	return lists
+}
+
+// Get our part of a route's status
+func ourRouteStatus(g *gomega.WithT, uut *Cluster, kind string, namespace string, name string) []interface{} {
+	obj, err := uut.dynamicClient.Resource(gatewayAPIResources[kind]).Namespace(namespace).Get(name, metav1.GetOptions{})
+	g.Expect(err).To(gomega.BeNil())
+	parents, _, _ := unstructured.NestedSlice(obj.Object, "status", "parents")
+	var ours []interface{}
+	for _, parent := range parents {
+		if parent.(map[string]interface{})["controllerName"] == gatewayControllerName {
+			ours = append(ours, parent)
+		}
+	}
+	return ours
+}
+
+// Hostnames of routes attached to our Gateways should be routed like the ones of Ingresses
+func TestGatewayAPIRoutes(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	cfg := config.ClusterInternal{
+		Name:             "fake",
+		IngressNamespace: "ingress-nginx",
+		SyncTLSSecrets:   true,
+		GatewayClass:     "k8router",
+	}
+	_, uut := createFakeClientsetAndUUTWithConfig(t, cfg,
+		gatewayAPIObject(kindGateway, "infra", "edge", map[string]interface{}{
+			"gatewayClassName": "k8router",
+			"listeners": []interface{}{
+				map[string]interface{}{
+					"name":     "https",
+					"protocol": "HTTPS",
+					"port":     int64(443),
+					"hostname": "*.example.org",
+					"tls": map[string]interface{}{
+						"certificateRefs": []interface{}{map[string]interface{}{"name": "wildcard"}},
+					},
+					"allowedRoutes": map[string]interface{}{
+						"namespaces": map[string]interface{}{"from": "All"},
+					},
+				},
+				map[string]interface{}{
+					"name":     "passthrough",
+					"protocol": "TLS",
+					"port":     int64(8443),
+					"tls":      map[string]interface{}{"mode": "Passthrough"},
+				},
+			},
+		}),
+		gatewayAPIObject(kindGateway, "infra", "other", map[string]interface{}{
+			"gatewayClassName": "someone-else",
+		}),
+		gatewayAPIObject(kindHTTPRoute, "shop", "web", map[string]interface{}{
+			"parentRefs": []interface{}{
+				map[string]interface{}{"name": "edge", "namespace": "infra"},
+				map[string]interface{}{"name": "other", "namespace": "infra"},
+			},
+			"hostnames": []interface{}{"shop.example.org", "shop.example.com"},
+			"rules": []interface{}{
+				map[string]interface{}{
+					"backendRefs": []interface{}{
+						map[string]interface{}{"name": "web", "port": int64(80), "weight": int64(90)},
+						map[string]interface{}{"name": "web-canary", "port": int64(80), "weight": int64(10)},
+					},
+				},
+			},
+		}),
+		gatewayAPIObject(kindTLSRoute, "infra", "db", map[string]interface{}{
+			"parentRefs": []interface{}{map[string]interface{}{"name": "edge", "sectionName": "passthrough"}},
+			"hostnames":  []interface{}{"db.example.org"},
+		}),
+	)
+
+	clusterState := waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses["httproute-shop-web"].Hosts) > 0 &&
+			len(clusterState.Ingresses["tlsroute-infra-db"].Hosts) > 0
+	})
+	route := clusterState.Ingresses["httproute-shop-web"]
+	g.Expect(route.Kind).To(gomega.Equal(kindHTTPRoute))
+	g.Expect(route.Namespace).To(gomega.Equal("shop"))
+	g.Expect(route.ObjectName).To(gomega.Equal("web"))
+	g.Expect(route.Hosts).To(gomega.Equal([]string{"shop.example.org"}))
+	g.Expect(route.TLS).To(gomega.Equal([]state.K8RouterIngressTLS{
+		{Hosts: []string{"shop.example.org"}, SecretName: "infra/wildcard"},
+	}))
+	g.Expect(route.Options.SSLPassthrough).To(gomega.BeFalse())
+	// The backendRefs' weights add up to the cluster's weight for the route
+	hundred := 100
+	g.Expect(route.Paths).To(gomega.Equal([]state.K8RouterIngressPath{{Path: "/", Prefix: true, Weight: &hundred}}))
+	passthrough := clusterState.Ingresses["tlsroute-infra-db"]
+	g.Expect(passthrough.Hosts).To(gomega.Equal([]string{"db.example.org"}))
+	g.Expect(passthrough.Options.SSLPassthrough).To(gomega.BeTrue())
+	g.Expect(passthrough.TLS).To(gomega.BeEmpty())
+
+	// Acceptance is reported for our Gateways only
+	g.Eventually(func() []interface{} {
+		return ourRouteStatus(g, uut, kindHTTPRoute, "shop", "web")
+	}).Should(gomega.HaveLen(1))
+	parent := ourRouteStatus(g, uut, kindHTTPRoute, "shop", "web")[0].(map[string]interface{})
+	g.Expect(parent["parentRef"]).To(gomega.Equal(map[string]interface{}{"name": "edge", "namespace": "infra"}))
+	condition := parent["conditions"].([]interface{})[0].(map[string]interface{})
+	g.Expect(condition["type"]).To(gomega.Equal("Accepted"))
+	g.Expect(condition["status"]).To(gomega.Equal("True"))
+	g.Expect(condition["observedGeneration"]).To(gomega.BeEquivalentTo(1))
+	g.Eventually(func() []interface{} {
+		return ourRouteStatus(g, uut, kindTLSRoute, "infra", "db")
+	}).Should(gomega.HaveLen(1))
+	condition = ourRouteStatus(g, uut, kindTLSRoute, "infra", "db")[0].(map[string]interface{})["conditions"].([]interface{})[0].(map[string]interface{})
+	g.Expect(condition["status"]).To(gomega.Equal("True"))
+	g.Expect(condition["reason"]).To(gomega.Equal("Accepted"))
+
+	// Routes disappear with their Gateway
+	g.Expect(uut.dynamicClient.Resource(gatewayAPIResources[kindGateway]).Namespace("infra").Delete("edge", nil)).
+		To(gomega.Succeed())
+	waitForClusterState(t, uut, func(clusterState state.ClusterState) bool {
+		return len(clusterState.Ingresses["httproute-shop-web"].Hosts) == 0
+	})
+	g.Eventually(func() []interface{} {
+		return ourRouteStatus(g, uut, kindHTTPRoute, "shop", "web")
+	}).Should(gomega.BeEmpty())
+
+	uut.Stop()
+}
+
+// Routes only get the hostnames their listeners allow
+func TestRouteAttachment(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	g.Expect(intersectHostnames("", []string{"a.example.org"})).To(gomega.Equal([]string{"a.example.org"}))
+	g.Expect(intersectHostnames("a.example.org", nil)).To(gomega.Equal([]string{"a.example.org"}))
+	g.Expect(intersectHostnames("", nil)).To(gomega.BeEmpty())
+	g.Expect(intersectHostnames("*.example.org", []string{"a.example.org", "a.b.example.org", "example.org"})).To(
+		gomega.Equal([]string{"a.example.org"}))
+	g.Expect(intersectHostnames("a.example.org", []string{"*.example.org", "b.example.org"})).To(
+		gomega.Equal([]string{"a.example.org"}))
+
+	uut := Initialize(config.Cluster{ClusterInternal: &config.ClusterInternal{Name: "fake"}}, nil, nil)
+	gw := gatewayAPIObject(kindGateway, "infra", "edge", map[string]interface{}{
+		"gatewayClassName": "k8router",
+		"listeners": []interface{}{
+			map[string]interface{}{"name": "http", "protocol": "HTTP", "port": int64(80)},
+		},
+	})
+	uut.config.GatewayClass = "k8router"
+	uut.handleGatewayEvent(gw, "ADDED")
+	g.Expect(uut.applyGatewayAPIChange(<-uut.gatewayAPIEvents)).To(gomega.BeFalse(), "No routes yet")
+
+	// Routes of other namespaces aren't allowed by default
+	uut.handleRouteEvent(kindHTTPRoute, gatewayAPIObject(kindHTTPRoute, "shop", "web", map[string]interface{}{
+		"parentRefs": []interface{}{map[string]interface{}{"name": "edge", "namespace": "infra"}},
+		"hostnames":  []interface{}{"shop.example.org"},
+	}), "ADDED")
+	g.Expect(uut.applyGatewayAPIChange(<-uut.gatewayAPIEvents)).To(gomega.BeTrue())
+	g.Expect(uut.currentClusterState.Ingresses["httproute-shop-web"].Hosts).To(gomega.BeEmpty())
+	update := <-uut.routeStatusQueue
+	g.Expect(update.parents[0].Conditions[0].Reason).To(gomega.Equal("NotAllowedByListeners"))
+
+	// Routes without any weighted backend don't attract traffic
+	uut.handleRouteEvent(kindHTTPRoute, gatewayAPIObject(kindHTTPRoute, "infra", "maintenance", map[string]interface{}{
+		"parentRefs": []interface{}{map[string]interface{}{"name": "edge"}},
+		"hostnames":  []interface{}{"maintenance.example.org"},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"backendRefs": []interface{}{map[string]interface{}{"name": "web", "weight": int64(0)}},
+			},
+		},
+	}), "ADDED")
+	uut.applyGatewayAPIChange(<-uut.gatewayAPIEvents)
+	g.Expect(uut.currentClusterState.Ingresses["httproute-infra-maintenance"].Hosts).To(gomega.BeEmpty())
+	update = <-uut.routeStatusQueue
+	g.Expect(update.name).To(gomega.Equal("maintenance"))
+	g.Expect(update.parents[0].Conditions[0].Reason).To(gomega.Equal("Accepted"))
+}
+
+// Path matches and weighted backendRefs of the route's rules are mapped to the paths of its hosts
+func TestRoutePaths(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut := Initialize(config.Cluster{ClusterInternal: &config.ClusterInternal{Name: "fake"}}, nil, nil)
+	paths := func(rules ...interface{}) []state.K8RouterIngressPath {
+		uut.handleRouteEvent(kindHTTPRoute, gatewayAPIObject(kindHTTPRoute, "shop", "web", map[string]interface{}{
+			"rules": rules,
+		}), "ADDED")
+		return (<-uut.gatewayAPIEvents).route.ingress.Paths
+	}
+	match := func(pathType string, value string) interface{} {
+		return map[string]interface{}{"path": map[string]interface{}{"type": pathType, "value": value}}
+	}
+	backend := map[string]interface{}{"name": "web"}
+	weighted := func(weight int64) interface{} { return map[string]interface{}{"name": "web", "weight": weight} }
+
+	g.Expect(paths()).To(gomega.BeNil())
+	g.Expect(paths(map[string]interface{}{"backendRefs": []interface{}{backend}})).To(gomega.BeNil())
+	// Header matches are left to the Gateway implementation
+	g.Expect(paths(map[string]interface{}{
+		"matches":     []interface{}{map[string]interface{}{"headers": []interface{}{}}},
+		"backendRefs": []interface{}{backend},
+	})).To(gomega.BeNil())
+
+	ten := 10
+	zero := 0
+	g.Expect(paths(
+		map[string]interface{}{
+			"matches":     []interface{}{match("PathPrefix", "/api/"), match("Exact", "/health")},
+			"backendRefs": []interface{}{weighted(7), backend, weighted(2)},
+		},
+		map[string]interface{}{
+			"matches":     []interface{}{match("PathPrefix", "/static"), match("Exact", "/health")},
+			"backendRefs": []interface{}{weighted(0)},
+		},
+		map[string]interface{}{
+			"matches":     []interface{}{match("RegularExpression", "/v[0-9]+"), match("Exact", "/in valid")},
+			"backendRefs": []interface{}{backend},
+		},
+		map[string]interface{}{
+			"matches": []interface{}{match("PathPrefix", "/unserved")},
+		},
+	)).To(gomega.Equal([]state.K8RouterIngressPath{
+		{Path: "/api", Prefix: true, Weight: &ten},
+		{Path: "/health", Weight: &ten},
+		{Path: "/static", Prefix: true, Weight: &zero},
+		{Path: "/", Prefix: true},
+	}))
+}
+
+// Only installed Gateway API kinds are watched, as the informers of missing ones would never sync
+func TestGatewayAPIDiscovery(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	uut := Initialize(config.Cluster{ClusterInternal: &config.ClusterInternal{Name: "fake", GatewayClass: "k8router"}},
+		nil, nil)
+	client := fake.NewSimpleClientset()
+	client.Resources = gatewayAPIResourceLists(kindGateway, kindHTTPRoute)
+	uut.client = client
+	uut.dynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	installed, err := uut.installedGatewayAPIKinds()
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(installed).To(gomega.Equal(map[string]bool{kindGateway: true, kindHTTPRoute: true}))
+	stopper := make(chan struct{})
+	defer close(stopper)
+	stores, synced := uut.watchGatewayAPI(stopper, installed, nil)
+	g.Expect(stores).To(gomega.HaveLen(2))
+	g.Expect(stores).NotTo(gomega.HaveKey(kindTLSRoute))
+	g.Expect(synced).To(gomega.HaveLen(2))
+	g.Expect(cache.WaitForCacheSync(stopper, synced...)).To(gomega.BeTrue())
+
+	// Without Gateways, routes can't attach to anything
+	stores, synced = uut.watchGatewayAPI(stopper, map[string]bool{kindHTTPRoute: true}, nil)
+	g.Expect(stores).To(gomega.BeEmpty())
+	g.Expect(synced).To(gomega.BeEmpty())
+}
@@ -0,0 +1,145 @@
+package router
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/vsk8s/k8router/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Which objects of a cluster are watched. The API server filters most objects already, but the handlers check again
+// since not all clients do
+type watchScope struct {
+	// Namespaces to watch Ingresses and Services in (all if empty)
+	namespaces []string
+	// Namespaces to never watch Ingresses and Services in
+	excluded map[string]bool
+
+	ingressSelector labels.Selector
+	serviceSelector labels.Selector
+	podSelector     labels.Selector
+}
+
+// Build the watch scope from the cluster config
+func newWatchScope(cfg *config.ClusterInternal) watchScope {
+	scope := watchScope{
+		namespaces: cfg.Namespaces,
+		excluded:   map[string]bool{},
+	}
+	for _, namespace := range cfg.ExcludedNamespaces {
+		scope.excluded[namespace] = true
+	}
+	scope.ingressSelector = parseSelector(cfg.Name, cfg.IngressSelector)
+	scope.serviceSelector = parseSelector(cfg.Name, cfg.ServiceSelector)
+	// All pods in the ingress namespace are ingress pods unless configured otherwise
+	scope.podSelector = parseSelector(cfg.Name, cfg.PodSelector)
+	return scope
+}
+
+// Parse a label selector which has already been validated with the config
+func parseSelector(cluster string, selector string) labels.Selector {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cluster":  cluster,
+			"selector": selector,
+		}).WithError(err).Error("Invalid label selector, selecting everything")
+		return labels.Everything()
+	}
+	return parsed
+}
+
+// Check whether Ingresses and Services in a namespace are watched
+func (s *watchScope) namespaceWatched(namespace string) bool {
+	if s.excluded[namespace] {
+		return false
+	}
+	if len(s.namespaces) == 0 {
+		return true
+	}
+	return containsString(s.namespaces, namespace)
+}
+
+// Check whether an object in a namespace with the given labels is watched
+func (s *watchScope) matches(selector labels.Selector, namespace string, objLabels map[string]string) bool {
+	return s.namespaceWatched(namespace) && selector.Matches(labels.Set(objLabels))
+}
+
+// Create the informer factories for Ingresses, Services or Secrets: one per allowed namespace, or a single one for
+// all namespaces which skips the excluded ones
+func (s *watchScope) informerFactories(client kubernetes.Interface, selector labels.Selector) []informers.SharedInformerFactory {
+	var excluded []fields.Selector
+	for namespace := range s.excluded {
+		excluded = append(excluded, fields.OneTermNotEqualSelector("metadata.namespace", namespace))
+	}
+	tweak := informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = selector.String()
+		if len(s.namespaces) == 0 && len(excluded) > 0 {
+			options.FieldSelector = fields.AndSelectors(excluded...).String()
+		}
+	})
+	if len(s.namespaces) == 0 {
+		return []informers.SharedInformerFactory{
+			informers.NewSharedInformerFactoryWithOptions(client, 0, tweak),
+		}
+	}
+	var factories []informers.SharedInformerFactory
+	for _, namespace := range s.namespaces {
+		if s.excluded[namespace] {
+			continue
+		}
+		factories = append(factories, informers.NewSharedInformerFactoryWithOptions(client, 0,
+			informers.WithNamespace(namespace), tweak))
+	}
+	return factories
+}
+
+// Create the informer factories for Gateway API objects, split like the ones for Ingresses
+func (s *watchScope) dynamicInformerFactories(client dynamic.Interface,
+	selector labels.Selector) []dynamicinformer.DynamicSharedInformerFactory {
+	var excluded []fields.Selector
+	for namespace := range s.excluded {
+		excluded = append(excluded, fields.OneTermNotEqualSelector("metadata.namespace", namespace))
+	}
+	tweak := func(options *metav1.ListOptions) {
+		options.LabelSelector = selector.String()
+		if len(s.namespaces) == 0 && len(excluded) > 0 {
+			options.FieldSelector = fields.AndSelectors(excluded...).String()
+		}
+	}
+	if len(s.namespaces) == 0 {
+		return []dynamicinformer.DynamicSharedInformerFactory{
+			dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, metav1.NamespaceAll, tweak),
+		}
+	}
+	var factories []dynamicinformer.DynamicSharedInformerFactory
+	for _, namespace := range s.namespaces {
+		if s.excluded[namespace] {
+			continue
+		}
+		factories = append(factories, dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, tweak))
+	}
+	return factories
+}
+
+// Create the informer factory for the ingress pods
+func (s *watchScope) podInformerFactory(client kubernetes.Interface, namespace string) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = s.podSelector.String()
+		}))
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
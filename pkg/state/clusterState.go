@@ -3,12 +3,83 @@ package state
 import (
 	v1 "k8s.io/api/core/v1"
 	"net"
+	"time"
 )
 
 // K8RouterIngress contains all ingress-related information
 type K8RouterIngress struct {
-	Name  string
+	Name string
+	// Kind, namespace and name of the object the hosts come from. The kind is empty for Ingresses
+	Kind       string
+	Namespace  string
+	ObjectName string
+	Hosts      []string
+	TLS        []K8RouterIngressTLS
+	// Traffic weight of this cluster for the ingress' hosts (nil to use the cluster's weight)
+	Weight *int
+	// Priority of this cluster for the ingress' hosts (nil to use the cluster's priority)
+	Priority *int
+	// Paths the ingress serves on its hosts, all paths if empty
+	Paths []K8RouterIngressPath
+	// Per-host HAProxy behavior
+	Options K8RouterIngressOptions
+	// Host patterns the ingress' namespace claims via annotation (only set for clusters trusting these claims)
+	NamespaceClaims []string
+}
+
+// K8RouterIngressOptions contains the HAProxy behavior for an ingress' hosts as configured via annotations
+type K8RouterIngressOptions struct {
+	// Redirect plain HTTP requests to HTTPS
+	ForceHTTPS bool
+	// Source IP ranges (CIDR) allowed to access the hosts, everybody if empty
+	AllowedSourceRanges []string
+	// Max age of the Strict-Transport-Security header, no header if zero
+	HSTSMaxAge time.Duration
+	// Whether the Strict-Transport-Security header should include subdomains
+	HSTSIncludeSubdomains bool
+	// Time the client has to send the request, HAProxy default if zero
+	RequestTimeout time.Duration
+	// Time the backend has to respond, HAProxy default if zero
+	ResponseTimeout time.Duration
+	// Maximum request body size in bytes, unlimited if zero
+	MaxBodySize int64
+	// Name of the HAProxy userlist to authenticate requests against, no authentication if empty
+	BasicAuthUserlist string
+	// Realm to use for basic authentication
+	BasicAuthRealm string
+	// Pass TLS connections through to the cluster without decrypting them
+	SSLPassthrough bool
+	// Client certificate verification ('required', 'optional' or 'off'), the certificate's setting if empty
+	ClientVerify string
+	// Protocol to talk to the ingress pods with ('http/1.1' or 'h2'), the cluster's setting if empty
+	BackendProtocol string
+}
+
+// K8RouterIngressPath is a path an ingress serves on its hosts
+type K8RouterIngressPath struct {
+	// Path to match, without trailing slash unless it is '/'
+	Path string
+	// Whether requests for paths below the path match as well (by path element, so '/a' matches '/a/b' but not '/ab')
+	Prefix bool
+	// Traffic weight of this cluster for the path (nil to use the ingress' weight)
+	Weight *int
+}
+
+// K8RouterIngressTLS is a TLS block of an ingress
+type K8RouterIngressTLS struct {
 	Hosts []string
+	// Namespace and name of the referenced secret, separated by '/'
+	SecretName string
+}
+
+// K8RouterCertificate is a TLS certificate synced from a Kubernetes secret
+type K8RouterCertificate struct {
+	// Namespace and name of the secret, separated by '/'
+	Name string
+	// Hosts of all ingresses referencing this certificate
+	Hosts []string
+	// Concatenated x509 chain and key in PEM format
+	PEM []byte
 }
 
 // K8RouterBackend contains all backend-related information
@@ -25,27 +96,104 @@ type LoadBalancer struct {
 	Protocol v1.Protocol
 }
 
-// ClusterState contains the full state of a given ClusterInternal. This should be enough to build the haproxy config
+// ClusterState contains the full state of a given ClusterInternal. This should be enough to build the haproxy config.
+// The objects contained in a published state must not be modified, use Copy() to derive a new state
 type ClusterState struct {
-	Name      string
-	Ingresses []K8RouterIngress
-	Backends  []K8RouterBackend
+	Name string
+	// Number of this snapshot, increases with every published state of the cluster
+	Generation uint64
+	// Ingresses by name
+	Ingresses map[string]K8RouterIngress
+	// Ingress pods by name
+	Backends map[string]K8RouterBackend
+	// Certificates synced from TLS secrets by secret name
+	Certificates map[string]K8RouterCertificate
+}
+
+// NewClusterState creates an empty state for a cluster
+func NewClusterState(name string) ClusterState {
+	return ClusterState{
+		Name:         name,
+		Ingresses:    map[string]K8RouterIngress{},
+		Backends:     map[string]K8RouterBackend{},
+		Certificates: map[string]K8RouterCertificate{},
+	}
+}
+
+// Copy the state so that objects can be added or removed without affecting the original
+func (s *ClusterState) Copy() ClusterState {
+	result := NewClusterState(s.Name)
+	result.Generation = s.Generation
+	for name, ingress := range s.Ingresses {
+		result.Ingresses[name] = ingress
+	}
+	for name, backend := range s.Backends {
+		result.Backends[name] = backend
+	}
+	for name, cert := range s.Certificates {
+		result.Certificates[name] = cert
+	}
+	return result
+}
+
+// AddIngress adds an ingress to the state, replacing any ingress with the same name
+func (s *ClusterState) AddIngress(ingress K8RouterIngress) {
+	if s.Ingresses == nil {
+		s.Ingresses = map[string]K8RouterIngress{}
+	}
+	s.Ingresses[ingress.Name] = ingress
+}
+
+// AddBackend adds a backend to the state, replacing any backend with the same name
+func (s *ClusterState) AddBackend(backend K8RouterBackend) {
+	if s.Backends == nil {
+		s.Backends = map[string]K8RouterBackend{}
+	}
+	s.Backends[backend.Name] = backend
 }
 
-// IngressChange represents an ingress change event
+// AddCertificate adds a certificate to the state, replacing any certificate with the same name
+func (s *ClusterState) AddCertificate(cert K8RouterCertificate) {
+	if s.Certificates == nil {
+		s.Certificates = map[string]K8RouterCertificate{}
+	}
+	s.Certificates[cert.Name] = cert
+}
+
+// IngressChange represents an ingress change event. Created is set for new or modified ingresses
 type IngressChange struct {
 	Ingress K8RouterIngress
 	Created bool
 }
 
-// BackendChange contains a backend change event
+// BackendChange contains a backend change event. Created is set for new or modified backends
 type BackendChange struct {
 	Backend K8RouterBackend
 	Created bool
 }
 
+// CertificateChange is a TLS secret change event. Created is set for new or modified secrets
+type CertificateChange struct {
+	Certificate K8RouterCertificate
+	Created     bool
+}
+
 // LoadBalancerChange is a change in a loadbalancer event
 type LoadBalancerChange struct {
 	Service LoadBalancer
 	Created bool
 }
+
+// IngressEvent is something the owners of an ingress should know about
+type IngressEvent struct {
+	// Cluster, namespace and name of the object. The kind is empty for Ingresses
+	Cluster   string
+	Kind      string
+	Namespace string
+	Name      string
+	// Whether something is wrong (or just informational)
+	Warning bool
+	// Short machine-readable reason, e.g. 'HostRejected'
+	Reason  string
+	Message string
+}
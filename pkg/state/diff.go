@@ -0,0 +1,138 @@
+package state
+
+import "sort"
+
+// ClusterStateDiff describes what changed between two states of a cluster. Changed objects are contained in their new
+// version. All lists are sorted by name
+type ClusterStateDiff struct {
+	AddedIngresses   []K8RouterIngress
+	RemovedIngresses []K8RouterIngress
+	ChangedIngresses []K8RouterIngress
+
+	AddedBackends   []K8RouterBackend
+	RemovedBackends []K8RouterBackend
+	ChangedBackends []K8RouterBackend
+
+	AddedCertificates   []K8RouterCertificate
+	RemovedCertificates []K8RouterCertificate
+	ChangedCertificates []K8RouterCertificate
+}
+
+// Diff computes the changes from one state of a cluster to another
+func Diff(oldState *ClusterState, newState *ClusterState) ClusterStateDiff {
+	diff := ClusterStateDiff{}
+
+	names := map[string]bool{}
+	for name := range oldState.Ingresses {
+		names[name] = true
+	}
+	for name := range newState.Ingresses {
+		names[name] = true
+	}
+	for _, name := range sortedNames(names) {
+		oldIngress, inOld := oldState.Ingresses[name]
+		newIngress, inNew := newState.Ingresses[name]
+		switch {
+		case !inOld:
+			diff.AddedIngresses = append(diff.AddedIngresses, newIngress)
+		case !inNew:
+			diff.RemovedIngresses = append(diff.RemovedIngresses, oldIngress)
+		case !IsIngressEquivalent(&oldIngress, &newIngress):
+			diff.ChangedIngresses = append(diff.ChangedIngresses, newIngress)
+		}
+	}
+
+	names = map[string]bool{}
+	for name := range oldState.Backends {
+		names[name] = true
+	}
+	for name := range newState.Backends {
+		names[name] = true
+	}
+	for _, name := range sortedNames(names) {
+		oldBackend, inOld := oldState.Backends[name]
+		newBackend, inNew := newState.Backends[name]
+		switch {
+		case !inOld:
+			diff.AddedBackends = append(diff.AddedBackends, newBackend)
+		case !inNew:
+			diff.RemovedBackends = append(diff.RemovedBackends, oldBackend)
+		case !IsBackendEquivalent(&oldBackend, &newBackend):
+			diff.ChangedBackends = append(diff.ChangedBackends, newBackend)
+		}
+	}
+
+	names = map[string]bool{}
+	for name := range oldState.Certificates {
+		names[name] = true
+	}
+	for name := range newState.Certificates {
+		names[name] = true
+	}
+	for _, name := range sortedNames(names) {
+		oldCert, inOld := oldState.Certificates[name]
+		newCert, inNew := newState.Certificates[name]
+		switch {
+		case !inOld:
+			diff.AddedCertificates = append(diff.AddedCertificates, newCert)
+		case !inNew:
+			diff.RemovedCertificates = append(diff.RemovedCertificates, oldCert)
+		case !IsCertificateEquivalent(&oldCert, &newCert):
+			diff.ChangedCertificates = append(diff.ChangedCertificates, newCert)
+		}
+	}
+	return diff
+}
+
+// IsEmpty checks whether nothing changed at all
+func (d *ClusterStateDiff) IsEmpty() bool {
+	return d.OnlyBackendAddressesChanged() && len(d.ChangedBackends) == 0
+}
+
+// OnlyBackendAddressesChanged checks whether the only changes are the IPs of existing backends. These can be applied
+// to a running HAProxy without reloading it
+func (d *ClusterStateDiff) OnlyBackendAddressesChanged() bool {
+	return len(d.AddedIngresses) == 0 && len(d.RemovedIngresses) == 0 && len(d.ChangedIngresses) == 0 &&
+		len(d.AddedBackends) == 0 && len(d.RemovedBackends) == 0 &&
+		len(d.AddedCertificates) == 0 && len(d.RemovedCertificates) == 0 && len(d.ChangedCertificates) == 0
+}
+
+// Summary lists the names of all changed objects by kind of change, e.g. for logging
+func (d *ClusterStateDiff) Summary() map[string][]string {
+	summary := map[string][]string{}
+	addIngresses := func(kind string, ingresses []K8RouterIngress) {
+		for _, ingress := range ingresses {
+			summary[kind] = append(summary[kind], ingress.Name)
+		}
+	}
+	addBackends := func(kind string, backends []K8RouterBackend) {
+		for _, backend := range backends {
+			summary[kind] = append(summary[kind], backend.Name)
+		}
+	}
+	addCertificates := func(kind string, certificates []K8RouterCertificate) {
+		for _, cert := range certificates {
+			summary[kind] = append(summary[kind], cert.Name)
+		}
+	}
+	addIngresses("addedIngresses", d.AddedIngresses)
+	addIngresses("removedIngresses", d.RemovedIngresses)
+	addIngresses("changedIngresses", d.ChangedIngresses)
+	addBackends("addedBackends", d.AddedBackends)
+	addBackends("removedBackends", d.RemovedBackends)
+	addBackends("changedBackends", d.ChangedBackends)
+	addCertificates("addedCertificates", d.AddedCertificates)
+	addCertificates("removedCertificates", d.RemovedCertificates)
+	addCertificates("changedCertificates", d.ChangedCertificates)
+	return summary
+}
+
+// Get a sorted list of names from a set
+func sortedNames(names map[string]bool) []string {
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
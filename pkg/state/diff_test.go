@@ -0,0 +1,199 @@
+package state
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+// Generate implements quick.Generator. Names are drawn from a small pool so that states generated independently
+// overlap
+func (ClusterState) Generate(rand *rand.Rand, size int) reflect.Value {
+	clusterState := NewClusterState("cluster")
+	pick := func(prefix string, pool int) string {
+		return prefix + strconv.Itoa(rand.Intn(pool))
+	}
+	seen := map[string]bool{}
+	for i := rand.Intn(6); i > 0; i-- {
+		name := pick("ingress-", 8)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ingress := K8RouterIngress{Name: name}
+		for j := rand.Intn(3) + 1; j > 0; j-- {
+			ingress.Hosts = append(ingress.Hosts, pick("host", 4)+".example.org")
+		}
+		if rand.Intn(2) == 0 {
+			weight := rand.Intn(3)
+			ingress.Weight = &weight
+		}
+		if rand.Intn(2) == 0 {
+			ingress.TLS = []K8RouterIngressTLS{{Hosts: ingress.Hosts, SecretName: pick("app/secret-", 2)}}
+		}
+		if rand.Intn(2) == 0 {
+			ingress.Paths = []K8RouterIngressPath{{Path: "/", Prefix: true}, {Path: pick("/path", 2), Prefix: rand.Intn(2) == 0}}
+		}
+		ingress.Options.ForceHTTPS = rand.Intn(2) == 0
+		clusterState.AddIngress(ingress)
+	}
+	for i := rand.Intn(6); i > 0; i-- {
+		name := pick("pod-", 8)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ip := net.IPv4(10, 0, 0, byte(rand.Intn(3)))
+		clusterState.AddBackend(K8RouterBackend{Name: name, IP: &ip})
+	}
+	for i := rand.Intn(3); i > 0; i-- {
+		name := pick("app/cert-", 4)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		clusterState.AddCertificate(K8RouterCertificate{
+			Name:  name,
+			Hosts: []string{pick("host", 4) + ".example.org"},
+			PEM:   []byte(pick("pem", 2)),
+		})
+	}
+	return reflect.ValueOf(clusterState)
+}
+
+// Copy a cluster state with all lists inside its objects reversed
+func reversed(clusterState ClusterState) ClusterState {
+	result := clusterState.Copy()
+	reverse := func(list []string) []string {
+		var reversedList []string
+		for i := len(list) - 1; i >= 0; i-- {
+			reversedList = append(reversedList, list[i])
+		}
+		return reversedList
+	}
+	for name, ingress := range result.Ingresses {
+		ingress.Hosts = reverse(ingress.Hosts)
+		var tls []K8RouterIngressTLS
+		for i := len(ingress.TLS) - 1; i >= 0; i-- {
+			tls = append(tls, K8RouterIngressTLS{Hosts: reverse(ingress.TLS[i].Hosts), SecretName: ingress.TLS[i].SecretName})
+		}
+		ingress.TLS = tls
+		var paths []K8RouterIngressPath
+		for i := len(ingress.Paths) - 1; i >= 0; i-- {
+			paths = append(paths, ingress.Paths[i])
+		}
+		ingress.Paths = paths
+		result.Ingresses[name] = ingress
+	}
+	for name, cert := range result.Certificates {
+		cert.Hosts = reverse(cert.Hosts)
+		result.Certificates[name] = cert
+	}
+	return result
+}
+
+// Apply a diff to a state. Only names are tracked, which is enough to check added/removed
+func applyDiff(clusterState ClusterState, diff ClusterStateDiff) map[string]bool {
+	names := map[string]bool{}
+	for _, ingress := range clusterState.Ingresses {
+		names["ingress/"+ingress.Name] = true
+	}
+	for _, backend := range clusterState.Backends {
+		names["backend/"+backend.Name] = true
+	}
+	for _, cert := range clusterState.Certificates {
+		names["cert/"+cert.Name] = true
+	}
+	for _, ingress := range diff.AddedIngresses {
+		names["ingress/"+ingress.Name] = true
+	}
+	for _, ingress := range diff.RemovedIngresses {
+		delete(names, "ingress/"+ingress.Name)
+	}
+	for _, backend := range diff.AddedBackends {
+		names["backend/"+backend.Name] = true
+	}
+	for _, backend := range diff.RemovedBackends {
+		delete(names, "backend/"+backend.Name)
+	}
+	for _, cert := range diff.AddedCertificates {
+		names["cert/"+cert.Name] = true
+	}
+	for _, cert := range diff.RemovedCertificates {
+		delete(names, "cert/"+cert.Name)
+	}
+	return names
+}
+
+func TestDiffOfEqualStatesIsEmpty(t *testing.T) {
+	property := func(clusterState ClusterState) bool {
+		diff := Diff(&clusterState, &clusterState)
+		return diff.IsEmpty() && IsClusterStateEquivalent(&clusterState, &clusterState)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiffIgnoresOrder(t *testing.T) {
+	property := func(clusterState ClusterState) bool {
+		shuffled := reversed(clusterState)
+		diff := Diff(&clusterState, &shuffled)
+		return diff.IsEmpty() && IsClusterStateEquivalent(&clusterState, &shuffled)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiffTransformsStates(t *testing.T) {
+	property := func(a ClusterState, b ClusterState) bool {
+		diff := Diff(&a, &b)
+		return reflect.DeepEqual(applyDiff(a, diff), applyDiff(b, ClusterStateDiff{})) &&
+			diff.IsEmpty() == IsClusterStateEquivalent(&a, &b)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiffIsSymmetric(t *testing.T) {
+	property := func(a ClusterState, b ClusterState) bool {
+		forward := Diff(&a, &b)
+		backward := Diff(&b, &a)
+		return reflect.DeepEqual(forward.AddedIngresses, backward.RemovedIngresses) &&
+			reflect.DeepEqual(forward.AddedBackends, backward.RemovedBackends) &&
+			reflect.DeepEqual(forward.AddedCertificates, backward.RemovedCertificates) &&
+			len(forward.ChangedIngresses) == len(backward.ChangedIngresses) &&
+			len(forward.ChangedBackends) == len(backward.ChangedBackends) &&
+			len(forward.ChangedCertificates) == len(backward.ChangedCertificates)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// Changing a backend's IP is the only change which doesn't require a reload
+func TestDiffBackendAddressChange(t *testing.T) {
+	property := func(clusterState ClusterState) bool {
+		if len(clusterState.Backends) == 0 {
+			return true
+		}
+		changed := reversed(clusterState)
+		ip := net.IPv4(192, 0, 2, 1)
+		for name, backend := range changed.Backends {
+			backend.IP = &ip
+			changed.Backends[name] = backend
+			break
+		}
+		diff := Diff(&clusterState, &changed)
+		return !diff.IsEmpty() && diff.OnlyBackendAddressesChanged() && len(diff.ChangedBackends) == 1 &&
+			diff.ChangedBackends[0].IP.Equal(ip)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,5 +1,12 @@
 package state
 
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 // IsBackendEquivalent checks whether two backends are equivalent in the context of update coalescing
 func IsBackendEquivalent(backendA *K8RouterBackend, backendB *K8RouterBackend) bool {
 	if backendA == nil || backendB == nil {
@@ -8,6 +15,9 @@ func IsBackendEquivalent(backendA *K8RouterBackend, backendB *K8RouterBackend) b
 	if backendA.Name != backendB.Name {
 		return false
 	}
+	if backendA.IP == nil || backendB.IP == nil {
+		return backendA.IP == backendB.IP
+	}
 	return backendA.IP.Equal(*backendB.IP)
 }
 
@@ -16,43 +26,111 @@ func IsIngressEquivalent(ingressA *K8RouterIngress, ingressB *K8RouterIngress) b
 	if ingressA == nil || ingressB == nil {
 		return false
 	}
-	if ingressA.Name != ingressB.Name {
+	if ingressA.Name != ingressB.Name || ingressA.Kind != ingressB.Kind || ingressA.Namespace != ingressB.Namespace ||
+		ingressA.ObjectName != ingressB.ObjectName {
 		return false
 	}
-	if len(ingressA.Hosts) != len(ingressB.Hosts) {
+	if !isStringSetEqual(ingressA.NamespaceClaims, ingressB.NamespaceClaims) {
 		return false
 	}
-	for index, value := range ingressA.Hosts {
-		if ingressB.Hosts[index] != value {
-			return false
+	if !isStringSetEqual(ingressA.Hosts, ingressB.Hosts) {
+		return false
+	}
+	if !isIntPointerEqual(ingressA.Weight, ingressB.Weight) || !isIntPointerEqual(ingressA.Priority, ingressB.Priority) {
+		return false
+	}
+	if !IsIngressOptionsEquivalent(&ingressA.Options, &ingressB.Options) {
+		return false
+	}
+	if !isStringSetEqual(pathKeys(ingressA.Paths), pathKeys(ingressB.Paths)) {
+		return false
+	}
+	return isStringSetEqual(tlsKeys(ingressA.TLS), tlsKeys(ingressB.TLS))
+}
+
+// Get an order-independent representation of paths
+func pathKeys(paths []K8RouterIngressPath) []string {
+	var keys []string
+	for _, path := range paths {
+		weight := "-"
+		if path.Weight != nil {
+			weight = strconv.Itoa(*path.Weight)
 		}
+		keys = append(keys, path.Path+"\x00"+strconv.FormatBool(path.Prefix)+"\x00"+weight)
 	}
-	return true
+	return keys
 }
 
-// IsClusterStateEquivalent checks whether two whole cluster state objects are equivalent in the context of update coalescing
-func IsClusterStateEquivalent(clusterA *ClusterState, clusterB *ClusterState) bool {
-	if clusterA == nil || clusterB == nil {
-		return false
+// Get an order-independent representation of TLS blocks
+func tlsKeys(tls []K8RouterIngressTLS) []string {
+	var keys []string
+	for _, block := range tls {
+		hosts := append([]string{}, block.Hosts...)
+		sort.Strings(hosts)
+		keys = append(keys, block.SecretName+"\x00"+strings.Join(hosts, "\x00"))
 	}
-	if clusterA.Name != clusterB.Name {
+	return keys
+}
+
+// IsIngressOptionsEquivalent checks whether two sets of ingress options result in the same HAProxy behavior
+func IsIngressOptionsEquivalent(optionsA *K8RouterIngressOptions, optionsB *K8RouterIngressOptions) bool {
+	return optionsA.ForceHTTPS == optionsB.ForceHTTPS &&
+		isStringSetEqual(optionsA.AllowedSourceRanges, optionsB.AllowedSourceRanges) &&
+		optionsA.HSTSMaxAge == optionsB.HSTSMaxAge &&
+		optionsA.HSTSIncludeSubdomains == optionsB.HSTSIncludeSubdomains &&
+		optionsA.RequestTimeout == optionsB.RequestTimeout &&
+		optionsA.ResponseTimeout == optionsB.ResponseTimeout &&
+		optionsA.MaxBodySize == optionsB.MaxBodySize &&
+		optionsA.BasicAuthUserlist == optionsB.BasicAuthUserlist &&
+		optionsA.BasicAuthRealm == optionsB.BasicAuthRealm &&
+		optionsA.SSLPassthrough == optionsB.SSLPassthrough &&
+		optionsA.ClientVerify == optionsB.ClientVerify &&
+		optionsA.BackendProtocol == optionsB.BackendProtocol
+}
+
+// IsCertificateEquivalent checks whether two certificates are equivalent in the context of update coalescing
+func IsCertificateEquivalent(certA *K8RouterCertificate, certB *K8RouterCertificate) bool {
+	if certA == nil || certB == nil {
 		return false
 	}
-	if len(clusterA.Backends) != len(clusterB.Backends) {
+	if certA.Name != certB.Name || !isStringSetEqual(certA.Hosts, certB.Hosts) {
 		return false
 	}
-	for index, value := range clusterA.Backends {
-		if IsBackendEquivalent(&clusterB.Backends[index], &value) {
+	return bytes.Equal(certA.PEM, certB.PEM)
+}
+
+func isIntPointerEqual(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Check whether two slices contain the same strings, ignoring order and duplicates
+func isStringSetEqual(a []string, b []string) bool {
+	setA := map[string]bool{}
+	for _, value := range a {
+		setA[value] = true
+	}
+	setB := map[string]bool{}
+	for _, value := range b {
+		if !setA[value] {
 			return false
 		}
+		setB[value] = true
 	}
-	if len(clusterA.Ingresses) != len(clusterB.Ingresses) {
+	return len(setA) == len(setB)
+}
+
+// IsClusterStateEquivalent checks whether two whole cluster state objects are equivalent in the context of update
+// coalescing. The order of ingresses, backends and certificates doesn't matter
+func IsClusterStateEquivalent(clusterA *ClusterState, clusterB *ClusterState) bool {
+	if clusterA == nil || clusterB == nil {
 		return false
 	}
-	for index, value := range clusterA.Ingresses {
-		if IsIngressEquivalent(&clusterB.Ingresses[index], &value) {
-			return false
-		}
+	if clusterA.Name != clusterB.Name {
+		return false
 	}
-	return true
+	diff := Diff(clusterA, clusterB)
+	return diff.IsEmpty()
 }